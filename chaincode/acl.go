@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- access control ------------------------------------------
+
+// ACLPolicyKey is the key of the singleton ACL policy.
+const ACLPolicyKey = "ACLPolicy"
+
+// Rule effects.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Wildcard matches any role, org, action or resource state in an ACLRule.
+const Wildcard = "*"
+
+// GovernanceRole is the AdminRole of admins who propose and vote on system
+// changes, see governance.go.
+const GovernanceRole = "governance"
+
+// Actions checked by the authorizer in addition to the delegable ones.
+const (
+	ActionManageUser         = "manage_user"
+	ActionDecideRegistration = "decide_registration"
+	ActionUpdateOrganization = "update_organization"
+	ActionGrantDelegation    = "grant_delegation"
+	ActionGovern             = "govern"
+	ActionManageFacility     = "manage_facility"
+	ActionManageInventory    = "manage_inventory"
+	ActionPlaceOrder         = "place_order"
+	ActionFulfillOrder       = "fulfill_order"
+	ActionIssueInvoice       = "issue_invoice"
+	ActionApproveInvoice     = "approve_invoice"
+	ActionFeedFXRates        = "feed_fx_rates"
+	ActionSetTelemetryRange  = "set_telemetry_range"
+	ActionRecordTelemetry    = "record_telemetry"
+	ActionManageDevice       = "manage_device"
+	ActionInspect            = "inspect"
+	ActionDisposeQuality     = "dispose_quality"
+)
+
+// ACLRule allows or denies Action to users with Role in OrgID while the
+// resource is in ResourceState. For products the resource state is the
+// product status, for users and registrations it is the user type concerned
+// and for governance it is the kind of change proposed.
+// Admins match both "admin" and "admin:<AdminRole>".
+type ACLRule struct {
+	RuleID        string `json:"RuleID"`
+	Role          string `json:"Role"`
+	OrgID         string `json:"OrgID"`
+	Action        string `json:"Action"`
+	ResourceState string `json:"ResourceState"`
+	Effect        string `json:"Effect"`
+	Priority      int    `json:"Priority"`
+	Description   string `json:"Description"`
+}
+
+// ACLPolicy is the ordered set of rules the authorizer evaluates.
+type ACLPolicy struct {
+	DocType  string    `json:"DocType"`
+	PolicyID string    `json:"PolicyID"`
+	Rules    []ACLRule `json:"Rules"`
+}
+
+// AccessDecision explains the outcome of an authorization.
+type AccessDecision struct {
+	Allowed      bool      `json:"Allowed"`
+	RuleID       string    `json:"RuleID"`
+	Reason       string    `json:"Reason"`
+	MatchedRules []ACLRule `json:"MatchedRules"`
+}
+
+// defaultACLRules reproduce the checks the transactions used to hard-code.
+func defaultACLRules() []ACLRule {
+	return []ACLRule{
+		{RuleID: "manufacturer-create", Role: "manufacturer", OrgID: Wildcard, Action: ActionCreateProduct, ResourceState: Wildcard, Effect: EffectAllow, Description: "manufacturers create products"},
+		{RuleID: "customer-no-update", Role: "customer", OrgID: Wildcard, Action: ActionUpdateProduct, ResourceState: Wildcard, Effect: EffectDeny, Priority: 10, Description: "customers can not update products"},
+		{RuleID: "manufacturer-update", Role: "manufacturer", OrgID: Wildcard, Action: ActionUpdateProduct, ResourceState: Wildcard, Effect: EffectAllow, Description: "manufacturers update and price their products"},
+		{RuleID: "supplier-update", Role: "supplier", OrgID: Wildcard, Action: ActionUpdateProduct, ResourceState: Wildcard, Effect: EffectAllow, Description: "suppliers update and price the products they own"},
+		{RuleID: "supplier-receive", Role: "supplier", OrgID: Wildcard, Action: ActionAcceptTransfer, ResourceState: StatusAvailable, Effect: EffectAllow, Description: "suppliers receive available products"},
+		{RuleID: "transporter-receive", Role: "transporter", OrgID: Wildcard, Action: ActionAcceptTransfer, ResourceState: StatusAtWarehouse, Effect: EffectAllow, Description: "transporters pick up products at the warehouse"},
+		{RuleID: "customer-receive", Role: Wildcard, OrgID: Wildcard, Action: ActionAcceptTransfer, ResourceState: StatusInTransit, Effect: EffectAllow, Description: "anyone can buy products in transit"},
+		{RuleID: "admin-users", Role: "admin", OrgID: Wildcard, Action: ActionManageUser, ResourceState: Wildcard, Effect: EffectAllow, Description: "admins manage the users of their org"},
+		{RuleID: "manufacturer-admin-registrations", Role: "admin:manufacturer", OrgID: Wildcard, Action: ActionDecideRegistration, ResourceState: "manufacturer", Effect: EffectAllow, Description: "manufacturer admins decide on manufacturer registrations"},
+		{RuleID: "supplier-admin-registrations", Role: "admin:supplier", OrgID: Wildcard, Action: ActionDecideRegistration, ResourceState: "supplier", Effect: EffectAllow, Description: "supplier admins decide on supplier registrations"},
+		{RuleID: "transporter-admin-registrations", Role: "admin:transporter", OrgID: Wildcard, Action: ActionDecideRegistration, ResourceState: "transporter", Effect: EffectAllow, Description: "transporter admins decide on transporter registrations"},
+		{RuleID: "admin-organization", Role: "admin", OrgID: Wildcard, Action: ActionUpdateOrganization, ResourceState: Wildcard, Effect: EffectAllow, Description: "admins update their org"},
+		{RuleID: "admin-facilities", Role: "admin", OrgID: Wildcard, Action: ActionManageFacility, ResourceState: Wildcard, Effect: EffectAllow, Description: "admins register and update the facilities of their org"},
+		{RuleID: "inventory", Role: Wildcard, OrgID: Wildcard, Action: ActionManageInventory, ResourceState: Wildcard, Effect: EffectAllow, Description: "participants manage the stock of their org's facilities"},
+		{RuleID: "customer-no-inventory", Role: "customer", OrgID: Wildcard, Action: ActionManageInventory, ResourceState: Wildcard, Effect: EffectDeny, Priority: 10, Description: "customers hold no stock"},
+		{RuleID: "adjustments", Role: Wildcard, OrgID: Wildcard, Action: ActionManageInventory, ResourceState: MovementAdjustment, Effect: EffectDeny, Priority: 5, Description: "stock adjustments need an admin"},
+		{RuleID: "admin-adjustments", Role: "admin", OrgID: Wildcard, Action: ActionManageInventory, ResourceState: MovementAdjustment, Effect: EffectAllow, Priority: 6, Description: "admins adjust stock after a cycle count"},
+		{RuleID: "place-orders", Role: Wildcard, OrgID: Wildcard, Action: ActionPlaceOrder, ResourceState: Wildcard, Effect: EffectAllow, Description: "participants place orders for their org"},
+		{RuleID: "fulfill-orders", Role: Wildcard, OrgID: Wildcard, Action: ActionFulfillOrder, ResourceState: Wildcard, Effect: EffectAllow, Description: "participants confirm and fulfill orders received by their org"},
+		{RuleID: "customer-no-fulfill", Role: "customer", OrgID: Wildcard, Action: ActionFulfillOrder, ResourceState: Wildcard, Effect: EffectDeny, Priority: 10, Description: "customers do not sell"},
+		{RuleID: "issue-invoices", Role: Wildcard, OrgID: Wildcard, Action: ActionIssueInvoice, ResourceState: Wildcard, Effect: EffectAllow, Description: "sellers invoice the orders of their org"},
+		{RuleID: "customer-no-invoices", Role: "customer", OrgID: Wildcard, Action: ActionIssueInvoice, ResourceState: Wildcard, Effect: EffectDeny, Priority: 10, Description: "customers do not invoice"},
+		{RuleID: "approve-invoices", Role: Wildcard, OrgID: Wildcard, Action: ActionApproveInvoice, ResourceState: Wildcard, Effect: EffectAllow, Description: "buyers approve or dispute the invoices of their org"},
+		{RuleID: "governance-fx-rates", Role: "admin:" + GovernanceRole, OrgID: Wildcard, Action: ActionFeedFXRates, ResourceState: Wildcard, Effect: EffectAllow, Description: "governance admins publish exchange rates until feeders are granted"},
+		{RuleID: "manufacturer-telemetry-ranges", Role: "manufacturer", OrgID: Wildcard, Action: ActionSetTelemetryRange, ResourceState: Wildcard, Effect: EffectAllow, Description: "manufacturers set the conditions their products tolerate"},
+		{RuleID: "telemetry", Role: Wildcard, OrgID: Wildcard, Action: ActionRecordTelemetry, ResourceState: Wildcard, Effect: EffectAllow, Description: "holders report sensor readings for the goods they hold"},
+		{RuleID: "admin-devices", Role: "admin", OrgID: Wildcard, Action: ActionManageDevice, ResourceState: Wildcard, Effect: EffectAllow, Description: "admins register, assign and retire the sensors of their org"},
+		{RuleID: "inspect", Role: Wildcard, OrgID: Wildcard, Action: ActionInspect, ResourceState: Wildcard, Effect: EffectAllow, Description: "holders inspect the goods they hold"},
+		{RuleID: "admin-quality-disposition", Role: "admin", OrgID: Wildcard, Action: ActionDisposeQuality, ResourceState: Wildcard, Effect: EffectAllow, Description: "admins decide what happens to goods that failed inspection"},
+		{RuleID: "delegate", Role: Wildcard, OrgID: Wildcard, Action: ActionGrantDelegation, ResourceState: Wildcard, Effect: EffectAllow, Description: "anyone can delegate their own rights"},
+		{RuleID: "governance", Role: "admin:" + GovernanceRole, OrgID: Wildcard, Action: ActionGovern, ResourceState: Wildcard, Effect: EffectAllow, Description: "governance admins propose and vote on system changes"},
+	}
+}
+
+func validateACLRule(rule *ACLRule) error {
+	if len(rule.RuleID) == 0 {
+		return errValidation("rule id must be provided")
+	}
+	if len(rule.Role) == 0 || len(rule.OrgID) == 0 || len(rule.Action) == 0 || len(rule.ResourceState) == 0 {
+		return errValidation("rule %s must set role, org, action and resource state, use %q to match any", rule.RuleID, Wildcard)
+	}
+	if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+		return errValidation("rule %s effect must be %q or %q", rule.RuleID, EffectAllow, EffectDeny)
+	}
+	return nil
+}
+
+// LoadACLPolicy reads the ACL from the ledger. Ledgers that never stored one
+// use the default rules.
+func LoadACLPolicy(ctx contractapi.TransactionContextInterface) (*ACLPolicy, error) {
+	data, err := ctx.GetStub().GetState(ACLPolicyKey)
+	if err != nil {
+		return nil, errInternal("failed to read ACL policy: %s", err.Error())
+	}
+	if data == nil {
+		return &ACLPolicy{DocType: "aclPolicy", PolicyID: ACLPolicyKey, Rules: defaultACLRules()}, nil
+	}
+
+	policy := new(ACLPolicy)
+	err = json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for ACL policy: %s", err.Error())
+	}
+	return policy, nil
+}
+
+// SaveACLPolicy writes policy under its singleton key.
+func SaveACLPolicy(ctx contractapi.TransactionContextInterface, policy *ACLPolicy) error {
+	policy.DocType = "aclPolicy"
+	policy.PolicyID = ACLPolicyKey
+	return writeState(ctx, ACLPolicyKey, "ACL policy", policy)
+}
+
+func actorRoles(actor *User) []string {
+	if actor.UserType == "admin" && actor.AdminRole != "" {
+		return []string{actor.UserType, "admin:" + actor.AdminRole}
+	}
+	return []string{actor.UserType}
+}
+
+func matches(pattern string, values ...string) bool {
+	return pattern == Wildcard || containsString(values, pattern)
+}
+
+// evaluateACL decides whether actor may perform action on a resource in
+// resourceState. The matching rule with the highest priority wins and deny
+// beats allow at equal priority. Without a matching rule access is denied.
+func evaluateACL(policy *ACLPolicy, actor *User, action string, resourceState string) *AccessDecision {
+	matched := []ACLRule{}
+	for _, rule := range policy.Rules {
+		if matches(rule.Role, actorRoles(actor)...) && matches(rule.OrgID, actor.OrgID) && matches(rule.Action, action) && matches(rule.ResourceState, resourceState) {
+			matched = append(matched, rule)
+		}
+	}
+
+	if len(matched) == 0 {
+		return &AccessDecision{
+			Allowed:      false,
+			Reason:       fmt.Sprintf("no rule allows %s to %s in state %q", actor.UserType, action, resourceState),
+			MatchedRules: matched,
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].Priority != matched[j].Priority {
+			return matched[i].Priority > matched[j].Priority
+		}
+		return matched[i].Effect == EffectDeny && matched[j].Effect != EffectDeny
+	})
+
+	winner := matched[0]
+	return &AccessDecision{
+		Allowed:      winner.Effect == EffectAllow,
+		RuleID:       winner.RuleID,
+		Reason:       fmt.Sprintf("rule %s: %s", winner.RuleID, winner.Description),
+		MatchedRules: matched,
+	}
+}
+
+// authorize is the single authorization check used by every transaction.
+func authorize(ctx contractapi.TransactionContextInterface, actor *User, action string, resourceState string) error {
+	policy, err := LoadACLPolicy(ctx)
+	if err != nil {
+		return err
+	}
+
+	decision := evaluateACL(policy, actor, action, resourceState)
+	if !decision.Allowed {
+		return errForbiddenRole("%s may not %s: %s", actor.UserID, action, decision.Reason)
+	}
+	return nil
+}
+
+// ExplainAccess shows how the ACL decides whether userID may perform action
+// on a resource in resourceState, for troubleshooting denials.
+func (t *SupplyChain) ExplainAccess(ctx contractapi.TransactionContextInterface, userID string, action string, resourceState string) (*AccessDecision, error) {
+	user, err := LoadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := LoadACLPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateACL(policy, user, action, resourceState), nil
+}
+
+func (t *SupplyChain) QueryACLPolicy(ctx contractapi.TransactionContextInterface) (*ACLPolicy, error) {
+	return LoadACLPolicy(ctx)
+}
+
+// putRule adds rule, or replaces the rule with the same id.
+func (p *ACLPolicy) putRule(rule ACLRule) {
+	for i := range p.Rules {
+		if p.Rules[i].RuleID == rule.RuleID {
+			p.Rules[i] = rule
+			return
+		}
+	}
+	p.Rules = append(p.Rules, rule)
+}
+
+// deleteRule removes the rule with ruleID.
+func (p *ACLPolicy) deleteRule(ruleID string) error {
+	rules := []ACLRule{}
+	for _, rule := range p.Rules {
+		if rule.RuleID != ruleID {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == len(p.Rules) {
+		return errNotFound("can not find ACL rule: %s", ruleID)
+	}
+	p.Rules = rules
+	return nil
+}
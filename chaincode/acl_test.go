@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestEvaluateACL(t *testing.T) {
+	rules := []ACLRule{
+		{RuleID: "all-read", Role: Wildcard, OrgID: Wildcard, Action: "read", ResourceState: Wildcard, Effect: EffectAllow},
+		{RuleID: "supplier-ship", Role: "supplier", OrgID: Wildcard, Action: "ship", ResourceState: StatusAtWarehouse, Effect: EffectAllow},
+		{RuleID: "org2-no-ship", Role: Wildcard, OrgID: "Org2MSP", Action: "ship", ResourceState: Wildcard, Effect: EffectDeny},
+		{RuleID: "org2-ship", Role: "supplier", OrgID: "Org2MSP", Action: "ship", ResourceState: Wildcard, Effect: EffectAllow},
+		{RuleID: "org3-ship", Role: "supplier", OrgID: "Org3MSP", Action: "ship", ResourceState: Wildcard, Effect: EffectAllow, Priority: 5},
+		{RuleID: "org3-no-ship", Role: Wildcard, OrgID: "Org3MSP", Action: "ship", ResourceState: Wildcard, Effect: EffectDeny},
+		{RuleID: "approver", Role: "admin:supplier", OrgID: Wildcard, Action: "approve", ResourceState: Wildcard, Effect: EffectAllow},
+	}
+	policy := &ACLPolicy{Rules: rules}
+
+	tests := []struct {
+		name    string
+		actor   User
+		action  string
+		state   string
+		allowed bool
+		ruleID  string
+	}{
+		{"wildcard rule", User{UserType: "customer", OrgID: "Org1MSP"}, "read", StatusSold, true, "all-read"},
+		{"role and state match", User{UserType: "supplier", OrgID: "Org1MSP"}, "ship", StatusAtWarehouse, true, "supplier-ship"},
+		{"state does not match", User{UserType: "supplier", OrgID: "Org1MSP"}, "ship", StatusSold, false, ""},
+		{"role does not match", User{UserType: "customer", OrgID: "Org1MSP"}, "ship", StatusAtWarehouse, false, ""},
+		{"deny beats allow at equal priority", User{UserType: "supplier", OrgID: "Org2MSP"}, "ship", StatusAtWarehouse, false, "org2-no-ship"},
+		{"higher priority wins", User{UserType: "supplier", OrgID: "Org3MSP"}, "ship", StatusAtWarehouse, true, "org3-ship"},
+		{"admin role", User{UserType: "admin", AdminRole: "supplier", OrgID: "Org1MSP"}, "approve", "", true, "approver"},
+		{"admin of another role", User{UserType: "admin", AdminRole: "customer", OrgID: "Org1MSP"}, "approve", "", false, ""},
+		{"no rule", User{UserType: "supplier", OrgID: "Org1MSP"}, "delete", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := evaluateACL(policy, &tt.actor, tt.action, tt.state)
+			if decision.Allowed != tt.allowed {
+				t.Errorf("Allowed = %v, want %v (%s)", decision.Allowed, tt.allowed, decision.Reason)
+			}
+			if decision.RuleID != tt.ruleID {
+				t.Errorf("RuleID = %q, want %q", decision.RuleID, tt.ruleID)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- bootstrap ------------------------------------------
+
+// Keys of the singleton records written by InitLedger.
+const (
+	SystemConfigKey = "SystemConfig"
+	InitMarkerKey   = "InitMarker"
+)
+
+// DeployerAttribute is the certificate attribute, issued by the org's CA,
+// that designates the identity allowed to run InitLedger.
+const DeployerAttribute = "scm.deployer"
+
+// TransientAdminPasswords carries a JSON object mapping admin user ids to
+// their initial passwords.
+const TransientAdminPasswords = "admin_passwords"
+
+// knownRoles are the user types the chaincode has transactions for.
+var knownRoles = map[string]bool{
+	"manufacturer": true,
+	"supplier":     true,
+	"transporter":  true,
+	"customer":     true,
+}
+
+// OrgConfig declares an org taking part in the supply chain and the roles its
+// users may hold. InitLedger turns each into an Organization.
+type OrgConfig struct {
+	MSPID          string          `json:"MSPID"`
+	Name           string          `json:"Name"`
+	Roles          []string        `json:"Roles"`
+	Addresses      []string        `json:"Addresses"`
+	Certifications []Certification `json:"Certifications"`
+}
+
+// AdminConfig declares an admin user created by InitLedger. Admin contact
+// details are business data and are passed in the config, the password is
+// read from the transient map.
+type AdminConfig struct {
+	UserID    string `json:"UserID"`
+	MSPID     string `json:"MSPID"`
+	AdminRole string `json:"AdminRole"`
+	Name      string `json:"Name"`
+	Email     string `json:"Email"`
+	Address   string `json:"Address"`
+}
+
+// BootstrapConfig is the JSON document accepted by InitLedger.
+type BootstrapConfig struct {
+	Organizations []OrgConfig       `json:"Organizations"`
+	Admins        []AdminConfig     `json:"Admins"`
+	Roles         []string          `json:"Roles"`
+	Parameters    map[string]string `json:"Parameters"`
+}
+
+// SystemConfig is the stored result of the bootstrap. Organizations and
+// admins are not kept here, they become Organization and User records.
+type SystemConfig struct {
+	DocType    string            `json:"DocType"`
+	ConfigID   string            `json:"ConfigID"`
+	Roles      []string          `json:"Roles"`
+	Parameters map[string]string `json:"Parameters"`
+}
+
+// InitMarker records who initialized the ledger and when. Its presence makes
+// InitLedger fail on every later call.
+type InitMarker struct {
+	InitializedBy string `json:"InitializedBy"`
+	MSPID         string `json:"MSPID"`
+	Timestamp     string `json:"Timestamp"`
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BootstrapConfig) org(mspID string) *OrgConfig {
+	for i := range c.Organizations {
+		if c.Organizations[i].MSPID == mspID {
+			return &c.Organizations[i]
+		}
+	}
+	return nil
+}
+
+func validateBootstrapConfig(config *BootstrapConfig) error {
+	if len(config.Roles) == 0 {
+		return errValidation("bootstrap config must enable at least one role")
+	}
+	for _, role := range config.Roles {
+		if !knownRoles[role] {
+			return errValidation("unknown role %q in bootstrap config", role)
+		}
+	}
+
+	if len(config.Organizations) == 0 {
+		return errValidation("bootstrap config must declare at least one organization")
+	}
+	seenOrgs := map[string]bool{}
+	for _, org := range config.Organizations {
+		if len(org.MSPID) == 0 {
+			return errValidation("every organization needs an MSP ID")
+		}
+		if len(org.Name) == 0 {
+			return errValidation("organization %s needs a name", org.MSPID)
+		}
+		if seenOrgs[org.MSPID] {
+			return errValidation("organization %s is declared twice", org.MSPID)
+		}
+		seenOrgs[org.MSPID] = true
+		for _, role := range org.Roles {
+			if !containsString(config.Roles, role) {
+				return errValidation("organization %s has role %q which is not enabled", org.MSPID, role)
+			}
+		}
+	}
+
+	seenAdmins := map[string]bool{}
+	for _, admin := range config.Admins {
+		if len(admin.UserID) == 0 {
+			return errValidation("every admin needs a user id")
+		}
+		if seenAdmins[admin.UserID] {
+			return errValidation("admin %s is declared twice", admin.UserID)
+		}
+		seenAdmins[admin.UserID] = true
+
+		org := config.org(admin.MSPID)
+		if org == nil {
+			return errValidation("admin %s belongs to undeclared organization %s", admin.UserID, admin.MSPID)
+		}
+		if admin.AdminRole != GovernanceRole && !containsString(org.Roles, admin.AdminRole) {
+			return errValidation("admin %s manages role %q which organization %s does not hold", admin.UserID, admin.AdminRole, admin.MSPID)
+		}
+	}
+	return nil
+}
+
+// requireDeployer refuses callers whose certificate does not carry the
+// deployer attribute.
+func requireDeployer(ctx contractapi.TransactionContextInterface) error {
+	err := ctx.GetClientIdentity().AssertAttributeValue(DeployerAttribute, "true")
+	if err != nil {
+		return errForbiddenRole("only an identity with %s=true can initialize the ledger", DeployerAttribute)
+	}
+	return nil
+}
+
+// LoadSystemConfig reads the config stored by InitLedger.
+func LoadSystemConfig(ctx contractapi.TransactionContextInterface) (*SystemConfig, error) {
+	data, err := ctx.GetStub().GetState(SystemConfigKey)
+	if err != nil {
+		return nil, errInternal("failed to read system config: %s", err.Error())
+	}
+	if data == nil {
+		return nil, errInvalidTransition("ledger is not initialized, run InitLedger first")
+	}
+
+	config := new(SystemConfig)
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for system config: %s", err.Error())
+	}
+	return config, nil
+}
+
+// SaveSystemConfig writes config under its singleton key.
+func SaveSystemConfig(ctx contractapi.TransactionContextInterface, config *SystemConfig) error {
+	config.DocType = "systemConfig"
+	config.ConfigID = SystemConfigKey
+	return writeState(ctx, SystemConfigKey, "system config", config)
+}
+
+// requireRoleAllowed refuses users of role in org mspID unless the system
+// config enables the role for that org.
+func requireRoleAllowed(ctx contractapi.TransactionContextInterface, mspID string, role string) error {
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !containsString(config.Roles, role) {
+		return errValidation("role %q is not enabled", role)
+	}
+
+	org, err := LoadOrganization(ctx, mspID)
+	if hasCode(err, CodeNotFound) {
+		return errForbiddenRole("organization %s is not part of the supply chain", mspID)
+	}
+	if err != nil {
+		return err
+	}
+	if !containsString(org.Roles, role) {
+		return errForbiddenRole("organization %s can not hold role %q", mspID, role)
+	}
+	return nil
+}
+
+func (t *SupplyChain) QuerySystemConfig(ctx contractapi.TransactionContextInterface) (*SystemConfig, error) {
+	return LoadSystemConfig(ctx)
+}
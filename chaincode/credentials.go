@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- credentials ------------------------------------------
+
+// passwordIterations is the PBKDF2 work factor of new passwords. It is stored
+// with each credential, so raising it leaves existing verifiers valid.
+const passwordIterations = 600000
+
+// minPasswordSaltLength is the shortest password_salt accepted.
+const minPasswordSaltLength = 16
+
+// credentialObjectType keys password verifiers in the implicit collection of
+// the user's org.
+const credentialObjectType = "credential"
+
+// pbkdf2SHA256 derives a keyLen byte key from password and salt with
+// PBKDF2-HMAC-SHA256 as specified in RFC 8018.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	counter := make([]byte, 4)
+	u := make([]byte, 0, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Write(counter)
+		u = prf.Sum(u[:0])
+
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Credential is what is kept of a password in the implicit collection of the
+// user's org: the PBKDF2 key derived from it, with the salt and work factor
+// used. Keeping the salt private as well means the hash of the record, which
+// every peer of the channel holds, can not be used to guess the password.
+type Credential struct {
+	Salt       string `json:"Salt"`
+	Iterations int    `json:"Iterations"`
+	Verifier   []byte `json:"Verifier"`
+}
+
+// passwordVerifier derives the key stored for password with salt and
+// iterations.
+func passwordVerifier(salt string, iterations int, password string) []byte {
+	return pbkdf2SHA256([]byte(password), []byte(salt), iterations, sha256.Size)
+}
+
+func credentialKey(ctx contractapi.TransactionContextInterface, userID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(credentialObjectType, []string{userID})
+	if err != nil {
+		return "", errInternal("failed to create credential key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// legacyPasswordHash is how passwords were hashed before they were derived
+// with PBKDF2.
+func legacyPasswordHash(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// storesCredential reports whether the password of user is kept as a
+// Credential rather than on its public record.
+func storesCredential(user *User) bool {
+	return user.PasswordHash == "" && user.Password == ""
+}
+
+// setPassword stores a Credential for password in the implicit collection of
+// the user's org. salt is the random password_salt passed by the client; the
+// user id is appended so one salt can serve several users. Nothing of the
+// password is left on the public user.
+func setPassword(ctx contractapi.TransactionContextInterface, user *User, password string, salt string) error {
+	if user.MSPID == "" {
+		return errValidation("user %s has no org to hold its credentials", user.UserID)
+	}
+	if len(password) == 0 {
+		return errValidation("password must not be empty")
+	}
+	if len(salt) < minPasswordSaltLength {
+		return errValidation("%s must be a random value of at least %d characters", TransientPasswordSalt, minPasswordSaltLength)
+	}
+
+	user.PasswordSalt = ""
+	user.PasswordHash = ""
+	user.Password = ""
+
+	credential := Credential{Salt: salt + ":" + user.UserID, Iterations: passwordIterations}
+	credential.Verifier = passwordVerifier(credential.Salt, credential.Iterations, password)
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return errInternal("marshal error for credentials of %s: %s", user.UserID, err.Error())
+	}
+
+	key, err := credentialKey(ctx, user.UserID)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutPrivateData(orgCollection(user.MSPID), key, data)
+	if err != nil {
+		return errInternal("failed to put credentials of %s: %s", user.UserID, err.Error())
+	}
+	return nil
+}
+
+// purgePassword removes the credential of user from its org collection.
+func purgePassword(ctx contractapi.TransactionContextInterface, user *User) error {
+	key, err := credentialKey(ctx, user.UserID)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PurgePrivateData(orgCollection(user.MSPID), key)
+	if err != nil {
+		return errInternal("failed to purge credentials of %s: %s", user.UserID, err.Error())
+	}
+	return nil
+}
+
+// checkPassword compares password with the stored credentials. Only peers of
+// the user's org can read its Credential, so only they derive and compare the
+// key. Other endorsers only check that a credential exists and leave the
+// decision to the user's org, whose endorsement authenticate requires. Both
+// reads record the same hashed read, so the endorsements still agree. Users
+// created before passwords were derived with PBKDF2 still carry a SHA-256
+// hash, or even the plain text value, on their public record.
+func checkPassword(ctx contractapi.TransactionContextInterface, user *User, password string) (bool, error) {
+	if storesCredential(user) {
+		key, err := credentialKey(ctx, user.UserID)
+		if err != nil {
+			return false, err
+		}
+		peerMSPID, err := shim.GetMSPID()
+		if err != nil {
+			return false, errInternal("failed to read peer MSP ID: %s", err.Error())
+		}
+		if peerMSPID != user.MSPID {
+			stored, err := ctx.GetStub().GetPrivateDataHash(orgCollection(user.MSPID), key)
+			if err != nil {
+				return false, errInternal("failed to read credentials of %s: %s", user.UserID, err.Error())
+			}
+			return stored != nil, nil
+		}
+
+		data, err := ctx.GetStub().GetPrivateData(orgCollection(user.MSPID), key)
+		if err != nil {
+			return false, errInternal("failed to read credentials of %s: %s", user.UserID, err.Error())
+		}
+		if data == nil {
+			return false, nil
+		}
+		credential := new(Credential)
+		err = json.Unmarshal(data, credential)
+		if err != nil {
+			return false, errInternal("unmarshalling error for credentials of %s: %s", user.UserID, err.Error())
+		}
+		verifier := passwordVerifier(credential.Salt, credential.Iterations, password)
+		return subtle.ConstantTimeCompare(credential.Verifier, verifier) == 1, nil
+	}
+	if user.PasswordHash == "" {
+		return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1, nil
+	}
+	hash := legacyPasswordHash(user.PasswordSalt, password)
+	return subtle.ConstantTimeCompare([]byte(user.PasswordHash), []byte(hash)) == 1, nil
+}
+
+// authenticate loads userID and checks it against the password passed in the
+// transient map. args are the regular arguments of the call, which must not
+// contain the password.
+func authenticate(ctx contractapi.TransactionContextInterface, args []string, userID string) (*User, error) {
+	secrets, err := readSensitive(ctx, args, TransientPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := LoadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := checkPassword(ctx, user, secrets[TransientPassword])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errValidation("incorrect user id or password")
+	}
+
+	// Only the user's org can check the password, so it must endorse
+	err = requireOrgEndorsement(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		keyLen     int
+		want       string
+	}{
+		// RFC 7914, section 11
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, tt.keyLen))
+		if got != tt.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, tt.keyLen, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordVerifier(t *testing.T) {
+	want := "87aa57ba98a3b25adc5943e8b5c71fda58bdbb4798115ae21291b5f5ef89a0b9"
+	if got := hex.EncodeToString(passwordVerifier("0123456789abcdef:User1", passwordIterations, "Passw0rd!")); got != want {
+		t.Errorf("passwordVerifier = %s, want %s", got, want)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	l := newTestLedger(t)
+	user := l.addUser("User1", "manufacturer", "Org1MSP")
+	err := l.submit("Org1MSP", "", func(ctx contractapi.TransactionContextInterface) error {
+		err := setPassword(ctx, user, "Passw0rd!", "0123456789abcdef")
+		if err != nil {
+			return err
+		}
+		return SaveUser(ctx, user)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PasswordSalt != "" || user.PasswordHash != "" {
+		t.Errorf("public user keeps credentials: %+v", user)
+	}
+	stranger := &User{UserID: "User2", MSPID: "Org1MSP"}
+
+	tests := []struct {
+		name     string
+		peer     string
+		user     *User
+		password string
+		want     bool
+	}{
+		{"own org", "Org1MSP", user, "Passw0rd!", true},
+		{"own org, wrong password", "Org1MSP", user, "passw0rd!", false},
+		{"own org, no credential", "Org1MSP", stranger, "Passw0rd!", false},
+		{"other org defers", "Org2MSP", user, "anything", true},
+		{"other org, no credential", "Org2MSP", stranger, "Passw0rd!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORE_PEER_LOCALMSPID", tt.peer)
+			got, err := checkPassword(l.ctx, tt.user, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("checkPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateNeedsUserOrg(t *testing.T) {
+	l := newTestLedger(t)
+	l.addUser("User1", "manufacturer", "Org1MSP")
+	l.stub.transient[TransientPassword] = []byte("user1")
+	_, err := authenticate(l.ctx, []string{"User1"}, "User1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.stub.writes["User1"] == nil {
+		t.Error("authenticate did not write the user, which pulls in its org's endorsement")
+	}
+}
+
+func TestLegacyPasswordHash(t *testing.T) {
+	// sha256("salt" + "password")
+	want := "13601bda4ea78e55a07b98866d2be6be0744e3866f13c00c811cab608a28f322"
+	if got := legacyPasswordHash("salt", "password"); got != want {
+		t.Errorf("legacyPasswordHash = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- delegation ------------------------------------------
+
+// Actions that can be delegated.
+const (
+	ActionCreateProduct  = "create_product"
+	ActionUpdateProduct  = "update_product"
+	ActionAcceptTransfer = "accept_transfer"
+	ActionHandOver       = "hand_over"
+)
+
+var delegableActions = map[string]bool{
+	ActionCreateProduct: true,
+	ActionUpdateProduct: true,
+	ActionHandOver:      true,
+}
+
+// Delegation scopes. A shipment is a single product record, which is the
+// unit every transfer transaction moves.
+const (
+	ScopeAll      = "all"
+	ScopeSKU      = "sku"
+	ScopeShipment = "shipment"
+)
+
+// delegationIndex maps a delegate and its delegator to delegation ids.
+const delegationIndex = "delegation~delegate~delegator"
+
+// Delegation lets DelegatorID's rights for Actions be exercised by DelegateID
+// between ValidFrom and ValidUntil, limited to the products matching the
+// scope.
+type Delegation struct {
+	DocType      string   `json:"DocType"`
+	DelegationID string   `json:"DelegationID"`
+	DelegatorID  string   `json:"DelegatorID"`
+	DelegateID   string   `json:"DelegateID"`
+	Actions      []string `json:"Actions"`
+	ScopeType    string   `json:"ScopeType"`
+	ScopeValue   string   `json:"ScopeValue"`
+	ValidFrom    string   `json:"ValidFrom"`
+	ValidUntil   string   `json:"ValidUntil"`
+	Revoked      bool     `json:"Revoked"`
+}
+
+func validateDelegation(delegation *Delegation) error {
+	if len(delegation.Actions) == 0 {
+		return errValidation("at least one action must be delegated")
+	}
+	for _, action := range delegation.Actions {
+		if !delegableActions[action] {
+			return errValidation("action %q can not be delegated", action)
+		}
+	}
+
+	switch delegation.ScopeType {
+	case ScopeAll:
+		if delegation.ScopeValue != "" {
+			return errValidation("scope %s takes no value", ScopeAll)
+		}
+	case ScopeSKU, ScopeShipment:
+		if delegation.ScopeValue == "" {
+			return errValidation("scope %s needs a value", delegation.ScopeType)
+		}
+	default:
+		return errValidation("unknown scope %q, expected all, sku or shipment", delegation.ScopeType)
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, delegation.ValidFrom)
+	if err != nil {
+		return errValidation("valid from must be an RFC 3339 time: %s", err.Error())
+	}
+	validUntil, err := time.Parse(time.RFC3339, delegation.ValidUntil)
+	if err != nil {
+		return errValidation("valid until must be an RFC 3339 time: %s", err.Error())
+	}
+	if !validUntil.After(validFrom) {
+		return errValidation("valid until must be after valid from")
+	}
+	return nil
+}
+
+// covers reports whether delegation allows action on product at now. product
+// is nil for actions that do not target an existing product, in which case
+// only the sku is known.
+func (d *Delegation) covers(action string, product *Product, sku string, now time.Time) bool {
+	if d.Revoked || !containsString(d.Actions, action) {
+		return false
+	}
+
+	validFrom, err := time.Parse(time.RFC3339, d.ValidFrom)
+	if err != nil || now.Before(validFrom) {
+		return false
+	}
+	validUntil, err := time.Parse(time.RFC3339, d.ValidUntil)
+	if err != nil || !now.Before(validUntil) {
+		return false
+	}
+
+	switch d.ScopeType {
+	case ScopeAll:
+		return true
+	case ScopeSKU:
+		if product != nil {
+			sku = product.SKU
+		}
+		return sku == d.ScopeValue
+	case ScopeShipment:
+		return product != nil && product.ProductID == d.ScopeValue
+	}
+	return false
+}
+
+// authorizeActing returns who is actually acting for principal. Without a
+// delegate that is principal itself, authenticated with the password in the
+// transient map. Otherwise the delegate authenticates instead and must hold a
+// delegation from principal covering action on product, or on sku for new
+// products.
+func authorizeActing(ctx contractapi.TransactionContextInterface, args []string, principal *User, delegateID string, action string, product *Product, sku string) (*User, error) {
+	if delegateID == "" || delegateID == principal.UserID {
+		_, err := authenticate(ctx, args, principal.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return principal, nil
+	}
+
+	delegate, err := authenticate(ctx, args, delegateID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(delegate)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := indexedIDs(ctx, delegationIndex, delegate.UserID, principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		delegation, err := LoadDelegation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if delegation.covers(action, product, sku, now) {
+			return delegate, nil
+		}
+	}
+
+	return nil, errForbiddenRole("%s holds no delegation from %s to %s here", delegate.UserID, principal.UserID, action)
+}
+
+// authorizeHandOver checks the sending side of a handoff and returns who
+// acts for it. senderID is the product's current custodian, who must be
+// active and authenticate, or be acted for by a delegate holding a hand_over
+// delegation. The receiver is in another org and never gives its password
+// here.
+func authorizeHandOver(ctx contractapi.TransactionContextInterface, args []string, senderID string, delegateID string, product *Product) (*User, error) {
+	sender, err := LoadUser(ctx, senderID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(sender)
+	if err != nil {
+		return nil, err
+	}
+	return authorizeActing(ctx, args, sender, delegateID, ActionHandOver, product, "")
+}
+
+// GrantDelegation lets delegatorID hand the listed actions to delegateID, a
+// colleague in the same org, for the given RFC 3339 time window and scope.
+// The delegator authenticates with the password in the transient map. It
+// returns the delegation id.
+func (t *SupplyChain) GrantDelegation(ctx contractapi.TransactionContextInterface, delegatorID string, delegateID string, actions []string, scopeType string, scopeValue string, validFrom string, validUntil string) (string, error) {
+	args := append([]string{delegatorID, delegateID, scopeType, scopeValue, validFrom, validUntil}, actions...)
+	delegator, err := authenticate(ctx, args, delegatorID)
+	if err != nil {
+		return "", err
+	}
+	err = requireActive(delegator)
+	if err != nil {
+		return "", err
+	}
+
+	err = authorize(ctx, delegator, ActionGrantDelegation, "")
+	if err != nil {
+		return "", err
+	}
+
+	if delegateID == delegatorID {
+		return "", errValidation("can not delegate to yourself")
+	}
+	delegate, err := LoadUser(ctx, delegateID)
+	if err != nil {
+		return "", err
+	}
+	if delegate.OrgID != delegator.OrgID {
+		return "", errForbiddenRole("can only delegate to users of %s", delegator.OrgID)
+	}
+
+	delegationCounter, err := incrementCounter(ctx, "DelegationCounterNO")
+	if err != nil {
+		return "", err
+	}
+
+	delegation := Delegation{
+		DelegationID: "Delegation" + strconv.Itoa(delegationCounter),
+		DelegatorID:  delegator.UserID,
+		DelegateID:   delegate.UserID,
+		Actions:      actions,
+		ScopeType:    scopeType,
+		ScopeValue:   scopeValue,
+		ValidFrom:    validFrom,
+		ValidUntil:   validUntil,
+	}
+	err = validateDelegation(&delegation)
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveDelegation(ctx, &delegation)
+	if err != nil {
+		return "", err
+	}
+
+	err = putIndex(ctx, delegationIndex, delegation.DelegateID, delegation.DelegatorID, delegation.DelegationID)
+	if err != nil {
+		return "", err
+	}
+	return delegation.DelegationID, nil
+}
+
+// RevokeDelegation ends a delegation before it expires. Only the delegator or
+// an admin of its org can revoke it.
+func (t *SupplyChain) RevokeDelegation(ctx contractapi.TransactionContextInterface, actorID string, delegationID string) error {
+	actor, err := authenticate(ctx, []string{actorID, delegationID}, actorID)
+	if err != nil {
+		return err
+	}
+
+	delegation, err := LoadDelegation(ctx, delegationID)
+	if err != nil {
+		return err
+	}
+
+	delegator, err := LoadUser(ctx, delegation.DelegatorID)
+	if err != nil {
+		return err
+	}
+	err = authorizeUserChange(ctx, actor, delegator)
+	if err != nil {
+		return err
+	}
+
+	if delegation.Revoked {
+		return errConflict("delegation %s is already revoked", delegationID)
+	}
+
+	delegation.Revoked = true
+	err = SaveDelegation(ctx, delegation)
+	if err != nil {
+		return err
+	}
+	return deleteIndex(ctx, delegationIndex, delegation.DelegateID, delegation.DelegatorID, delegation.DelegationID)
+}
+
+func (t *SupplyChain) QueryDelegation(ctx contractapi.TransactionContextInterface, delegationID string) (*Delegation, error) {
+	return LoadDelegation(ctx, delegationID)
+}
+
+// QueryDelegationsOf lists the delegations held by delegateID that have not
+// been revoked, including expired ones.
+func (t *SupplyChain) QueryDelegationsOf(ctx contractapi.TransactionContextInterface, delegateID string) ([]*Delegation, error) {
+	ids, err := indexedIDs(ctx, delegationIndex, delegateID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Delegation{}
+	for _, id := range ids {
+		delegation, err := LoadDelegation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, delegation)
+	}
+	return results, nil
+}
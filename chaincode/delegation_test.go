@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestHandOverCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		mspID    string
+		password string
+		delegate string
+		actions  []string
+		code     ErrorCode
+	}{
+		{"sender", "Org1MSP", "manufacturer1", "", nil, ""},
+		{"delegate of the sender", "Org1MSP", "manufacturer2", "Manufacturer2", []string{ActionHandOver}, ""},
+		{"receiver's password", "Org1MSP", "supplier1", "", nil, CodeValidationFailed},
+		{"submitted by the receiving org", "Org2MSP", "supplier1", "", nil, CodeForbiddenRole},
+		{"delegate without hand over", "Org1MSP", "manufacturer2", "Manufacturer2", []string{ActionUpdateProduct}, CodeForbiddenRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.addUser("Manufacturer1", "manufacturer", "Org1MSP")
+			l.addUser("Manufacturer2", "manufacturer", "Org1MSP")
+			l.addUser("Supplier1", "supplier", "Org2MSP")
+			l.put("Product1", DocTypeProduct, &Product{ProductID: "Product1", SKU: "Vaccine", ManufacturerID: "Manufacturer1", Status: StatusAvailable, OwnerOrgID: "Org1MSP", HolderOrgID: "Org1MSP"})
+
+			if tt.actions != nil {
+				err := l.submit("Org1MSP", "manufacturer1", func(ctx contractapi.TransactionContextInterface) error {
+					_, err := new(SupplyChain).GrantDelegation(ctx, "Manufacturer1", "Manufacturer2", tt.actions, ScopeShipment, "Product1", "2024-01-01T00:00:00Z", "2025-01-01T00:00:00Z")
+					return err
+				})
+				if err != nil {
+					t.Fatalf("GrantDelegation error = %v", err)
+				}
+			}
+
+			err := l.submit(tt.mspID, tt.password, func(ctx contractapi.TransactionContextInterface) error {
+				return new(SupplyChain).toSupplier(ctx, "Product1", "Supplier1", "52.37", "4.89", "", tt.delegate)
+			})
+			if tt.code != "" {
+				if !hasCode(err, tt.code) {
+					t.Fatalf("toSupplier error = %v, want %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("toSupplier error = %v", err)
+			}
+			product, err := LoadProduct(l.ctx, "Product1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if product.SupplierID != "Supplier1" || product.HolderOrgID != "Org2MSP" {
+				t.Errorf("product after handoff = %+v", product)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+//  ---------------------------- endorsement ------------------------------------------
+
+// clientMSPID returns the MSP ID of the identity that submitted the proposal.
+func clientMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", errInternal("failed to read client MSP ID: %s", err.Error())
+	}
+	return mspID, nil
+}
+
+// endorsementPolicy builds a signature policy that requires a peer of every
+// listed MSP to endorse, or of any one of them when anyOrg is set. MSP IDs are
+// de-duplicated and sorted so that every endorser produces identical policy
+// bytes.
+func endorsementPolicy(mspIDs []string, anyOrg bool) ([]byte, error) {
+	unique := map[string]bool{}
+	for _, mspID := range mspIDs {
+		if mspID != "" {
+			unique[mspID] = true
+		}
+	}
+
+	orgs := make([]string, 0, len(unique))
+	for mspID := range unique {
+		orgs = append(orgs, mspID)
+	}
+	sort.Strings(orgs)
+
+	principals := make([]*msp.MSPPrincipal, 0, len(orgs))
+	rules := make([]*common.SignaturePolicy, 0, len(orgs))
+	for i, mspID := range orgs {
+		role, err := proto.Marshal(&msp.MSPRole{MspIdentifier: mspID, Role: msp.MSPRole_PEER})
+		if err != nil {
+			return nil, errInternal("failed to marshal role for %s: %s", mspID, err.Error())
+		}
+		principals = append(principals, &msp.MSPPrincipal{
+			PrincipalClassification: msp.MSPPrincipal_ROLE,
+			Principal:               role,
+		})
+		rules = append(rules, &common.SignaturePolicy{
+			Type: &common.SignaturePolicy_SignedBy{SignedBy: int32(i)},
+		})
+	}
+
+	required := int32(len(rules))
+	if anyOrg {
+		required = 1
+	}
+	envelope := &common.SignaturePolicyEnvelope{
+		Version: 0,
+		Rule: &common.SignaturePolicy{
+			Type: &common.SignaturePolicy_NOutOf_{
+				NOutOf: &common.SignaturePolicy_NOutOf{N: required, Rules: rules},
+			},
+		},
+		Identities: principals,
+	}
+
+	policy, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, errInternal("failed to marshal endorsement policy: %s", err.Error())
+	}
+	return policy, nil
+}
+
+// setKeyEndorsers replaces the key-level endorsement policy of key so that
+// every listed org must endorse the next change to it. Records created before
+// users carried an MSP ID have no org to pin, so they keep the chaincode
+// level policy.
+func setKeyEndorsers(ctx contractapi.TransactionContextInterface, key string, mspIDs ...string) error {
+	return pinKey(ctx, key, mspIDs, false)
+}
+
+// setKeyEndorsersAny is setKeyEndorsers for records any one of the listed
+// orgs may change on its own.
+func setKeyEndorsersAny(ctx contractapi.TransactionContextInterface, key string, mspIDs ...string) error {
+	return pinKey(ctx, key, mspIDs, true)
+}
+
+func pinKey(ctx contractapi.TransactionContextInterface, key string, mspIDs []string, anyOrg bool) error {
+	hasOrg := false
+	for _, mspID := range mspIDs {
+		if mspID != "" {
+			hasOrg = true
+		}
+	}
+	if !hasOrg {
+		return nil
+	}
+
+	policy, err := endorsementPolicy(mspIDs, anyOrg)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().SetStateValidationParameter(key, policy)
+	if err != nil {
+		return errInternal("failed to set endorsement policy on %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// requireOrgEndorsement rewrites the user's record. The user key carries its
+// org's key-level policy, so including it in the write set forces a peer of
+// that org to endorse the transaction as well.
+func requireOrgEndorsement(ctx contractapi.TransactionContextInterface, user *User) error {
+	if user.MSPID == "" {
+		return nil
+	}
+	return SaveUser(ctx, user)
+}
+
+// transferCustody makes next the custodian of product. The current custodian
+// org is enforced by the policy already on the product key, the next
+// custodian org by rewriting its user record, and afterwards only the next
+// custodian org can endorse changes to the product.
+func transferCustody(ctx contractapi.TransactionContextInterface, product *Product, next *User) error {
+	err := requireOrgEndorsement(ctx, next)
+	if err != nil {
+		return err
+	}
+	return setKeyEndorsers(ctx, product.ProductID, next.MSPID)
+}
+
+// saveNewUser stores a freshly created user and pins its key to the user's
+// org, which is what lets requireOrgEndorsement demand that org later.
+func saveNewUser(ctx contractapi.TransactionContextInterface, user *User) error {
+	err := SaveUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	return setKeyEndorsers(ctx, user.UserID, user.MSPID)
+}
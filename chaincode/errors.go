@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+//  ---------------------------- errors ------------------------------------------
+
+// ErrorCode is a stable, machine readable identifier returned to clients so
+// they can branch on the kind of failure instead of matching message text.
+type ErrorCode string
+
+const (
+	CodeNotFound               ErrorCode = "NOT_FOUND"
+	CodeForbiddenRole          ErrorCode = "FORBIDDEN_ROLE"
+	CodeInvalidStateTransition ErrorCode = "INVALID_STATE_TRANSITION"
+	CodeValidationFailed       ErrorCode = "VALIDATION_FAILED"
+	CodeConflict               ErrorCode = "CONFLICT"
+	CodeInternal               ErrorCode = "INTERNAL"
+)
+
+// ChaincodeError is the only error type returned by transactions. Its Error
+// method renders the JSON payload, which is what the peer hands back to the
+// client as the transaction error message.
+type ChaincodeError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ChaincodeError) Error() string {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf(`{"code":%q,"message":%q}`, e.Code, e.Message)
+	}
+	return string(payload)
+}
+
+// hasCode reports whether err is a ChaincodeError carrying code.
+func hasCode(err error, code ErrorCode) bool {
+	var chaincodeErr *ChaincodeError
+	return errors.As(err, &chaincodeErr) && chaincodeErr.Code == code
+}
+
+func newError(code ErrorCode, format string, args ...any) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func errNotFound(format string, args ...any) error {
+	return newError(CodeNotFound, format, args...)
+}
+
+func errForbiddenRole(format string, args ...any) error {
+	return newError(CodeForbiddenRole, format, args...)
+}
+
+func errInvalidTransition(format string, args ...any) error {
+	return newError(CodeInvalidStateTransition, format, args...)
+}
+
+func errValidation(format string, args ...any) error {
+	return newError(CodeValidationFailed, format, args...)
+}
+
+func errConflict(format string, args ...any) error {
+	return newError(CodeConflict, format, args...)
+}
+
+// errInternal wraps ledger, marshalling and other infrastructure failures.
+func errInternal(format string, args ...any) error {
+	return newError(CodeInternal, format, args...)
+}
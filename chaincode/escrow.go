@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- escrow ------------------------------------------
+
+// Escrow statuses. The payer first Approves the amount of a handoff, funds
+// are Locked at the handoff, and the payer either accepts the delivery, which
+// releases them to the payee, or rejects it, which refunds them. A payer that
+// does neither before the escrow expires lets the payee release them.
+const (
+	EscrowStatusApproved = "Approved"
+	EscrowStatusLocked   = "Locked"
+	EscrowStatusReleased = "Released"
+	EscrowStatusRefunded = "Refunded"
+)
+
+// System parameters naming the token chaincode escrowed funds are held by
+// and the number of days the payer has to settle a locked escrow. The token
+// chaincode must run on this channel: InvokeChaincode on another channel can
+// only query, so escrow.token_channel must stay unset.
+const (
+	ParamEscrowTokenChaincode   = "escrow.token_chaincode"
+	ParamEscrowTokenChannel     = "escrow.token_channel"
+	ParamEscrowSettlementDays   = "escrow.settlement_days"
+	defaultEscrowSettlementDays = 14
+)
+
+// TransientEscrowKey is the optional transient entry of a handoff asking for
+// payment to be escrowed, a JSON encoded EscrowTerms.
+const TransientEscrowKey = "escrow"
+
+// tokenContract is the contract name the token chaincode serves the escrow
+// functions LockFrom, Release and Refund under.
+const tokenContract = "TokenContract"
+
+// escrowIndex maps a product to the escrows of its handoffs.
+const escrowIndex = "escrow~product"
+
+// EscrowTerms is the amount, in token units, the payer of a handoff locks in
+// escrow. It must be the amount the payer approved.
+//
+// Token units are the integer balances of the token chaincode, not Money:
+// they carry no currency or scale, and no FX rate is applied to them. A
+// payer settling a price in escrow converts it to token units itself before
+// approving, for a token pegged to cents by taking the price at scale 2,
+// such as 12.50 EUR as 1250.
+type EscrowTerms struct {
+	Amount int64 `json:"Amount"`
+}
+
+// Escrow is a payment locked in the token chaincode for one handoff of a
+// product. The payer approves the amount, in token units as for EscrowTerms,
+// with ApproveEscrow beforehand, which is its consent to the lock, and must
+// settle it before ExpiresAt.
+type Escrow struct {
+	DocType        string `json:"DocType"`
+	EscrowID       string `json:"EscrowID"`
+	ProductID      string `json:"ProductID"`
+	Handoff        string `json:"Handoff"`
+	PayerID        string `json:"PayerID"`
+	PayeeID        string `json:"PayeeID"`
+	PayerAccount   string `json:"PayerAccount"`
+	PayeeAccount   string `json:"PayeeAccount"`
+	Amount         int64  `json:"Amount"`
+	TokenChaincode string `json:"TokenChaincode"`
+	Status         string `json:"Status"`
+	Reason         string `json:"Reason"`
+	LockedAt       string `json:"LockedAt"`
+	ExpiresAt      string `json:"ExpiresAt"`
+	SettledAt      string `json:"SettledAt"`
+}
+
+// expired reports whether the payer's time to settle escrow is over at now.
+// Escrows locked before they carried ExpiresAt expire the default number of
+// days after they were locked, a time then recorded in Go's default format.
+func (e *Escrow) expired(now time.Time) (bool, error) {
+	if e.ExpiresAt == "" {
+		lockedAt, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", e.LockedAt)
+		if err != nil {
+			return false, errInternal("escrow %s has an invalid lock time %q", e.EscrowID, e.LockedAt)
+		}
+		return !now.Before(lockedAt.AddDate(0, 0, defaultEscrowSettlementDays)), nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, e.ExpiresAt)
+	if err != nil {
+		return false, errInternal("escrow %s has an invalid expiry %q", e.EscrowID, e.ExpiresAt)
+	}
+	return !now.Before(expiresAt), nil
+}
+
+// invokeToken calls function of the token chaincode with args and fails the
+// transaction if the token refuses.
+func invokeToken(ctx contractapi.TransactionContextInterface, escrow *Escrow, function string, args ...string) error {
+	call := [][]byte{[]byte(tokenContract + ":" + function)}
+	for _, arg := range args {
+		call = append(call, []byte(arg))
+	}
+
+	response := ctx.GetStub().InvokeChaincode(escrow.TokenChaincode, call, "")
+	if response.Status != shim.OK {
+		return errConflict("token chaincode %s refused %s for %s: %s", escrow.TokenChaincode, function, escrow.EscrowID, response.Message)
+	}
+	return nil
+}
+
+// approvedEscrow returns the escrow payerID approved for paying payeeID on a
+// handoff of productID.
+func approvedEscrow(ctx contractapi.TransactionContextInterface, productID string, payerID string, payeeID string) (*Escrow, error) {
+	ids, err := indexedIDs(ctx, escrowIndex, productID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		escrow, err := LoadEscrow(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if escrow.Status == EscrowStatusApproved && escrow.PayerID == payerID && escrow.PayeeID == payeeID {
+			return escrow, nil
+		}
+	}
+	return nil, errForbiddenRole("%s has not approved an escrow payment to %s for %s", payerID, payeeID, productID)
+}
+
+// lockEscrow locks the payment for handing product over when the transient
+// map asks for it. payerID pays payeeID once it accepts the delivery. The
+// amount is the one payerID approved with ApproveEscrow, since whoever
+// submits the handoff is not necessarily the payer.
+func lockEscrow(ctx contractapi.TransactionContextInterface, product *Product, payerID string, payeeID string) error {
+	value, ok, err := lookupTransient(ctx, TransientEscrowKey)
+	if err != nil || !ok {
+		return err
+	}
+	terms := new(EscrowTerms)
+	err = json.Unmarshal(value, terms)
+	if err != nil {
+		return errValidation("transient %s is not valid JSON: %s", TransientEscrowKey, err.Error())
+	}
+	err = requirePositiveAmount(terms.Amount)
+	if err != nil {
+		return err
+	}
+
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return err
+	}
+	tokenChaincode := config.Parameters[ParamEscrowTokenChaincode]
+	if tokenChaincode == "" {
+		return errInvalidTransition("escrow is not available, %s is not set", ParamEscrowTokenChaincode)
+	}
+	if config.Parameters[ParamEscrowTokenChannel] != "" {
+		return errInvalidTransition("escrow is not available, the token chaincode must run on this channel but %s is set", ParamEscrowTokenChannel)
+	}
+
+	payer, err := LoadUser(ctx, payerID)
+	if err != nil {
+		return err
+	}
+	payee, err := LoadUser(ctx, payeeID)
+	if err != nil {
+		return err
+	}
+	if payer.PaymentAccount == "" || payee.PaymentAccount == "" {
+		return errInvalidTransition("%s and %s both need a payment account for escrow", payerID, payeeID)
+	}
+
+	settlementDays, err := intParameter(config, ParamEscrowSettlementDays, defaultEscrowSettlementDays)
+	if err != nil {
+		return err
+	}
+
+	escrow, err := approvedEscrow(ctx, product.ProductID, payer.UserID, payee.UserID)
+	if err != nil {
+		return err
+	}
+	if escrow.Amount != terms.Amount {
+		return errForbiddenRole("%s approved paying %d for %s, not %d", payer.UserID, escrow.Amount, product.ProductID, terms.Amount)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	escrow.Handoff = product.Status
+	escrow.PayerAccount = payer.PaymentAccount
+	escrow.PayeeAccount = payee.PaymentAccount
+	escrow.TokenChaincode = tokenChaincode
+	escrow.Status = EscrowStatusLocked
+	escrow.LockedAt = now.Format(time.RFC3339)
+	escrow.ExpiresAt = now.AddDate(0, 0, settlementDays).Format(time.RFC3339)
+
+	err = invokeToken(ctx, escrow, "LockFrom", escrow.EscrowID, escrow.PayerAccount, escrow.PayeeAccount, strconv.FormatInt(escrow.Amount, 10))
+	if err != nil {
+		return err
+	}
+
+	err = SaveEscrow(ctx, escrow)
+	if err != nil {
+		return err
+	}
+	// The payer settles the escrow and the payee claims it once expired, so
+	// either org can endorse the next change on its own
+	return setKeyEndorsersAny(ctx, escrow.EscrowID, payer.MSPID, payee.MSPID)
+}
+
+// finishEscrow has the token chaincode carry out function on the funds of
+// escrow and records it as status.
+func finishEscrow(ctx contractapi.TransactionContextInterface, escrow *Escrow, reason string, function string, status string) error {
+	err := invokeToken(ctx, escrow, function, escrow.EscrowID)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	escrow.Status = status
+	escrow.Reason = reason
+	escrow.SettledAt = now.Format(time.RFC3339)
+	return SaveEscrow(ctx, escrow)
+}
+
+// settleEscrow lets payerID, authenticated with the password in the
+// transient map, release or refund the locked escrow.
+func settleEscrow(ctx contractapi.TransactionContextInterface, payerID string, escrowID string, reason string, function string, status string) error {
+	payer, err := authenticate(ctx, []string{payerID, escrowID, reason}, payerID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(payer)
+	if err != nil {
+		return err
+	}
+
+	escrow, err := LoadEscrow(ctx, escrowID)
+	if err != nil {
+		return err
+	}
+	if escrow.PayerID != payer.UserID {
+		return errForbiddenRole("only %s can settle %s", escrow.PayerID, escrowID)
+	}
+	if escrow.Status != EscrowStatusLocked {
+		return errInvalidTransition("escrow %s is %s", escrowID, escrow.Status)
+	}
+	err = requireClientOrg(ctx, payer.OrgID, "settle this escrow")
+	if err != nil {
+		return err
+	}
+	return finishEscrow(ctx, escrow, reason, function, status)
+}
+
+// ApproveEscrow lets payerID, authenticated with the password in the
+// transient map, consent to paying amount token units to payeeID in escrow
+// on the next handoff of productID between them. The handoff locks the
+// funds only when its transient escrow entry asks for this amount. It
+// returns the escrow id.
+func (t *SupplyChain) ApproveEscrow(ctx contractapi.TransactionContextInterface, payerID string, productID string, payeeID string, amount int64) (string, error) {
+	payer, err := authenticate(ctx, []string{payerID, productID, payeeID, strconv.FormatInt(amount, 10)}, payerID)
+	if err != nil {
+		return "", err
+	}
+	err = requireActive(payer)
+	if err != nil {
+		return "", err
+	}
+	err = requireClientOrg(ctx, payer.OrgID, "approve its escrow payments")
+	if err != nil {
+		return "", err
+	}
+	err = requirePositiveAmount(amount)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = LoadProduct(ctx, productID)
+	if err != nil {
+		return "", err
+	}
+	payee, err := LoadUser(ctx, payeeID)
+	if err != nil {
+		return "", err
+	}
+	_, err = approvedEscrow(ctx, productID, payer.UserID, payee.UserID)
+	if err == nil {
+		return "", errConflict("%s already approved an escrow payment to %s for %s", payer.UserID, payee.UserID, productID)
+	}
+	if !hasCode(err, CodeForbiddenRole) {
+		return "", err
+	}
+
+	escrowCounter, err := incrementCounter(ctx, "EscrowCounterNO")
+	if err != nil {
+		return "", err
+	}
+	escrow := &Escrow{
+		EscrowID:  "Escrow" + strconv.Itoa(escrowCounter),
+		ProductID: productID,
+		PayerID:   payer.UserID,
+		PayeeID:   payee.UserID,
+		Amount:    amount,
+		Status:    EscrowStatusApproved,
+	}
+	err = SaveEscrow(ctx, escrow)
+	if err != nil {
+		return "", err
+	}
+	err = putIndex(ctx, escrowIndex, escrow.ProductID, escrow.EscrowID)
+	if err != nil {
+		return "", err
+	}
+	return escrow.EscrowID, nil
+}
+
+// ClaimEscrow releases the funds of escrowID to its payee, payeeID, once the
+// payer let it expire without accepting or rejecting the delivery. The payee
+// authenticates with the password in the transient map.
+func (t *SupplyChain) ClaimEscrow(ctx contractapi.TransactionContextInterface, payeeID string, escrowID string) error {
+	payee, err := authenticate(ctx, []string{payeeID, escrowID}, payeeID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(payee)
+	if err != nil {
+		return err
+	}
+
+	escrow, err := LoadEscrow(ctx, escrowID)
+	if err != nil {
+		return err
+	}
+	if escrow.PayeeID != payee.UserID {
+		return errForbiddenRole("only %s can claim %s", escrow.PayeeID, escrowID)
+	}
+	if escrow.Status != EscrowStatusLocked {
+		return errInvalidTransition("escrow %s is %s", escrowID, escrow.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	expired, err := escrow.expired(now)
+	if err != nil {
+		return err
+	}
+	if !expired {
+		return errInvalidTransition("escrow %s can be settled by %s until %s", escrowID, escrow.PayerID, escrow.ExpiresAt)
+	}
+	err = requireClientOrg(ctx, payee.OrgID, "claim this escrow")
+	if err != nil {
+		return err
+	}
+	return finishEscrow(ctx, escrow, "expired", "Release", EscrowStatusReleased)
+}
+
+// SetPaymentAccount makes the submitting client identity the token account
+// userID pays from and is paid to. The user authenticates with the password
+// in the transient map.
+func (t *SupplyChain) SetPaymentAccount(ctx contractapi.TransactionContextInterface, userID string) error {
+	user, err := authenticate(ctx, []string{userID}, userID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+	err = requireClientOrg(ctx, user.OrgID, "set its payment account")
+	if err != nil {
+		return err
+	}
+
+	account, err := clientAccount(ctx)
+	if err != nil {
+		return err
+	}
+	user.PaymentAccount = account
+	return SaveUser(ctx, user)
+}
+
+// AcceptDelivery confirms the delivery paid for by escrowID and releases the
+// funds to the payee.
+func (t *SupplyChain) AcceptDelivery(ctx contractapi.TransactionContextInterface, payerID string, escrowID string) error {
+	return settleEscrow(ctx, payerID, escrowID, "", "Release", EscrowStatusReleased)
+}
+
+// RejectDelivery rejects the delivery paid for by escrowID and refunds the
+// funds to the payer.
+func (t *SupplyChain) RejectDelivery(ctx contractapi.TransactionContextInterface, payerID string, escrowID string, reason string) error {
+	if len(reason) == 0 {
+		return errValidation("a reason must be given for rejecting a delivery")
+	}
+	return settleEscrow(ctx, payerID, escrowID, reason, "Refund", EscrowStatusRefunded)
+}
+
+func (t *SupplyChain) QueryEscrow(ctx contractapi.TransactionContextInterface, escrowID string) (*Escrow, error) {
+	return LoadEscrow(ctx, escrowID)
+}
+
+// QueryEscrowsOf lists the escrows of the handoffs of productID.
+func (t *SupplyChain) QueryEscrowsOf(ctx contractapi.TransactionContextInterface, productID string) ([]*Escrow, error) {
+	ids, err := indexedIDs(ctx, escrowIndex, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Escrow{}
+	for _, id := range ids {
+		escrow, err := LoadEscrow(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, escrow)
+	}
+	return results, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// escrowLedger has Supplier1 approve paying 100 to Manufacturer1 for
+// Product1 and records the token calls the chaincode makes.
+func escrowLedger(t *testing.T, parameters map[string]string) (*testLedger, *[]string) {
+	l := newTestLedger(t)
+	l.put(SystemConfigKey, "system config", &SystemConfig{DocType: "systemConfig", ConfigID: SystemConfigKey, Parameters: parameters})
+	manufacturer := l.addUser("Manufacturer1", "manufacturer", "Org1MSP")
+	supplier := l.addUser("Supplier1", "supplier", "Org2MSP")
+	manufacturer.PaymentAccount = "alice"
+	supplier.PaymentAccount = "bob"
+	l.put(manufacturer.UserID, DocTypeUser, manufacturer)
+	l.put(supplier.UserID, DocTypeUser, supplier)
+	l.put("Product1", DocTypeProduct, &Product{ProductID: "Product1", SKU: "Vaccine", ManufacturerID: "Manufacturer1", Status: StatusAvailable, OwnerOrgID: "Org1MSP", HolderOrgID: "Org1MSP"})
+
+	calls := []string{}
+	l.stub.invoke = func(name string, args [][]byte, channel string) peer.Response {
+		call := []string{name, channel}
+		for _, arg := range args {
+			call = append(call, string(arg))
+		}
+		calls = append(calls, strings.Join(call, " "))
+		return shim.Success(nil)
+	}
+
+	err := l.submit("Org2MSP", "supplier1", func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(SupplyChain).ApproveEscrow(ctx, "Supplier1", "Product1", "Manufacturer1", 100)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ApproveEscrow error = %v", err)
+	}
+	return l, &calls
+}
+
+// handOverWithEscrow hands Product1 to Supplier1 asking to escrow amount.
+func handOverWithEscrow(l *testLedger, amount string) error {
+	l.stub.transient[TransientEscrowKey] = []byte(`{"Amount": ` + amount + `}`)
+	return l.submit("Org1MSP", "manufacturer1", func(ctx contractapi.TransactionContextInterface) error {
+		return new(SupplyChain).toSupplier(ctx, "Product1", "Supplier1", "52.37", "4.89", "", "")
+	})
+}
+
+func TestLockEscrow(t *testing.T) {
+	l, calls := escrowLedger(t, map[string]string{ParamEscrowTokenChaincode: "token"})
+
+	err := handOverWithEscrow(l, "100")
+	if err != nil {
+		t.Fatalf("toSupplier error = %v", err)
+	}
+	if want := []string{"token  TokenContract:LockFrom Escrow1 bob alice 100"}; strings.Join(*calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("token calls = %q, want %q", *calls, want)
+	}
+
+	escrow, err := LoadEscrow(l.ctx, "Escrow1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if escrow.Status != EscrowStatusLocked || escrow.LockedAt != "2024-06-01T12:00:00Z" || escrow.ExpiresAt != "2024-06-15T12:00:00Z" {
+		t.Errorf("escrow = %+v", escrow)
+	}
+
+	envelope := &common.SignaturePolicyEnvelope{}
+	err = proto.Unmarshal(l.stub.endorsers["Escrow1"], envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := envelope.Rule.GetNOutOf(); rule == nil || rule.N != 1 || len(envelope.Identities) != 2 {
+		t.Errorf("escrow endorsement policy = %v, want payer or payee", envelope)
+	}
+}
+
+func TestLockEscrowRefused(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		amount     string
+		code       ErrorCode
+	}{
+		{"amount not approved", map[string]string{ParamEscrowTokenChaincode: "token"}, "150", CodeForbiddenRole},
+		{"no token chaincode", map[string]string{}, "100", CodeInvalidStateTransition},
+		{"token on another channel", map[string]string{ParamEscrowTokenChaincode: "token", ParamEscrowTokenChannel: "payments"}, "100", CodeInvalidStateTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, calls := escrowLedger(t, tt.parameters)
+			err := handOverWithEscrow(l, tt.amount)
+			if !hasCode(err, tt.code) {
+				t.Errorf("toSupplier error = %v, want %s", err, tt.code)
+			}
+			if len(*calls) != 0 {
+				t.Errorf("token calls = %q, want none", *calls)
+			}
+		})
+	}
+}
+
+func TestSettleEscrow(t *testing.T) {
+	tests := []struct {
+		name   string
+		mspID  string
+		pass   string
+		after  time.Duration
+		settle func(ctx contractapi.TransactionContextInterface) error
+		status string
+		code   ErrorCode
+	}{
+		{"payer accepts", "Org2MSP", "supplier1", 0, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).AcceptDelivery(ctx, "Supplier1", "Escrow1")
+		}, EscrowStatusReleased, ""},
+		{"payer rejects", "Org2MSP", "supplier1", 0, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).RejectDelivery(ctx, "Supplier1", "Escrow1", "damaged")
+		}, EscrowStatusRefunded, ""},
+		{"payee accepts", "Org1MSP", "manufacturer1", 0, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).AcceptDelivery(ctx, "Manufacturer1", "Escrow1")
+		}, EscrowStatusLocked, CodeForbiddenRole},
+		{"payee claims early", "Org1MSP", "manufacturer1", 13 * 24 * time.Hour, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).ClaimEscrow(ctx, "Manufacturer1", "Escrow1")
+		}, EscrowStatusLocked, CodeInvalidStateTransition},
+		{"payee claims expired", "Org1MSP", "manufacturer1", 14 * 24 * time.Hour, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).ClaimEscrow(ctx, "Manufacturer1", "Escrow1")
+		}, EscrowStatusReleased, ""},
+		{"payer claims", "Org2MSP", "supplier1", 14 * 24 * time.Hour, func(ctx contractapi.TransactionContextInterface) error {
+			return new(SupplyChain).ClaimEscrow(ctx, "Supplier1", "Escrow1")
+		}, EscrowStatusLocked, CodeForbiddenRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, calls := escrowLedger(t, map[string]string{ParamEscrowTokenChaincode: "token"})
+			err := handOverWithEscrow(l, "100")
+			if err != nil {
+				t.Fatalf("toSupplier error = %v", err)
+			}
+
+			l.stub.now = l.stub.now.Add(tt.after)
+			err = l.submit(tt.mspID, tt.pass, tt.settle)
+			if tt.code == "" && err != nil || tt.code != "" && !hasCode(err, tt.code) {
+				t.Fatalf("settle error = %v, want %q", err, tt.code)
+			}
+
+			escrow, err := LoadEscrow(l.ctx, "Escrow1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if escrow.Status != tt.status {
+				t.Errorf("escrow status = %s, want %s", escrow.Status, tt.status)
+			}
+			if tt.code == "" {
+				if escrow.SettledAt != l.stub.now.Format(time.RFC3339) {
+					t.Errorf("escrow settled at %q", escrow.SettledAt)
+				}
+				if len(*calls) != 2 {
+					t.Errorf("token calls = %q, want lock and settlement", *calls)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- facility ------------------------------------------
+
+// Types of facility an org can register.
+var facilityTypes = map[string]bool{
+	"factory":   true,
+	"warehouse": true,
+	"port":      true,
+	"store":     true,
+}
+
+// facilityIndex maps an org to the ids of its facilities.
+const facilityIndex = "facility~org"
+
+// facilityGLNIndex maps a GLN to the facility carrying it, so a GLN is used
+// once.
+const facilityGLNIndex = "facility~gln"
+
+// productFacilityIndex maps a facility to the products currently at it.
+const productFacilityIndex = "product~facility"
+
+// Facility is a site operated by an org, such as a warehouse. Its geofence is
+// the circle of RadiusMeters around its coordinates. Capacity is how many
+// products and units of stock it can hold, 0 when unknown.
+type Facility struct {
+	DocType        string  `json:"DocType"`
+	FacilityID     string  `json:"FacilityID"`
+	OrgID          string  `json:"OrgID"`
+	Type           string  `json:"Type"`
+	Name           string  `json:"Name"`
+	Address        string  `json:"Address"`
+	GLN            string  `json:"GLN"`
+	Latitude       float64 `json:"Latitude"`
+	Longitude      float64 `json:"Longitude"`
+	RadiusMeters   float64 `json:"RadiusMeters"`
+	Capacity       int     `json:"Capacity"`
+	OperatingHours string  `json:"OperatingHours"`
+}
+
+// FacilityStock is the number of products and units of stock held at a
+// facility.
+type FacilityStock struct {
+	FacilityID   string `json:"FacilityID"`
+	Name         string `json:"Name"`
+	Type         string `json:"Type"`
+	Capacity     int    `json:"Capacity"`
+	ProductCount int    `json:"ProductCount"`
+	UnitsOnHand  int    `json:"UnitsOnHand"`
+}
+
+func (f *Facility) contains(latitude float64, longitude float64) bool {
+	return distanceMeters(f.Latitude, f.Longitude, latitude, longitude) <= f.RadiusMeters
+}
+
+// validGLN reports whether gln is a 13 digit GS1 Global Location Number with
+// a correct check digit.
+func validGLN(gln string) bool {
+	if len(gln) != 13 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 12; i++ {
+		digit := int(gln[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if i%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	check := int(gln[12] - '0')
+	return check >= 0 && check <= 9 && (10-sum%10)%10 == check
+}
+
+func validateFacility(facility *Facility) error {
+	if !facilityTypes[facility.Type] {
+		return errValidation("unknown facility type %q, expected factory, warehouse, port or store", facility.Type)
+	}
+	if len(facility.Name) == 0 {
+		return errValidation("facility name must be provided")
+	}
+	if facility.GLN != "" && !validGLN(facility.GLN) {
+		return errValidation("GLN %q is not a valid 13 digit GLN", facility.GLN)
+	}
+	err := validateCoordinates(facility.Latitude, facility.Longitude)
+	if err != nil {
+		return err
+	}
+	if math.IsNaN(facility.RadiusMeters) || facility.RadiusMeters <= 0 {
+		return errValidation("radius must be positive")
+	}
+	if facility.Capacity < 0 {
+		return errValidation("capacity can not be negative")
+	}
+	return nil
+}
+
+// authorizeFacilityChange authenticates adminID with the password in the
+// transient map and checks it may manage the facilities of its org.
+func authorizeFacilityChange(ctx contractapi.TransactionContextInterface, args []string, adminID string, facilityType string) (*User, error) {
+	admin, err := authenticate(ctx, args, adminID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(admin)
+	if err != nil {
+		return nil, err
+	}
+	err = authorize(ctx, admin, ActionManageFacility, facilityType)
+	if err != nil {
+		return nil, err
+	}
+	err = requireClientOrg(ctx, admin.OrgID, "manage its facilities")
+	if err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+// claimGLN records that facilityID carries gln, refusing GLNs already used by
+// another facility.
+func claimGLN(ctx contractapi.TransactionContextInterface, gln string, facilityID string) error {
+	if gln == "" {
+		return nil
+	}
+	ids, err := indexedIDs(ctx, facilityGLNIndex, gln)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id != facilityID {
+			return errConflict("GLN %s is already used by %s", gln, id)
+		}
+	}
+	return putIndex(ctx, facilityGLNIndex, gln, facilityID)
+}
+
+// facilityOccupancy counts what facilityID holds: the products placed at it
+// and the units of stock on hand.
+func facilityOccupancy(ctx contractapi.TransactionContextInterface, facilityID string) (int, int, error) {
+	ids, err := indexedIDs(ctx, productFacilityIndex, facilityID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(inventoryObjectType, []string{facilityID})
+	if err != nil {
+		return 0, 0, errInternal("failed to query inventory of %s: %s", facilityID, err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// Products booked in as stock are counted as products only
+	placed := map[string]bool{}
+	for _, id := range ids {
+		placed[id] = true
+	}
+	units := 0
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, 0, errInternal("failed to iterate inventory of %s: %s", facilityID, err.Error())
+		}
+		level, err := decodeInventoryLevel(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !placed[level.Lot] {
+			units += level.OnHand
+		}
+	}
+	return len(ids), units, nil
+}
+
+// requireCapacity refuses to bring adding more products or units into
+// facility than its Capacity allows. A capacity of 0 is unknown and not
+// enforced.
+func requireCapacity(ctx contractapi.TransactionContextInterface, facility *Facility, adding int) error {
+	if facility.Capacity == 0 || adding <= 0 {
+		return nil
+	}
+	products, units, err := facilityOccupancy(ctx, facility.FacilityID)
+	if err != nil {
+		return err
+	}
+	if products+units+adding > facility.Capacity {
+		return errInvalidTransition("%s holds %d of its capacity of %d, no room for %d more", facility.FacilityID, products+units, facility.Capacity, adding)
+	}
+	return nil
+}
+
+// placeProduct records that product is now at facilityID, or at no known
+// facility when it is empty, and keeps the facility index in step. The
+// facility must have room for it.
+func placeProduct(ctx contractapi.TransactionContextInterface, product *Product, facilityID string) error {
+	if facilityID != "" && facilityID != product.FacilityID {
+		facility, err := LoadFacility(ctx, facilityID)
+		if err != nil {
+			return err
+		}
+		err = requireCapacity(ctx, facility, 1)
+		if err != nil {
+			return err
+		}
+	}
+	if product.FacilityID != "" {
+		err := deleteIndex(ctx, productFacilityIndex, product.FacilityID, product.ProductID)
+		if err != nil {
+			return err
+		}
+	}
+
+	product.FacilityID = facilityID
+	if facilityID == "" {
+		return nil
+	}
+	return putIndex(ctx, productFacilityIndex, facilityID, product.ProductID)
+}
+
+// RegisterFacility registers a facility of adminID's org. FacilityID and
+// OrgID are assigned by the chaincode. The admin authenticates with the
+// password in the transient map. It returns the facility id.
+func (t *SupplyChain) RegisterFacility(ctx contractapi.TransactionContextInterface, adminID string, facility Facility) (string, error) {
+	admin, err := authorizeFacilityChange(ctx, []string{adminID, facility.Name, facility.Address}, adminID, facility.Type)
+	if err != nil {
+		return "", err
+	}
+
+	err = validateFacility(&facility)
+	if err != nil {
+		return "", err
+	}
+
+	facilityCounter, err := incrementCounter(ctx, "FacilityCounterNO")
+	if err != nil {
+		return "", err
+	}
+	facility.FacilityID = "Facility" + strconv.Itoa(facilityCounter)
+	facility.OrgID = admin.OrgID
+
+	err = claimGLN(ctx, facility.GLN, facility.FacilityID)
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveFacility(ctx, &facility)
+	if err != nil {
+		return "", err
+	}
+
+	err = putIndex(ctx, facilityIndex, facility.OrgID, facility.FacilityID)
+	if err != nil {
+		return "", err
+	}
+	return facility.FacilityID, nil
+}
+
+// UpdateFacility replaces the details of the facility with the same
+// FacilityID. The operating org can not change. The admin must be allowed to
+// manage facilities of the current type, and of the new one if it changes.
+func (t *SupplyChain) UpdateFacility(ctx contractapi.TransactionContextInterface, adminID string, facility Facility) error {
+	current, err := LoadFacility(ctx, facility.FacilityID)
+	if err != nil {
+		return err
+	}
+
+	admin, err := authorizeFacilityChange(ctx, []string{adminID, facility.Name, facility.Address}, adminID, current.Type)
+	if err != nil {
+		return err
+	}
+	if facility.Type != current.Type {
+		err = authorize(ctx, admin, ActionManageFacility, facility.Type)
+		if err != nil {
+			return err
+		}
+	}
+	if current.OrgID != admin.OrgID {
+		return errForbiddenRole("only an admin of %s can update %s", current.OrgID, current.FacilityID)
+	}
+
+	err = validateFacility(&facility)
+	if err != nil {
+		return err
+	}
+
+	if facility.GLN != current.GLN {
+		err = claimGLN(ctx, facility.GLN, facility.FacilityID)
+		if err != nil {
+			return err
+		}
+		if current.GLN != "" {
+			err = deleteIndex(ctx, facilityGLNIndex, current.GLN, current.FacilityID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	facility.OrgID = current.OrgID
+	return SaveFacility(ctx, &facility)
+}
+
+func (t *SupplyChain) QueryFacility(ctx contractapi.TransactionContextInterface, facilityID string) (*Facility, error) {
+	return LoadFacility(ctx, facilityID)
+}
+
+// QueryFacilitiesOf lists the facilities of orgID.
+func (t *SupplyChain) QueryFacilitiesOf(ctx contractapi.TransactionContextInterface, orgID string) ([]*Facility, error) {
+	ids, err := indexedIDs(ctx, facilityIndex, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Facility{}
+	for _, id := range ids {
+		facility, err := LoadFacility(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, facility)
+	}
+	return results, nil
+}
+
+// QueryFacilityInventory lists the products currently at facilityID.
+func (t *SupplyChain) QueryFacilityInventory(ctx contractapi.TransactionContextInterface, facilityID string) ([]*Product, error) {
+	ids, err := indexedIDs(ctx, productFacilityIndex, facilityID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Product{}
+	for _, id := range ids {
+		product, err := LoadProduct(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+	}
+	return results, nil
+}
+
+// QueryFacilityStock counts the products and units held at each facility of
+// orgID.
+func (t *SupplyChain) QueryFacilityStock(ctx contractapi.TransactionContextInterface, orgID string) ([]FacilityStock, error) {
+	facilities, err := t.QueryFacilitiesOf(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FacilityStock{}
+	for _, facility := range facilities {
+		products, units, err := facilityOccupancy(ctx, facility.FacilityID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, FacilityStock{
+			FacilityID:   facility.FacilityID,
+			Name:         facility.Name,
+			Type:         facility.Type,
+			Capacity:     facility.Capacity,
+			ProductCount: products,
+			UnitsOnHand:  units,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestValidGLN(t *testing.T) {
+	tests := []struct {
+		gln   string
+		valid bool
+	}{
+		{"4006381333931", true},
+		{"0614141000036", true},
+		{"9501101530003", true},
+		{"4006381333932", false},
+		{"400638133393", false},
+		{"40063813339310", false},
+		{"40063813339 1", false},
+		{"400638133393A", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validGLN(tt.gln); got != tt.valid {
+			t.Errorf("validGLN(%q) = %v, want %v", tt.gln, got, tt.valid)
+		}
+	}
+}
+
+func TestValidateFacility(t *testing.T) {
+	valid := Facility{Type: "warehouse", Name: "North DC", GLN: "4006381333931", Latitude: 52.52, Longitude: 13.405, RadiusMeters: 500, Capacity: 2000}
+	tests := []struct {
+		name   string
+		change func(*Facility)
+		valid  bool
+	}{
+		{"valid", func(f *Facility) {}, true},
+		{"without GLN or capacity", func(f *Facility) { f.GLN = ""; f.Capacity = 0 }, true},
+		{"unknown type", func(f *Facility) { f.Type = "depot" }, false},
+		{"no name", func(f *Facility) { f.Name = "" }, false},
+		{"bad GLN", func(f *Facility) { f.GLN = "4006381333932" }, false},
+		{"latitude out of range", func(f *Facility) { f.Latitude = 91 }, false},
+		{"no radius", func(f *Facility) { f.RadiusMeters = 0 }, false},
+		{"negative capacity", func(f *Facility) { f.Capacity = -1 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facility := valid
+			tt.change(&facility)
+			err := validateFacility(&facility)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateFacility error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestUpdateFacilityType(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		next    string
+		code    ErrorCode
+	}{
+		{"same type", "warehouse", "warehouse", ""},
+		{"to a type the admin may not manage", "warehouse", "port", CodeForbiddenRole},
+		{"from a type the admin may not manage", "port", "warehouse", CodeForbiddenRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			l.put(ACLPolicyKey, "ACL policy", &ACLPolicy{DocType: "aclPolicy", PolicyID: ACLPolicyKey, Rules: []ACLRule{
+				{RuleID: "warehouses", Role: "admin", OrgID: Wildcard, Action: ActionManageFacility, ResourceState: "warehouse", Effect: EffectAllow},
+			}})
+			l.addUser("Admin1", "admin", "Org1MSP")
+			facility := Facility{FacilityID: "Facility1", OrgID: "Org1MSP", Type: tt.current, Name: "North DC", Latitude: 52.52, Longitude: 13.405, RadiusMeters: 500}
+			l.put(facility.FacilityID, DocTypeFacility, &facility)
+
+			facility.Type = tt.next
+			err := l.submit("Org1MSP", "admin1", func(ctx contractapi.TransactionContextInterface) error {
+				return new(SupplyChain).UpdateFacility(ctx, "Admin1", facility)
+			})
+			if tt.code == "" && err != nil || tt.code != "" && !hasCode(err, tt.code) {
+				t.Errorf("UpdateFacility error = %v, want %q", err, tt.code)
+			}
+		})
+	}
+}
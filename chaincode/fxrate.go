@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- fx rates ------------------------------------------
+
+// System parameters of the rate oracle. Reports are normalized to the
+// reporting currency, USD by default, and rates older than the maximum age,
+// 24 hours by default, are not used.
+const (
+	ParamReportingCurrency = "fx.reporting_currency"
+	ParamFXMaxAgeHours     = "fx.max_age_hours"
+)
+
+// FXRate is the price of one unit of Base in Quote, as last published by a
+// price feeder. Rate is an exact decimal, such as "1.0825".
+type FXRate struct {
+	DocType  string `json:"DocType"`
+	RateID   string `json:"RateID"`
+	Base     string `json:"Base"`
+	Quote    string `json:"Quote"`
+	Rate     string `json:"Rate"`
+	Source   string `json:"Source"`
+	FeederID string `json:"FeederID"`
+	AsOf     string `json:"AsOf"`
+}
+
+// UnmarshalJSON also decodes rates published before rates were exact
+// decimals, which stored Rate as a JSON number.
+func (r *FXRate) UnmarshalJSON(data []byte) error {
+	type plain FXRate
+	var fields struct {
+		plain
+		Rate json.Number `json:"Rate"`
+	}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	*r = FXRate(fields.plain)
+	r.Rate = fields.Rate.String()
+	return nil
+}
+
+// OrderValue is the value of a purchase order in its own currency and in the
+// reporting currency. Reported is missing for orders placed before orders
+// carried a currency, and for orders in a currency no current rate converts.
+type OrderValue struct {
+	OrderID     string `json:"OrderID"`
+	BuyerOrgID  string `json:"BuyerOrgID"`
+	SellerOrgID string `json:"SellerOrgID"`
+	Status      string `json:"Status"`
+	Value       Money  `json:"Value"`
+	Reported    *Money `json:"Reported,omitempty"`
+}
+
+func fxRateID(base string, quote string) string {
+	return "FXRate" + base + quote
+}
+
+func reportingCurrency(config *SystemConfig) (string, error) {
+	currency := config.Parameters[ParamReportingCurrency]
+	if currency == "" {
+		return "USD", nil
+	}
+	err := validateCurrency(currency)
+	if err != nil {
+		return "", errValidation("parameter %s: %s", ParamReportingCurrency, err.Error())
+	}
+	return currency, nil
+}
+
+// lookupRate returns the rate converting base to quote from the published
+// base/quote rate, or else from the inverse of the quote/base rate. Rates
+// older than maxAge are ignored.
+func lookupRate(ctx contractapi.TransactionContextInterface, base string, quote string, maxAge time.Duration, now time.Time) (*big.Rat, bool, error) {
+	for _, inverse := range []bool{false, true} {
+		id := fxRateID(base, quote)
+		if inverse {
+			id = fxRateID(quote, base)
+		}
+		rate, err := LoadFXRate(ctx, id)
+		if hasCode(err, CodeNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		asOf, err := time.Parse(time.RFC3339, rate.AsOf)
+		if err != nil || now.Sub(asOf) > maxAge {
+			continue
+		}
+		value, ok := new(big.Rat).SetString(rate.Rate)
+		if !ok || value.Sign() <= 0 {
+			return nil, false, errInternal("corrupt rate %s: %q", rate.RateID, rate.Rate)
+		}
+		if inverse {
+			return value.Inv(value), true, nil
+		}
+		return value, true, nil
+	}
+	return nil, false, nil
+}
+
+// convertMoney converts m to currency, rounded to its minor unit. Without a
+// rate between the two currencies it crosses through the reporting currency.
+func convertMoney(ctx contractapi.TransactionContextInterface, config *SystemConfig, m Money, currency string) (Money, error) {
+	err := validateCurrency(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	err = validateCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if m.Currency == currency {
+		return roundedMoney(m.rat(), currency)
+	}
+
+	maxAgeHours, err := intParameter(config, ParamFXMaxAgeHours, 24)
+	if err != nil {
+		return Money{}, err
+	}
+	maxAge := time.Duration(maxAgeHours) * time.Hour
+	now, err := txTime(ctx)
+	if err != nil {
+		return Money{}, err
+	}
+
+	rate, ok, err := lookupRate(ctx, m.Currency, currency, maxAge, now)
+	if err != nil {
+		return Money{}, err
+	}
+	if !ok {
+		pivot, err := reportingCurrency(config)
+		if err != nil {
+			return Money{}, err
+		}
+		toPivot, ok1, err := lookupRate(ctx, m.Currency, pivot, maxAge, now)
+		if err != nil {
+			return Money{}, err
+		}
+		fromPivot, ok2, err := lookupRate(ctx, pivot, currency, maxAge, now)
+		if err != nil {
+			return Money{}, err
+		}
+		if !ok1 || !ok2 || pivot == m.Currency || pivot == currency {
+			return Money{}, errNotFound("no current rate converts %s to %s", m.Currency, currency)
+		}
+		rate = toPivot.Mul(toPivot, fromPivot)
+	}
+	return roundedMoney(rate.Mul(rate, m.rat()), currency)
+}
+
+// orderTotal is the value of all lines of order.
+func orderTotal(order *PurchaseOrder) (Money, error) {
+	total := Money{Scale: currencyDigits[order.Currency], Currency: order.Currency}
+	for _, line := range order.Lines {
+		value, err := line.UnitPrice.withCurrency(order.Currency).times(line.Quantity)
+		if err != nil {
+			return Money{}, err
+		}
+		total, err = total.plus(value)
+		if err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// UpdateFXRate publishes the price of one unit of base in quote, a decimal
+// such as "1.0825". Only users the ACL lets feed rates can publish,
+// authenticating with the password in the transient map.
+func (t *SupplyChain) UpdateFXRate(ctx contractapi.TransactionContextInterface, feederID string, base string, quote string, rate string, source string) error {
+	feeder, err := authenticate(ctx, []string{feederID, base, quote, rate, source}, feederID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(feeder)
+	if err != nil {
+		return err
+	}
+	err = authorize(ctx, feeder, ActionFeedFXRates, base)
+	if err != nil {
+		return err
+	}
+	err = requireClientOrg(ctx, feeder.OrgID, "feed rates")
+	if err != nil {
+		return err
+	}
+
+	err = validateCurrency(base)
+	if err != nil {
+		return err
+	}
+	err = validateCurrency(quote)
+	if err != nil {
+		return err
+	}
+	if base == quote {
+		return errValidation("a rate needs two different currencies")
+	}
+	value, err := parseDecimal(rate, maxDecimals)
+	if err != nil {
+		return err
+	}
+	if value.Sign() <= 0 {
+		return errValidation("rate must be positive")
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	return SaveFXRate(ctx, &FXRate{
+		RateID:   fxRateID(base, quote),
+		Base:     base,
+		Quote:    quote,
+		Rate:     value.FloatString(maxDecimals),
+		Source:   source,
+		FeederID: feeder.UserID,
+		AsOf:     now.Format(time.RFC3339),
+	})
+}
+
+func (t *SupplyChain) QueryFXRate(ctx contractapi.TransactionContextInterface, base string, quote string) (*FXRate, error) {
+	return LoadFXRate(ctx, fxRateID(base, quote))
+}
+
+// ConvertAmount converts amount to currency at the current rates.
+func (t *SupplyChain) ConvertAmount(ctx contractapi.TransactionContextInterface, amount Money, currency string) (*Money, error) {
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := convertMoney(ctx, config, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	return &converted, nil
+}
+
+// QueryOrderValues lists the value of every order orgID placed or received,
+// normalized to the reporting currency where a current rate allows it.
+func (t *SupplyChain) QueryOrderValues(ctx contractapi.TransactionContextInterface, orgID string) ([]OrderValue, error) {
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := reportingCurrency(config)
+	if err != nil {
+		return nil, err
+	}
+
+	orders, err := t.QueryPurchaseOrdersOf(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []OrderValue{}
+	for _, order := range orders {
+		total, err := orderTotal(order)
+		if err != nil {
+			return nil, err
+		}
+		value := OrderValue{
+			OrderID:     order.OrderID,
+			BuyerOrgID:  order.BuyerOrgID,
+			SellerOrgID: order.SellerOrgID,
+			Status:      order.Status,
+			Value:       total,
+		}
+		if order.Currency != "" {
+			reported, err := convertMoney(ctx, config, value.Value, currency)
+			if err == nil {
+				value.Reported = &reported
+			} else if !hasCode(err, CodeNotFound) {
+				return nil, err
+			}
+		}
+		results = append(results, value)
+	}
+	return results, nil
+}
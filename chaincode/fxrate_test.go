@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// rateStub serves the world state reads convertMoney makes. Any other call
+// panics on the nil embedded interface.
+type rateStub struct {
+	shim.ChaincodeStubInterface
+	state map[string][]byte
+	now   time.Time
+}
+
+func (s *rateStub) GetState(key string) ([]byte, error) {
+	return s.state[key], nil
+}
+
+func (s *rateStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now.Unix()}, nil
+}
+
+func TestConvertMoney(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	stub := &rateStub{state: map[string][]byte{}, now: now}
+	publish := func(base string, quote string, rate string, age time.Duration) {
+		data := `{"DocType": "` + DocTypeFXRate + `", "RateID": "` + fxRateID(base, quote) + `", "Base": "` + base + `", "Quote": "` + quote + `", "Rate": ` + rate + `, "AsOf": "` + now.Add(-age).Format(time.RFC3339) + `"}`
+		stub.state[fxRateID(base, quote)] = []byte(data)
+	}
+	publish("EUR", "USD", `"1.0825"`, time.Hour)
+	publish("USD", "JPY", `"157.3"`, 2*time.Hour)
+	publish("GBP", "USD", `"1.27"`, 30*time.Hour)
+	// Published before rates were exact decimals
+	publish("CHF", "EUR", `1.04`, time.Hour)
+
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(stub)
+	config := &SystemConfig{Parameters: map[string]string{}}
+
+	tests := []struct {
+		name     string
+		amount   Money
+		currency string
+		want     Money
+		code     ErrorCode
+	}{
+		{"direct rate", Money{Units: 10000, Scale: 2, Currency: "EUR"}, "USD", Money{Units: 10825, Scale: 2, Currency: "USD"}, ""},
+		{"inverse rate", Money{Units: 10825, Scale: 2, Currency: "USD"}, "EUR", Money{Units: 10000, Scale: 2, Currency: "EUR"}, ""},
+		{"inverse rate rounded", Money{Units: 1000, Scale: 2, Currency: "USD"}, "EUR", Money{Units: 924, Scale: 2, Currency: "EUR"}, ""},
+		{"through the reporting currency", Money{Units: 100, Scale: 2, Currency: "EUR"}, "JPY", Money{Units: 170, Scale: 0, Currency: "JPY"}, ""},
+		{"legacy numeric rate", Money{Units: 5000, Scale: 2, Currency: "CHF"}, "EUR", Money{Units: 5200, Scale: 2, Currency: "EUR"}, ""},
+		{"same currency rounds", Money{Units: 12345, Scale: 3, Currency: "EUR"}, "EUR", Money{Units: 1235, Scale: 2, Currency: "EUR"}, ""},
+		{"stale rate", Money{Units: 100, Scale: 2, Currency: "GBP"}, "USD", Money{}, CodeNotFound},
+		{"no rate", Money{Units: 100, Scale: 2, Currency: "SEK"}, "NOK", Money{}, CodeNotFound},
+		{"unsupported currency", Money{Units: 100, Scale: 2, Currency: "EUR"}, "XXX", Money{}, CodeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertMoney(ctx, config, tt.amount, tt.currency)
+			if tt.code != "" {
+				if !hasCode(err, tt.code) {
+					t.Errorf("convertMoney error = %v, want %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convertMoney error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("convertMoney = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFXRateUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data  string
+		want  string
+		valid bool
+	}{
+		{`{"RateID": "FXRateEURUSD", "Rate": "1.0825"}`, "1.0825", true},
+		{`{"RateID": "FXRateEURUSD", "Rate": 1.0825}`, "1.0825", true},
+		{`{"RateID": "FXRateUSDJPY", "Rate": 157}`, "157", true},
+		{`{"RateID": "FXRateEURUSD", "Rate": "high"}`, "", false},
+	}
+	for _, tt := range tests {
+		var rate FXRate
+		err := json.Unmarshal([]byte(tt.data), &rate)
+		if (err == nil) != tt.valid {
+			t.Errorf("Unmarshal(%s) error = %v, want valid %v", tt.data, err, tt.valid)
+			continue
+		}
+		if tt.valid && (rate.Rate != tt.want || rate.RateID == "") {
+			t.Errorf("Unmarshal(%s) = %+v, want rate %s", tt.data, rate, tt.want)
+		}
+	}
+}
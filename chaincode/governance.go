@@ -0,0 +1,456 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- governance ------------------------------------------
+
+// Kinds of system change a proposal can carry.
+const (
+	ChangeSetParameter  = "set_parameter"
+	ChangeSetRoles      = "set_roles"
+	ChangePutACLRule    = "put_acl_rule"
+	ChangeDeleteACLRule = "delete_acl_rule"
+)
+
+// Proposal statuses.
+const (
+	ProposalStatusOpen     = "Open"
+	ProposalStatusExecuted = "Executed"
+	ProposalStatusRejected = "Rejected"
+	ProposalStatusExpired  = "Expired"
+)
+
+// System parameters read by the governance transactions themselves. The
+// quorum is the number of organizations that must approve a proposal, by
+// default a majority of them.
+const (
+	ParamGovernanceQuorum   = "governance.quorum"
+	ParamProposalTTLHours   = "governance.proposal_ttl_hours"
+	defaultProposalTTLHours = 72
+)
+
+// proposalIndex maps a proposal status to proposal ids.
+const proposalIndex = "proposal~status"
+
+// ProposedChange is the system change a proposal applies once executed. Only
+// the fields of its Kind are used: Key and Value for set_parameter, Roles for
+// set_roles, Rule for put_acl_rule and RuleID for delete_acl_rule.
+type ProposedChange struct {
+	Kind   string   `json:"Kind"`
+	Key    string   `json:"Key"`
+	Value  string   `json:"Value"`
+	Roles  []string `json:"Roles"`
+	Rule   ACLRule  `json:"Rule"`
+	RuleID string   `json:"RuleID"`
+}
+
+// GovernanceVote is the vote an organization cast on a proposal. Each org
+// votes once, through one of its governance admins.
+type GovernanceVote struct {
+	OrgID     string `json:"OrgID"`
+	UserID    string `json:"UserID"`
+	Approve   bool   `json:"Approve"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// Proposal is a system change waiting for the approval of enough orgs.
+type Proposal struct {
+	DocType     string           `json:"DocType"`
+	ProposalID  string           `json:"ProposalID"`
+	ProposerID  string           `json:"ProposerID"`
+	Description string           `json:"Description"`
+	Change      ProposedChange   `json:"Change"`
+	Status      string           `json:"Status"`
+	Votes       []GovernanceVote `json:"Votes"`
+	CreatedAt   string           `json:"CreatedAt"`
+	ExpiresAt   string           `json:"ExpiresAt"`
+	ExecutedBy  string           `json:"ExecutedBy"`
+}
+
+func (p *Proposal) tally() (approvals int, rejections int) {
+	for _, vote := range p.Votes {
+		if vote.Approve {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	return approvals, rejections
+}
+
+func (p *Proposal) expired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, p.ExpiresAt)
+	return err != nil || !now.Before(expiresAt)
+}
+
+// intParameter reads the integer system parameter key, or fallback when it is
+// not set.
+func intParameter(config *SystemConfig, key string, fallback int) (int, error) {
+	value, ok := config.Parameters[key]
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, errValidation("parameter %s must be a positive integer, got %q", key, value)
+	}
+	return n, nil
+}
+
+// governanceQuorum returns how many of the orgs must approve a proposal and
+// how many orgs there are.
+func governanceQuorum(ctx contractapi.TransactionContextInterface, config *SystemConfig) (int, int, error) {
+	orgIDs, err := organizationIDs(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	quorum, err := intParameter(config, ParamGovernanceQuorum, len(orgIDs)/2+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if quorum > len(orgIDs) {
+		return 0, 0, errValidation("quorum of %d is more than the %d organizations", quorum, len(orgIDs))
+	}
+	return quorum, len(orgIDs), nil
+}
+
+func validateChange(ctx contractapi.TransactionContextInterface, change *ProposedChange) error {
+	switch change.Kind {
+	case ChangeSetParameter:
+		if len(change.Key) == 0 {
+			return errValidation("parameter key must be provided")
+		}
+		if change.Key == ParamEscrowTokenChannel && change.Value != "" {
+			return errValidation("the token chaincode must run on this channel, %s can only be cleared", ParamEscrowTokenChannel)
+		}
+		if change.Key != ParamGovernanceQuorum && change.Key != ParamProposalTTLHours {
+			return nil
+		}
+		n, err := strconv.Atoi(change.Value)
+		if err != nil || n <= 0 {
+			return errValidation("parameter %s must be a positive integer, got %q", change.Key, change.Value)
+		}
+		if change.Key == ParamGovernanceQuorum {
+			orgIDs, err := organizationIDs(ctx)
+			if err != nil {
+				return err
+			}
+			if n > len(orgIDs) {
+				return errValidation("quorum of %d is more than the %d organizations", n, len(orgIDs))
+			}
+		}
+	case ChangeSetRoles:
+		if len(change.Roles) == 0 {
+			return errValidation("at least one role must stay enabled")
+		}
+		for _, role := range change.Roles {
+			if !knownRoles[role] {
+				return errValidation("unknown role %q", role)
+			}
+		}
+	case ChangePutACLRule:
+		return validateACLRule(&change.Rule)
+	case ChangeDeleteACLRule:
+		if len(change.RuleID) == 0 {
+			return errValidation("rule id must be provided")
+		}
+	default:
+		return errValidation("unknown change %q, expected set_parameter, set_roles, put_acl_rule or delete_acl_rule", change.Kind)
+	}
+	return nil
+}
+
+// applyChange makes change take effect.
+func applyChange(ctx contractapi.TransactionContextInterface, change *ProposedChange) error {
+	switch change.Kind {
+	case ChangeSetParameter, ChangeSetRoles:
+		config, err := LoadSystemConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if change.Kind == ChangeSetRoles {
+			config.Roles = change.Roles
+		} else {
+			if config.Parameters == nil {
+				config.Parameters = map[string]string{}
+			}
+			config.Parameters[change.Key] = change.Value
+		}
+		return SaveSystemConfig(ctx, config)
+
+	case ChangePutACLRule, ChangeDeleteACLRule:
+		policy, err := LoadACLPolicy(ctx)
+		if err != nil {
+			return err
+		}
+		if change.Kind == ChangePutACLRule {
+			policy.putRule(change.Rule)
+		} else {
+			err = policy.deleteRule(change.RuleID)
+			if err != nil {
+				return err
+			}
+		}
+		return SaveACLPolicy(ctx, policy)
+	}
+	return errValidation("unknown change %q", change.Kind)
+}
+
+// authorizeGovernor authenticates userID with the password in the transient
+// map and checks that the ACL lets it take part in governance for its org.
+func authorizeGovernor(ctx contractapi.TransactionContextInterface, args []string, userID string, kind string) (*User, error) {
+	user, err := authenticate(ctx, args, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return nil, err
+	}
+	err = authorize(ctx, user, ActionGovern, kind)
+	if err != nil {
+		return nil, err
+	}
+	err = requireClientOrg(ctx, user.OrgID, "vote for their org")
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// setProposalStatus moves proposal to status and keeps the status index in
+// step.
+func setProposalStatus(ctx contractapi.TransactionContextInterface, proposal *Proposal, status string) error {
+	if proposal.Status != "" {
+		err := deleteIndex(ctx, proposalIndex, proposal.Status, proposal.ProposalID)
+		if err != nil {
+			return err
+		}
+	}
+	proposal.Status = status
+	return putIndex(ctx, proposalIndex, status, proposal.ProposalID)
+}
+
+// requireOpen refuses proposals that are closed or past their expiry.
+func requireOpen(proposal *Proposal, now time.Time) error {
+	if proposal.Status != ProposalStatusOpen {
+		return errInvalidTransition("proposal %s is %s", proposal.ProposalID, proposal.Status)
+	}
+	if proposal.expired(now) {
+		return errInvalidTransition("proposal %s expired at %s", proposal.ProposalID, proposal.ExpiresAt)
+	}
+	return nil
+}
+
+// ProposeChange opens a proposal for change, which takes effect once admins
+// of enough orgs approved it and it is executed. proposerID must be a
+// governance admin and authenticates with the password in the transient map.
+// The proposal counts as approved by the proposer's org. It returns the
+// proposal id.
+func (t *SupplyChain) ProposeChange(ctx contractapi.TransactionContextInterface, proposerID string, change ProposedChange, description string) (string, error) {
+	proposer, err := authorizeGovernor(ctx, []string{proposerID, description, change.Key, change.Value}, proposerID, change.Kind)
+	if err != nil {
+		return "", err
+	}
+
+	err = validateChange(ctx, &change)
+	if err != nil {
+		return "", err
+	}
+
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	ttlHours, err := intParameter(config, ParamProposalTTLHours, defaultProposalTTLHours)
+	if err != nil {
+		return "", err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	proposalCounter, err := incrementCounter(ctx, "ProposalCounterNO")
+	if err != nil {
+		return "", err
+	}
+
+	proposal := Proposal{
+		ProposalID:  "Proposal" + strconv.Itoa(proposalCounter),
+		ProposerID:  proposer.UserID,
+		Description: description,
+		Change:      change,
+		Votes: []GovernanceVote{
+			{OrgID: proposer.OrgID, UserID: proposer.UserID, Approve: true, Timestamp: now.Format(time.RFC3339)},
+		},
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(time.Duration(ttlHours) * time.Hour).Format(time.RFC3339),
+	}
+	err = setProposalStatus(ctx, &proposal, ProposalStatusOpen)
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveProposal(ctx, &proposal)
+	if err != nil {
+		return "", err
+	}
+	return proposal.ProposalID, nil
+}
+
+// VoteOnProposal records the vote of voterID's org on proposalID. Each org
+// votes once. A proposal that can no longer reach the quorum is rejected.
+func (t *SupplyChain) VoteOnProposal(ctx contractapi.TransactionContextInterface, voterID string, proposalID string, approve bool) error {
+	proposal, err := LoadProposal(ctx, proposalID)
+	if err != nil {
+		return err
+	}
+
+	voter, err := authorizeGovernor(ctx, []string{voterID, proposalID}, voterID, proposal.Change.Kind)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	err = requireOpen(proposal, now)
+	if err != nil {
+		return err
+	}
+
+	for _, vote := range proposal.Votes {
+		if vote.OrgID == voter.OrgID {
+			return errConflict("%s already voted on %s", voter.OrgID, proposalID)
+		}
+	}
+	proposal.Votes = append(proposal.Votes, GovernanceVote{
+		OrgID:     voter.OrgID,
+		UserID:    voter.UserID,
+		Approve:   approve,
+		Timestamp: now.Format(time.RFC3339),
+	})
+
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return err
+	}
+	quorum, orgCount, err := governanceQuorum(ctx, config)
+	if err != nil {
+		return err
+	}
+	_, rejections := proposal.tally()
+	if rejections > orgCount-quorum {
+		err = setProposalStatus(ctx, proposal, ProposalStatusRejected)
+		if err != nil {
+			return err
+		}
+	}
+
+	return SaveProposal(ctx, proposal)
+}
+
+// ExecuteProposal applies the change of proposalID once orgs reaching the
+// quorum approved it and before it expires. The quorum in force at execution
+// time applies.
+func (t *SupplyChain) ExecuteProposal(ctx contractapi.TransactionContextInterface, actorID string, proposalID string) error {
+	proposal, err := LoadProposal(ctx, proposalID)
+	if err != nil {
+		return err
+	}
+
+	actor, err := authorizeGovernor(ctx, []string{actorID, proposalID}, actorID, proposal.Change.Kind)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	err = requireOpen(proposal, now)
+	if err != nil {
+		return err
+	}
+
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return err
+	}
+	quorum, _, err := governanceQuorum(ctx, config)
+	if err != nil {
+		return err
+	}
+	approvals, _ := proposal.tally()
+	if approvals < quorum {
+		return errInvalidTransition("proposal %s has %d of the %d approvals it needs", proposalID, approvals, quorum)
+	}
+
+	err = applyChange(ctx, &proposal.Change)
+	if err != nil {
+		return err
+	}
+
+	proposal.ExecutedBy = actor.UserID
+	err = setProposalStatus(ctx, proposal, ProposalStatusExecuted)
+	if err != nil {
+		return err
+	}
+	return SaveProposal(ctx, proposal)
+}
+
+// ExpireProposal closes an open proposal whose expiry has passed. Anyone can
+// call it.
+func (t *SupplyChain) ExpireProposal(ctx contractapi.TransactionContextInterface, proposalID string) error {
+	proposal, err := LoadProposal(ctx, proposalID)
+	if err != nil {
+		return err
+	}
+	if proposal.Status != ProposalStatusOpen {
+		return errInvalidTransition("proposal %s is %s", proposalID, proposal.Status)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if !proposal.expired(now) {
+		return errInvalidTransition("proposal %s is open until %s", proposalID, proposal.ExpiresAt)
+	}
+
+	err = setProposalStatus(ctx, proposal, ProposalStatusExpired)
+	if err != nil {
+		return err
+	}
+	return SaveProposal(ctx, proposal)
+}
+
+func (t *SupplyChain) QueryProposal(ctx contractapi.TransactionContextInterface, proposalID string) (*Proposal, error) {
+	return LoadProposal(ctx, proposalID)
+}
+
+// QueryProposals lists the proposals with status, such as Open.
+func (t *SupplyChain) QueryProposals(ctx contractapi.TransactionContextInterface, status string) ([]*Proposal, error) {
+	ids, err := indexedIDs(ctx, proposalIndex, status)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Proposal{}
+	for _, id := range ids {
+		proposal, err := LoadProposal(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, proposal)
+	}
+	return results, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// governanceLedger has three orgs, so two must approve a proposal, each with
+// a governance admin AdminN. Admin1 proposed to set the proposal TTL to 24
+// hours as Proposal1.
+func governanceLedger(t *testing.T) *testLedger {
+	l := newTestLedger(t)
+	l.put(SystemConfigKey, "system config", &SystemConfig{DocType: "systemConfig", ConfigID: SystemConfigKey, Parameters: map[string]string{}})
+	for _, n := range []string{"1", "2", "3"} {
+		err := putIndex(l.ctx, organizationIndex, "Org"+n+"MSP")
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin := l.addUser("Admin"+n, "admin", "Org"+n+"MSP")
+		admin.AdminRole = GovernanceRole
+		l.put(admin.UserID, DocTypeUser, admin)
+	}
+
+	err := l.submit("Org1MSP", "admin1", func(ctx contractapi.TransactionContextInterface) error {
+		_, err := new(SupplyChain).ProposeChange(ctx, "Admin1", ProposedChange{Kind: ChangeSetParameter, Key: ParamProposalTTLHours, Value: "24"}, "shorter votes")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ProposeChange error = %v", err)
+	}
+	return l
+}
+
+func vote(voterID string, approve bool) func(ctx contractapi.TransactionContextInterface) error {
+	return func(ctx contractapi.TransactionContextInterface) error {
+		return new(SupplyChain).VoteOnProposal(ctx, voterID, "Proposal1", approve)
+	}
+}
+
+func execute(actorID string) func(ctx contractapi.TransactionContextInterface) error {
+	return func(ctx contractapi.TransactionContextInterface) error {
+		return new(SupplyChain).ExecuteProposal(ctx, actorID, "Proposal1")
+	}
+}
+
+func TestGovernanceVoting(t *testing.T) {
+	type step struct {
+		mspID    string
+		password string
+		after    time.Duration
+		tx       func(ctx contractapi.TransactionContextInterface) error
+		code     ErrorCode
+	}
+	tests := []struct {
+		name   string
+		steps  []step
+		status string
+		ttl    string
+	}{
+		{"approved and executed", []step{
+			{"Org2MSP", "admin2", 0, vote("Admin2", true), ""},
+			{"Org3MSP", "admin3", 0, execute("Admin3"), ""},
+		}, ProposalStatusExecuted, "24"},
+		{"executed short of the quorum", []step{
+			{"Org1MSP", "admin1", 0, execute("Admin1"), CodeInvalidStateTransition},
+		}, ProposalStatusOpen, ""},
+		{"org votes twice", []step{
+			{"Org1MSP", "admin1", 0, vote("Admin1", false), CodeConflict},
+		}, ProposalStatusOpen, ""},
+		{"vote submitted by another org", []step{
+			{"Org1MSP", "admin2", 0, vote("Admin2", true), CodeForbiddenRole},
+		}, ProposalStatusOpen, ""},
+		{"rejected by a blocking minority", []step{
+			{"Org2MSP", "admin2", 0, vote("Admin2", false), ""},
+			{"Org3MSP", "admin3", 0, vote("Admin3", false), ""},
+			{"Org1MSP", "admin1", 0, execute("Admin1"), CodeInvalidStateTransition},
+		}, ProposalStatusRejected, ""},
+		{"vote after expiry", []step{
+			{"Org2MSP", "admin2", defaultProposalTTLHours * time.Hour, vote("Admin2", true), CodeInvalidStateTransition},
+		}, ProposalStatusOpen, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := governanceLedger(t)
+			for i, s := range tt.steps {
+				l.stub.now = l.stub.now.Add(s.after)
+				err := l.submit(s.mspID, s.password, s.tx)
+				if s.code == "" && err != nil || s.code != "" && !hasCode(err, s.code) {
+					t.Fatalf("step %d error = %v, want %q", i+1, err, s.code)
+				}
+			}
+
+			proposal, err := LoadProposal(l.ctx, "Proposal1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proposal.Status != tt.status {
+				t.Errorf("proposal status = %s, want %s", proposal.Status, tt.status)
+			}
+			config, err := LoadSystemConfig(l.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := config.Parameters[ParamProposalTTLHours]; ttl != tt.ttl {
+				t.Errorf("%s = %q, want %q", ParamProposalTTLHours, ttl, tt.ttl)
+			}
+		})
+	}
+}
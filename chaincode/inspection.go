@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- quality inspection ------------------------------------------
+
+// QualityHoldEvent is emitted with a failed inspection, which put the goods
+// it covers on quality hold.
+const QualityHoldEvent = "QualityHold"
+
+// Stages goods are inspected at: at the source, such as a supplier's
+// warehouse, or on delivery to the receiving org.
+const (
+	InspectionStageSource   = "source"
+	InspectionStageDelivery = "delivery"
+)
+
+// Inspection results and statuses. A failed inspection stays On hold until
+// it is disposed of.
+const (
+	InspectionPassed = "Passed"
+	InspectionFailed = "Failed"
+
+	InspectionStatusClosed   = "Closed"
+	InspectionStatusOnHold   = "On hold"
+	InspectionStatusDisposed = "Disposed"
+)
+
+// Defect severities. Major and critical defects fail an inspection.
+var defectSeverities = map[string]bool{
+	"minor":    true,
+	"major":    true,
+	"critical": true,
+}
+
+// Dispositions of failed goods. Every disposition but scrap lifts the hold,
+// scrapped goods stay held for good.
+var qualityDispositions = map[string]bool{
+	"use_as_is":        true,
+	"rework":           true,
+	"return_to_vendor": true,
+	"scrap":            true,
+}
+
+// Indexes of inspections by product, and by facility, SKU and lot.
+const (
+	inspectionProductIndex = "inspection~product"
+	inspectionLotIndex     = "inspection~facility~sku~lot"
+)
+
+// ChecklistItem is the outcome of one check of an inspection.
+type ChecklistItem struct {
+	Item   string `json:"Item"`
+	Passed bool   `json:"Passed"`
+	Note   string `json:"Note"`
+}
+
+// Defect is a defect found, Quantity being the number of units affected.
+type Defect struct {
+	Code        string `json:"Code"`
+	Severity    string `json:"Severity"`
+	Description string `json:"Description"`
+	Quantity    int    `json:"Quantity"`
+}
+
+// Inspection is a quality inspection at FacilityID of either TargetID, a
+// product or a container, or of the lot Lot of SKU stocked at the facility.
+// EvidenceHashes are the hex encoded SHA-256 of photos and documents kept
+// off-chain. The inspection fails when a check fails or a major or critical
+// defect is found.
+type Inspection struct {
+	DocType         string          `json:"DocType"`
+	InspectionID    string          `json:"InspectionID"`
+	Stage           string          `json:"Stage"`
+	InspectorID     string          `json:"InspectorID"`
+	OrgID           string          `json:"OrgID"`
+	FacilityID      string          `json:"FacilityID"`
+	TargetID        string          `json:"TargetID"`
+	ProductIDs      []string        `json:"ProductIDs"`
+	SKU             string          `json:"SKU"`
+	Lot             string          `json:"Lot"`
+	Checklist       []ChecklistItem `json:"Checklist"`
+	Defects         []Defect        `json:"Defects"`
+	EvidenceHashes  []string        `json:"EvidenceHashes"`
+	Result          string          `json:"Result"`
+	Status          string          `json:"Status"`
+	InspectedAt     string          `json:"InspectedAt"`
+	Disposition     string          `json:"Disposition"`
+	DispositionBy   string          `json:"DispositionBy"`
+	DispositionNote string          `json:"DispositionNote"`
+	DisposedAt      string          `json:"DisposedAt"`
+}
+
+// inspectionResult validates the findings of inspection and returns whether
+// it passed.
+func inspectionResult(inspection *Inspection) (string, error) {
+	if inspection.Stage != InspectionStageSource && inspection.Stage != InspectionStageDelivery {
+		return "", errValidation("stage must be %q or %q, got %q", InspectionStageSource, InspectionStageDelivery, inspection.Stage)
+	}
+	if len(inspection.Checklist) == 0 {
+		return "", errValidation("an inspection needs at least one checklist item")
+	}
+	for _, hash := range inspection.EvidenceHashes {
+		decoded, err := hex.DecodeString(hash)
+		if err != nil || len(decoded) != 32 {
+			return "", errValidation("evidence hash %q is not a hex encoded SHA-256", hash)
+		}
+	}
+
+	result := InspectionPassed
+	for i, item := range inspection.Checklist {
+		if len(item.Item) == 0 {
+			return "", errValidation("checklist item %d has no name", i)
+		}
+		if !item.Passed {
+			result = InspectionFailed
+		}
+	}
+	for i, defect := range inspection.Defects {
+		if !defectSeverities[defect.Severity] {
+			return "", errValidation("defect %d: severity must be minor, major or critical, got %q", i, defect.Severity)
+		}
+		if defect.Quantity < 0 {
+			return "", errValidation("defect %d: quantity can not be negative", i)
+		}
+		if defect.Severity != "minor" {
+			result = InspectionFailed
+		}
+	}
+	return result, nil
+}
+
+// requireNoQualityHold refuses to move product on while it is on hold.
+func requireNoQualityHold(product *Product) error {
+	if product.QualityHold != "" {
+		return errInvalidTransition("product %s is on quality hold after %s", product.ProductID, product.QualityHold)
+	}
+	return nil
+}
+
+// inspectProducts checks inspector may inspect the products of targetID and,
+// when failed is set, puts them on hold under inspectionID.
+func inspectProducts(ctx contractapi.TransactionContextInterface, inspector *User, inspection *Inspection, failed bool) error {
+	products, err := telemetryProducts(ctx, inspection.TargetID)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		err = authorize(ctx, inspector, ActionInspect, product.Status)
+		if err != nil {
+			return err
+		}
+		if inspector.OrgID != product.HolderOrgID {
+			return errForbiddenRole("only members of %s, holding %s, can inspect it", product.HolderOrgID, product.ProductID)
+		}
+		inspection.ProductIDs = append(inspection.ProductIDs, product.ProductID)
+
+		err = putIndex(ctx, inspectionProductIndex, product.ProductID, inspection.InspectionID)
+		if err != nil {
+			return err
+		}
+		if !failed {
+			continue
+		}
+		if product.QualityHold != "" {
+			return errConflict("product %s is already on hold after %s, dispose of it first", product.ProductID, product.QualityHold)
+		}
+		product.QualityHold = inspection.InspectionID
+		err = SaveProduct(ctx, product)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inspectLot puts the lot of inspection at facility on hold when failed is
+// set. Held stock can still be adjusted, but not reserved, sold or shipped.
+func inspectLot(ctx contractapi.TransactionContextInterface, inspector *User, facility *Facility, inspection *Inspection, failed bool) error {
+	err := authorize(ctx, inspector, ActionInspect, "")
+	if err != nil {
+		return err
+	}
+	level, err := loadInventoryLevel(ctx, facility, inspection.SKU, inspection.Lot)
+	if err != nil {
+		return err
+	}
+	if level.OnHand == 0 && level.InTransit == 0 {
+		return errNotFound("no stock of %s lot %q at %s", inspection.SKU, inspection.Lot, facility.FacilityID)
+	}
+
+	err = putIndex(ctx, inspectionLotIndex, facility.FacilityID, inspection.SKU, inspection.Lot, inspection.InspectionID)
+	if err != nil {
+		return err
+	}
+	if !failed {
+		return nil
+	}
+	if level.QualityHold != "" {
+		return errConflict("%s lot %q at %s is already on hold after %s, dispose of it first", level.SKU, level.Lot, level.FacilityID, level.QualityHold)
+	}
+	level.QualityHold = inspection.InspectionID
+	return SaveInventoryLevel(ctx, level)
+}
+
+// RecordInspection records an inspection by inspectorID at one of the
+// facilities of its org, of a product or container it holds, given as
+// TargetID, or of a lot stocked at the facility, given as SKU and Lot. A
+// failed inspection puts the goods on quality hold until DisposeInspection.
+// The inspector authenticates with the password in the transient map. It
+// returns the inspection id.
+func (t *SupplyChain) RecordInspection(ctx contractapi.TransactionContextInterface, inspectorID string, inspection Inspection) (string, error) {
+	inspector, err := authenticate(ctx, []string{inspectorID, inspection.FacilityID, inspection.TargetID, inspection.SKU, inspection.Lot}, inspectorID)
+	if err != nil {
+		return "", err
+	}
+	err = requireActive(inspector)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := inspectionResult(&inspection)
+	if err != nil {
+		return "", err
+	}
+	if (inspection.TargetID == "") == (inspection.SKU == "") {
+		return "", errValidation("an inspection covers either a product or container, or a lot of a SKU")
+	}
+	facility, err := LoadFacility(ctx, inspection.FacilityID)
+	if err != nil {
+		return "", err
+	}
+	if facility.OrgID != inspector.OrgID {
+		return "", errForbiddenRole("%s is not a facility of %s", facility.FacilityID, inspector.OrgID)
+	}
+	err = requireClientOrg(ctx, inspector.OrgID, "record inspections")
+	if err != nil {
+		return "", err
+	}
+
+	inspectionCounter, err := incrementCounter(ctx, "InspectionCounterNO")
+	if err != nil {
+		return "", err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	inspection.InspectionID = "Inspection" + strconv.Itoa(inspectionCounter)
+	inspection.InspectorID = inspector.UserID
+	inspection.OrgID = inspector.OrgID
+	inspection.ProductIDs = []string{}
+	inspection.Result = result
+	inspection.Status = InspectionStatusClosed
+	inspection.InspectedAt = now.Format(time.RFC3339)
+	inspection.Disposition = ""
+	inspection.DispositionBy = ""
+	inspection.DispositionNote = ""
+	inspection.DisposedAt = ""
+	if inspection.Defects == nil {
+		inspection.Defects = []Defect{}
+	}
+	if inspection.EvidenceHashes == nil {
+		inspection.EvidenceHashes = []string{}
+	}
+
+	failed := result == InspectionFailed
+	if failed {
+		inspection.Status = InspectionStatusOnHold
+	}
+	if inspection.TargetID != "" {
+		err = inspectProducts(ctx, inspector, &inspection, failed)
+	} else {
+		err = inspectLot(ctx, inspector, facility, &inspection, failed)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveInspection(ctx, &inspection)
+	if err != nil {
+		return "", err
+	}
+	if failed {
+		payload, err := json.Marshal(inspection)
+		if err != nil {
+			return "", errInternal("marshal error for %s event: %s", QualityHoldEvent, err.Error())
+		}
+		err = ctx.GetStub().SetEvent(QualityHoldEvent, payload)
+		if err != nil {
+			return "", errInternal("failed to emit %s event: %s", QualityHoldEvent, err.Error())
+		}
+	}
+	return inspection.InspectionID, nil
+}
+
+// DisposeInspection decides what happens to the goods a failed inspection put
+// on hold: use_as_is, rework, return_to_vendor or scrap. The user must be
+// allowed to dispose of goods in the org that inspected them and
+// authenticates with the password in the transient map.
+func (t *SupplyChain) DisposeInspection(ctx contractapi.TransactionContextInterface, userID string, inspectionID string, disposition string, note string) error {
+	user, err := authenticate(ctx, []string{userID, inspectionID, disposition, note}, userID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+	if !qualityDispositions[disposition] {
+		return errValidation("disposition must be use_as_is, rework, return_to_vendor or scrap, got %q", disposition)
+	}
+
+	inspection, err := LoadInspection(ctx, inspectionID)
+	if err != nil {
+		return err
+	}
+	if inspection.Status != InspectionStatusOnHold {
+		return errInvalidTransition("inspection %s is %s", inspectionID, inspection.Status)
+	}
+	err = authorize(ctx, user, ActionDisposeQuality, disposition)
+	if err != nil {
+		return err
+	}
+	if user.OrgID != inspection.OrgID {
+		return errForbiddenRole("only members of %s can dispose of %s", inspection.OrgID, inspectionID)
+	}
+	err = requireClientOrg(ctx, inspection.OrgID, "dispose of this inspection")
+	if err != nil {
+		return err
+	}
+
+	if disposition != "scrap" {
+		for _, productID := range inspection.ProductIDs {
+			product, err := LoadProduct(ctx, productID)
+			if err != nil {
+				return err
+			}
+			if product.QualityHold != inspectionID {
+				continue
+			}
+			product.QualityHold = ""
+			err = SaveProduct(ctx, product)
+			if err != nil {
+				return err
+			}
+		}
+		if inspection.SKU != "" {
+			facility, err := LoadFacility(ctx, inspection.FacilityID)
+			if err != nil {
+				return err
+			}
+			level, err := loadInventoryLevel(ctx, facility, inspection.SKU, inspection.Lot)
+			if err != nil {
+				return err
+			}
+			if level.QualityHold == inspectionID {
+				level.QualityHold = ""
+				err = SaveInventoryLevel(ctx, level)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	inspection.Status = InspectionStatusDisposed
+	inspection.Disposition = disposition
+	inspection.DispositionBy = user.UserID
+	inspection.DispositionNote = note
+	inspection.DisposedAt = now.Format(time.RFC3339)
+	return SaveInspection(ctx, inspection)
+}
+
+func (t *SupplyChain) QueryInspection(ctx contractapi.TransactionContextInterface, inspectionID string) (*Inspection, error) {
+	return LoadInspection(ctx, inspectionID)
+}
+
+func loadInspections(ctx contractapi.TransactionContextInterface, index string, attributes ...string) ([]*Inspection, error) {
+	ids, err := indexedIDs(ctx, index, attributes...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Inspection{}
+	for _, id := range ids {
+		inspection, err := LoadInspection(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, inspection)
+	}
+	return results, nil
+}
+
+// QueryInspectionsOf lists the inspections of productID.
+func (t *SupplyChain) QueryInspectionsOf(ctx contractapi.TransactionContextInterface, productID string) ([]*Inspection, error) {
+	return loadInspections(ctx, inspectionProductIndex, productID)
+}
+
+// QueryLotInspections lists the inspections of lot of sku at facilityID.
+func (t *SupplyChain) QueryLotInspections(ctx contractapi.TransactionContextInterface, facilityID string, sku string, lot string) ([]*Inspection, error) {
+	return loadInspections(ctx, inspectionLotIndex, facilityID, sku, lot)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInspectionResult(t *testing.T) {
+	evidence := strings.Repeat("ab", 32)
+	passing := []ChecklistItem{{Item: "seal intact", Passed: true}, {Item: "labels", Passed: true}}
+
+	tests := []struct {
+		name       string
+		inspection Inspection
+		want       string
+		valid      bool
+	}{
+		{"all checks pass", Inspection{Stage: InspectionStageSource, Checklist: passing, EvidenceHashes: []string{evidence}}, InspectionPassed, true},
+		{"minor defects pass", Inspection{Stage: InspectionStageDelivery, Checklist: passing, Defects: []Defect{{Severity: "minor", Quantity: 3}}}, InspectionPassed, true},
+		{"failed check", Inspection{Stage: InspectionStageSource, Checklist: []ChecklistItem{{Item: "seal intact", Passed: true}, {Item: "labels"}}}, InspectionFailed, true},
+		{"major defect", Inspection{Stage: InspectionStageSource, Checklist: passing, Defects: []Defect{{Severity: "major", Quantity: 1}}}, InspectionFailed, true},
+		{"critical defect", Inspection{Stage: InspectionStageDelivery, Checklist: passing, Defects: []Defect{{Severity: "minor"}, {Severity: "critical"}}}, InspectionFailed, true},
+		{"unknown stage", Inspection{Stage: "transit", Checklist: passing}, "", false},
+		{"empty checklist", Inspection{Stage: InspectionStageSource}, "", false},
+		{"unnamed check", Inspection{Stage: InspectionStageSource, Checklist: []ChecklistItem{{Passed: true}}}, "", false},
+		{"unknown severity", Inspection{Stage: InspectionStageSource, Checklist: passing, Defects: []Defect{{Severity: "cosmetic"}}}, "", false},
+		{"negative defect quantity", Inspection{Stage: InspectionStageSource, Checklist: passing, Defects: []Defect{{Severity: "minor", Quantity: -1}}}, "", false},
+		{"evidence not hex", Inspection{Stage: InspectionStageSource, Checklist: passing, EvidenceHashes: []string{strings.Repeat("zz", 32)}}, "", false},
+		{"evidence not SHA-256", Inspection{Stage: InspectionStageSource, Checklist: passing, EvidenceHashes: []string{"abcd"}}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inspectionResult(&tt.inspection)
+			if (err == nil) != tt.valid {
+				t.Fatalf("inspectionResult error = %v, want valid %v", err, tt.valid)
+			}
+			if got != tt.want {
+				t.Errorf("inspectionResult = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- inventory ------------------------------------------
+
+// inventoryObjectType is the composite key prefix of inventory levels, keyed
+// by facility, SKU and lot.
+const inventoryObjectType = "inventory"
+
+// inventoryMovementIndex maps a facility and SKU to the movements that
+// changed its levels.
+const inventoryMovementIndex = "movement~facility~sku"
+
+// Kinds of inventory movement.
+const (
+	MovementReceipt     = "receipt"
+	MovementTransferOut = "transfer_out"
+	MovementInbound     = "inbound"
+	MovementTransferIn  = "transfer_in"
+	MovementSale        = "sale"
+	MovementReserve     = "reserve"
+	MovementRelease     = "release"
+	MovementAdjustment  = "adjustment"
+)
+
+// Transfer statuses.
+const (
+	TransferStatusInTransit = "In transit"
+	TransferStatusReceived  = "Received"
+)
+
+// adjustmentReasons are the reason codes accepted for cycle count
+// adjustments.
+var adjustmentReasons = map[string]bool{
+	"cycle_count": true,
+	"damage":      true,
+	"loss":        true,
+	"found":       true,
+	"expiry":      true,
+	"correction":  true,
+}
+
+// InventoryLevel is the stock of one lot of a SKU at a facility. OnHand is
+// physically at the facility, Reserved is the part of it promised to orders
+// and InTransit is on its way to the facility. QualityHold is the failed
+// inspection holding the lot, see inspection.go.
+type InventoryLevel struct {
+	DocType     string `json:"DocType"`
+	InventoryID string `json:"InventoryID"`
+	FacilityID  string `json:"FacilityID"`
+	OrgID       string `json:"OrgID"`
+	SKU         string `json:"SKU"`
+	Lot         string `json:"Lot"`
+	OnHand      int    `json:"OnHand"`
+	Reserved    int    `json:"Reserved"`
+	InTransit   int    `json:"InTransit"`
+	QualityHold string `json:"QualityHold"`
+}
+
+// InventoryMovement is the audit record of a change to an InventoryLevel.
+type InventoryMovement struct {
+	DocType        string `json:"DocType"`
+	MovementID     string `json:"MovementID"`
+	Kind           string `json:"Kind"`
+	FacilityID     string `json:"FacilityID"`
+	SKU            string `json:"SKU"`
+	Lot            string `json:"Lot"`
+	OnHandDelta    int    `json:"OnHandDelta"`
+	ReservedDelta  int    `json:"ReservedDelta"`
+	InTransitDelta int    `json:"InTransitDelta"`
+	ReasonCode     string `json:"ReasonCode"`
+	Reference      string `json:"Reference"`
+	UserID         string `json:"UserID"`
+	Timestamp      string `json:"Timestamp"`
+}
+
+// InventoryTransfer moves a quantity of a lot between two facilities. It is
+// in transit from the moment it is shipped until the destination receives it.
+type InventoryTransfer struct {
+	DocType        string `json:"DocType"`
+	TransferID     string `json:"TransferID"`
+	FromFacilityID string `json:"FromFacilityID"`
+	ToFacilityID   string `json:"ToFacilityID"`
+	SKU            string `json:"SKU"`
+	Lot            string `json:"Lot"`
+	Quantity       int    `json:"Quantity"`
+	Status         string `json:"Status"`
+	ShippedBy      string `json:"ShippedBy"`
+	ReceivedBy     string `json:"ReceivedBy"`
+}
+
+func (l *InventoryLevel) available() int {
+	return l.OnHand - l.Reserved
+}
+
+// loadInventoryLevel returns the level of sku and lot at facility, or an
+// empty level when none was recorded yet.
+func loadInventoryLevel(ctx contractapi.TransactionContextInterface, facility *Facility, sku string, lot string) (*InventoryLevel, error) {
+	if len(sku) == 0 {
+		return nil, errValidation("sku must be provided")
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(inventoryObjectType, []string{facility.FacilityID, sku, lot})
+	if err != nil {
+		return nil, errInternal("failed to create inventory key: %s", err.Error())
+	}
+
+	level, err := LoadInventoryLevel(ctx, key)
+	if hasCode(err, CodeNotFound) {
+		return &InventoryLevel{InventoryID: key, FacilityID: facility.FacilityID, OrgID: facility.OrgID, SKU: sku, Lot: lot}, nil
+	}
+	return level, err
+}
+
+// applyMovement changes level by the deltas of movement, refusing changes that
+// would leave a negative or over-reserved stock or move held stock on, and
+// records the movement. A movement without a MovementID gets the next one of
+// the movement counter; callers recording several movements in one
+// transaction reserve their ids with reserveCounter first.
+func applyMovement(ctx contractapi.TransactionContextInterface, level *InventoryLevel, movement *InventoryMovement) error {
+	if level.QualityHold != "" && (movement.Kind == MovementReserve || movement.Kind == MovementSale || movement.Kind == MovementTransferOut) {
+		return errInvalidTransition("%s lot %q at %s is on quality hold after %s", level.SKU, level.Lot, level.FacilityID, level.QualityHold)
+	}
+	onHand := level.OnHand + movement.OnHandDelta
+	reserved := level.Reserved + movement.ReservedDelta
+	inTransit := level.InTransit + movement.InTransitDelta
+	if onHand < 0 || reserved < 0 || inTransit < 0 {
+		return errInvalidTransition("not enough stock of %s lot %q at %s", level.SKU, level.Lot, level.FacilityID)
+	}
+	if reserved > onHand {
+		return errInvalidTransition("only %d of %s lot %q at %s are available", level.available(), level.SKU, level.Lot, level.FacilityID)
+	}
+	if movement.OnHandDelta > 0 {
+		facility, err := LoadFacility(ctx, level.FacilityID)
+		if err != nil {
+			return err
+		}
+		err = requireCapacity(ctx, facility, movement.OnHandDelta)
+		if err != nil {
+			return err
+		}
+	}
+
+	isNew := level.OnHand == 0 && level.Reserved == 0 && level.InTransit == 0
+	level.OnHand = onHand
+	level.Reserved = reserved
+	level.InTransit = inTransit
+	err := SaveInventoryLevel(ctx, level)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		// Only the operating org of the facility endorses changes to its stock
+		err = setKeyEndorsers(ctx, level.InventoryID, level.OrgID)
+		if err != nil {
+			return err
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if movement.MovementID == "" {
+		movementCounter, err := incrementCounter(ctx, "MovementCounterNO")
+		if err != nil {
+			return err
+		}
+		movement.MovementID = "Movement" + strconv.Itoa(movementCounter)
+	}
+	movement.FacilityID = level.FacilityID
+	movement.SKU = level.SKU
+	movement.Lot = level.Lot
+	movement.Timestamp = now.String()
+
+	err = SaveInventoryMovement(ctx, movement)
+	if err != nil {
+		return err
+	}
+	return putIndex(ctx, inventoryMovementIndex, movement.FacilityID, movement.SKU, movement.MovementID)
+}
+
+// moveProductStock books a serialized product, as one unit of its SKU with
+// the product id as lot, out of fromFacilityID with a movement of outKind and
+// into toFacilityID with one of inKind. Only a facility named in the handoff
+// books it in, and only a facility it was booked into books it out, so
+// products placed by their position alone, or before they were counted as
+// stock, move no stock.
+func moveProductStock(ctx contractapi.TransactionContextInterface, product *Product, fromFacilityID string, toFacilityID string, userID string, outKind string, inKind string) error {
+	type booking struct {
+		level    *InventoryLevel
+		movement *InventoryMovement
+	}
+	bookings := []booking{}
+
+	if fromFacilityID != "" {
+		from, err := LoadFacility(ctx, fromFacilityID)
+		if err != nil {
+			return err
+		}
+		level, err := loadInventoryLevel(ctx, from, product.SKU, product.ProductID)
+		if err != nil {
+			return err
+		}
+		if level.OnHand > 0 {
+			bookings = append(bookings, booking{level, &InventoryMovement{Kind: outKind, OnHandDelta: -1}})
+		}
+	}
+	if toFacilityID != "" {
+		to, err := LoadFacility(ctx, toFacilityID)
+		if err != nil {
+			return err
+		}
+		level, err := loadInventoryLevel(ctx, to, product.SKU, product.ProductID)
+		if err != nil {
+			return err
+		}
+		bookings = append(bookings, booking{level, &InventoryMovement{Kind: inKind, OnHandDelta: 1}})
+	}
+	if len(bookings) == 0 {
+		return nil
+	}
+
+	movementCounter, err := reserveCounter(ctx, "MovementCounterNO", len(bookings))
+	if err != nil {
+		return err
+	}
+	for i, b := range bookings {
+		b.movement.MovementID = "Movement" + strconv.Itoa(movementCounter+i)
+		b.movement.Reference = product.ProductID
+		b.movement.UserID = userID
+		err = applyMovement(ctx, b.level, b.movement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeInventory authenticates userID with the password in the transient
+// map and checks it may record a movement of kind at facilityID, which must
+// be operated by the user's org. It returns the user and the facility.
+func authorizeInventory(ctx contractapi.TransactionContextInterface, args []string, userID string, facilityID string, kind string) (*User, *Facility, error) {
+	user, err := authenticate(ctx, args, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = authorize(ctx, user, ActionManageInventory, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	facility, err := LoadFacility(ctx, facilityID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if facility.OrgID != user.OrgID {
+		return nil, nil, errForbiddenRole("only members of %s can change the stock of %s", facility.OrgID, facilityID)
+	}
+	err = requireClientOrg(ctx, facility.OrgID, "change the stock of "+facilityID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, facility, nil
+}
+
+func requirePositive(quantity int) error {
+	if quantity <= 0 {
+		return errValidation("quantity must be positive, got %d", quantity)
+	}
+	return nil
+}
+
+// changeInventory is the common body of the single-facility movements.
+func changeInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, movement *InventoryMovement) error {
+	args := []string{userID, facilityID, sku, lot, movement.Reference, movement.ReasonCode}
+	user, facility, err := authorizeInventory(ctx, args, userID, facilityID, movement.Kind)
+	if err != nil {
+		return err
+	}
+
+	level, err := loadInventoryLevel(ctx, facility, sku, lot)
+	if err != nil {
+		return err
+	}
+
+	movement.UserID = user.UserID
+	return applyMovement(ctx, level, movement)
+}
+
+// ReceiveInventory adds quantity units of lot of sku received at facilityID
+// from outside the supply chain, such as production or a vendor delivery.
+// userID authenticates with the password in the transient map, as for every
+// inventory transaction.
+func (t *SupplyChain) ReceiveInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, quantity int, reference string) error {
+	err := requirePositive(quantity)
+	if err != nil {
+		return err
+	}
+	return changeInventory(ctx, userID, facilityID, sku, lot, &InventoryMovement{Kind: MovementReceipt, OnHandDelta: quantity, Reference: reference})
+}
+
+// ReserveInventory sets quantity available units aside for reference, such
+// as an order.
+func (t *SupplyChain) ReserveInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, quantity int, reference string) error {
+	err := requirePositive(quantity)
+	if err != nil {
+		return err
+	}
+	return changeInventory(ctx, userID, facilityID, sku, lot, &InventoryMovement{Kind: MovementReserve, ReservedDelta: quantity, Reference: reference})
+}
+
+// ReleaseInventory makes quantity reserved units available again.
+func (t *SupplyChain) ReleaseInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, quantity int, reference string) error {
+	err := requirePositive(quantity)
+	if err != nil {
+		return err
+	}
+	return changeInventory(ctx, userID, facilityID, sku, lot, &InventoryMovement{Kind: MovementRelease, ReservedDelta: -quantity, Reference: reference})
+}
+
+// SellInventory removes quantity sold units. With fromReservation the units
+// are taken from the reserved stock, otherwise from the available stock.
+func (t *SupplyChain) SellInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, quantity int, fromReservation bool, reference string) error {
+	err := requirePositive(quantity)
+	if err != nil {
+		return err
+	}
+
+	movement := InventoryMovement{Kind: MovementSale, OnHandDelta: -quantity, Reference: reference}
+	if fromReservation {
+		movement.ReservedDelta = -quantity
+	}
+	return changeInventory(ctx, userID, facilityID, sku, lot, &movement)
+}
+
+// AdjustInventory records a cycle count: the on hand stock of lot of sku at
+// facilityID becomes countedQuantity. reasonCode must be one of the
+// adjustment reasons, the difference is kept in the movement audit trail.
+func (t *SupplyChain) AdjustInventory(ctx contractapi.TransactionContextInterface, userID string, facilityID string, sku string, lot string, countedQuantity int, reasonCode string, note string) error {
+	if !adjustmentReasons[reasonCode] {
+		return errValidation("unknown reason code %q, expected cycle_count, damage, loss, found, expiry or correction", reasonCode)
+	}
+	if countedQuantity < 0 {
+		return errValidation("counted quantity can not be negative")
+	}
+
+	user, facility, err := authorizeInventory(ctx, []string{userID, facilityID, sku, lot, reasonCode, note}, userID, facilityID, MovementAdjustment)
+	if err != nil {
+		return err
+	}
+
+	level, err := loadInventoryLevel(ctx, facility, sku, lot)
+	if err != nil {
+		return err
+	}
+	if countedQuantity == level.OnHand {
+		return errConflict("count matches the on hand stock of %d, nothing to adjust", level.OnHand)
+	}
+
+	return applyMovement(ctx, level, &InventoryMovement{
+		Kind:        MovementAdjustment,
+		OnHandDelta: countedQuantity - level.OnHand,
+		ReasonCode:  reasonCode,
+		Reference:   note,
+		UserID:      user.UserID,
+	})
+}
+
+// ShipInventory sends quantity available units of lot of sku from
+// fromFacilityID to toFacilityID, where they are in transit until received.
+// It returns the transfer id.
+func (t *SupplyChain) ShipInventory(ctx contractapi.TransactionContextInterface, userID string, fromFacilityID string, toFacilityID string, sku string, lot string, quantity int) (string, error) {
+	err := requirePositive(quantity)
+	if err != nil {
+		return "", err
+	}
+	if fromFacilityID == toFacilityID {
+		return "", errValidation("can not transfer stock to the facility it is at")
+	}
+
+	user, from, err := authorizeInventory(ctx, []string{userID, fromFacilityID, toFacilityID, sku, lot}, userID, fromFacilityID, MovementTransferOut)
+	if err != nil {
+		return "", err
+	}
+	to, err := LoadFacility(ctx, toFacilityID)
+	if err != nil {
+		return "", err
+	}
+
+	transferCounter, err := incrementCounter(ctx, "TransferCounterNO")
+	if err != nil {
+		return "", err
+	}
+	transfer := InventoryTransfer{
+		TransferID:     "Transfer" + strconv.Itoa(transferCounter),
+		FromFacilityID: from.FacilityID,
+		ToFacilityID:   to.FacilityID,
+		SKU:            sku,
+		Lot:            lot,
+		Quantity:       quantity,
+		Status:         TransferStatusInTransit,
+		ShippedBy:      user.UserID,
+	}
+
+	// Both movements are recorded in this transaction, which would read the
+	// same committed counter twice
+	movementCounter, err := reserveCounter(ctx, "MovementCounterNO", 2)
+	if err != nil {
+		return "", err
+	}
+
+	source, err := loadInventoryLevel(ctx, from, sku, lot)
+	if err != nil {
+		return "", err
+	}
+	err = applyMovement(ctx, source, &InventoryMovement{MovementID: "Movement" + strconv.Itoa(movementCounter), Kind: MovementTransferOut, OnHandDelta: -quantity, Reference: transfer.TransferID, UserID: user.UserID})
+	if err != nil {
+		return "", err
+	}
+
+	destination, err := loadInventoryLevel(ctx, to, sku, lot)
+	if err != nil {
+		return "", err
+	}
+	err = applyMovement(ctx, destination, &InventoryMovement{MovementID: "Movement" + strconv.Itoa(movementCounter+1), Kind: MovementInbound, InTransitDelta: quantity, Reference: transfer.TransferID, UserID: user.UserID})
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveInventoryTransfer(ctx, &transfer)
+	if err != nil {
+		return "", err
+	}
+	return transfer.TransferID, nil
+}
+
+// ReceiveTransfer books the stock of transferID in at its destination.
+func (t *SupplyChain) ReceiveTransfer(ctx contractapi.TransactionContextInterface, userID string, transferID string) error {
+	transfer, err := LoadInventoryTransfer(ctx, transferID)
+	if err != nil {
+		return err
+	}
+	if transfer.Status != TransferStatusInTransit {
+		return errInvalidTransition("transfer %s is %s", transferID, transfer.Status)
+	}
+
+	user, to, err := authorizeInventory(ctx, []string{userID, transferID}, userID, transfer.ToFacilityID, MovementTransferIn)
+	if err != nil {
+		return err
+	}
+
+	level, err := loadInventoryLevel(ctx, to, transfer.SKU, transfer.Lot)
+	if err != nil {
+		return err
+	}
+	err = applyMovement(ctx, level, &InventoryMovement{
+		Kind:           MovementTransferIn,
+		OnHandDelta:    transfer.Quantity,
+		InTransitDelta: -transfer.Quantity,
+		Reference:      transfer.TransferID,
+		UserID:         user.UserID,
+	})
+	if err != nil {
+		return err
+	}
+
+	transfer.Status = TransferStatusReceived
+	transfer.ReceivedBy = user.UserID
+	return SaveInventoryTransfer(ctx, transfer)
+}
+
+func (t *SupplyChain) QueryInventoryTransfer(ctx contractapi.TransactionContextInterface, transferID string) (*InventoryTransfer, error) {
+	return LoadInventoryTransfer(ctx, transferID)
+}
+
+// QueryInventory lists the stock levels at facilityID, optionally only those
+// of sku.
+func (t *SupplyChain) QueryInventory(ctx contractapi.TransactionContextInterface, facilityID string, sku string) ([]*InventoryLevel, error) {
+	attributes := []string{facilityID}
+	if sku != "" {
+		attributes = append(attributes, sku)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(inventoryObjectType, attributes)
+	if err != nil {
+		return nil, errInternal("failed to query inventory: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	results := []*InventoryLevel{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, errInternal("failed to iterate inventory: %s", err.Error())
+		}
+
+		level, err := decodeInventoryLevel(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, level)
+	}
+	return results, nil
+}
+
+// QueryInventoryMovements returns the audit trail of the stock of sku at
+// facilityID.
+func (t *SupplyChain) QueryInventoryMovements(ctx contractapi.TransactionContextInterface, facilityID string, sku string) ([]*InventoryMovement, error) {
+	ids, err := indexedIDs(ctx, inventoryMovementIndex, facilityID, sku)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*InventoryMovement{}
+	for _, id := range ids {
+		movement, err := LoadInventoryMovement(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, movement)
+	}
+	return results, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// stockLedger has a warehouse of Org1MSP with room for 10 products and units
+// holding 5 units of Vaccine lot L1, 2 of them reserved.
+func stockLedger(t *testing.T, qualityHold string) (*testLedger, *InventoryLevel) {
+	l := newTestLedger(t)
+	facility := &Facility{FacilityID: "Facility1", OrgID: "Org1MSP", Type: "warehouse", Name: "North DC", Latitude: 52.37, Longitude: 4.89, RadiusMeters: 500, Capacity: 10}
+	l.put(facility.FacilityID, DocTypeFacility, facility)
+
+	level, err := loadInventoryLevel(l.ctx, facility, "Vaccine", "L1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.OnHand = 5
+	level.Reserved = 2
+	level.QualityHold = qualityHold
+	err = SaveInventoryLevel(l.ctx, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.stub.commit()
+	return l, level
+}
+
+func TestApplyMovement(t *testing.T) {
+	tests := []struct {
+		name     string
+		hold     string
+		movement InventoryMovement
+		onHand   int
+		reserved int
+		code     ErrorCode
+	}{
+		{"receipt", "", InventoryMovement{Kind: MovementReceipt, OnHandDelta: 5}, 10, 2, ""},
+		{"over capacity", "", InventoryMovement{Kind: MovementReceipt, OnHandDelta: 6}, 5, 2, CodeInvalidStateTransition},
+		{"reserve the rest", "", InventoryMovement{Kind: MovementReserve, ReservedDelta: 3}, 5, 5, ""},
+		{"reserve more than available", "", InventoryMovement{Kind: MovementReserve, ReservedDelta: 4}, 5, 2, CodeInvalidStateTransition},
+		{"sell from the reservation", "", InventoryMovement{Kind: MovementSale, OnHandDelta: -2, ReservedDelta: -2}, 3, 0, ""},
+		{"sell reserved units", "", InventoryMovement{Kind: MovementSale, OnHandDelta: -4}, 5, 2, CodeInvalidStateTransition},
+		{"release more than reserved", "", InventoryMovement{Kind: MovementRelease, ReservedDelta: -3}, 5, 2, CodeInvalidStateTransition},
+		{"sell held stock", "Inspection1", InventoryMovement{Kind: MovementSale, OnHandDelta: -1}, 5, 2, CodeInvalidStateTransition},
+		{"count held stock", "Inspection1", InventoryMovement{Kind: MovementAdjustment, OnHandDelta: -1}, 4, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, level := stockLedger(t, tt.hold)
+			movement := tt.movement
+			err := l.submit("Org1MSP", "", func(ctx contractapi.TransactionContextInterface) error {
+				return applyMovement(ctx, level, &movement)
+			})
+			if tt.code == "" && err != nil || tt.code != "" && !hasCode(err, tt.code) {
+				t.Fatalf("applyMovement error = %v, want %q", err, tt.code)
+			}
+
+			stored, err := LoadInventoryLevel(l.ctx, level.InventoryID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.OnHand != tt.onHand || stored.Reserved != tt.reserved {
+				t.Errorf("level = %d on hand, %d reserved, want %d, %d", stored.OnHand, stored.Reserved, tt.onHand, tt.reserved)
+			}
+			if tt.code == "" {
+				if _, err := LoadInventoryMovement(l.ctx, "Movement1"); err != nil {
+					t.Errorf("movement not recorded: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandOffMovesStock(t *testing.T) {
+	l := newTestLedger(t)
+	l.addUser("Manufacturer1", "manufacturer", "Org1MSP")
+	l.addUser("Supplier1", "supplier", "Org2MSP")
+	factory := &Facility{FacilityID: "Facility1", OrgID: "Org1MSP", Type: "factory", Name: "Plant", Latitude: 48.1, Longitude: 11.6, RadiusMeters: 500}
+	warehouse := &Facility{FacilityID: "Facility2", OrgID: "Org2MSP", Type: "warehouse", Name: "North DC", Latitude: 52.37, Longitude: 4.89, RadiusMeters: 500, Capacity: 1}
+	l.put(factory.FacilityID, DocTypeFacility, factory)
+	l.put(warehouse.FacilityID, DocTypeFacility, warehouse)
+	l.put("Product1", DocTypeProduct, &Product{ProductID: "Product1", SKU: "Vaccine", ManufacturerID: "Manufacturer1", Status: StatusAvailable, OwnerOrgID: "Org1MSP", HolderOrgID: "Org1MSP", FacilityID: factory.FacilityID})
+	booked, err := loadInventoryLevel(l.ctx, factory, "Vaccine", "Product1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	booked.OnHand = 1
+	err = SaveInventoryLevel(l.ctx, booked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putIndex(l.ctx, productFacilityIndex, factory.FacilityID, "Product1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.stub.commit()
+
+	err = l.submit("Org1MSP", "manufacturer1", func(ctx contractapi.TransactionContextInterface) error {
+		return new(SupplyChain).toSupplier(ctx, "Product1", "Supplier1", "52.37", "4.89", warehouse.FacilityID, "")
+	})
+	if err != nil {
+		t.Fatalf("toSupplier error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		facility *Facility
+		onHand   int
+	}{{factory, 0}, {warehouse, 1}} {
+		level, err := loadInventoryLevel(l.ctx, tt.facility, "Vaccine", "Product1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level.OnHand != tt.onHand {
+			t.Errorf("%s holds %d of Product1, want %d", tt.facility.FacilityID, level.OnHand, tt.onHand)
+		}
+	}
+	for id, kind := range map[string]string{"Movement1": MovementTransferOut, "Movement2": MovementTransferIn} {
+		movement, err := LoadInventoryMovement(l.ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if movement.Kind != kind || movement.Reference != "Product1" || movement.UserID != "Manufacturer1" {
+			t.Errorf("%s = %+v, want %s of Product1", id, movement, kind)
+		}
+	}
+
+	products, units, err := facilityOccupancy(l.ctx, warehouse.FacilityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products != 1 || units != 0 {
+		t.Errorf("occupancy of %s = %d products, %d units, want the product once", warehouse.FacilityID, products, units)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- invoice ------------------------------------------
+
+// Invoice statuses. An issued invoice is either Matched or has a
+// Discrepancy, and accounts payable then approves or disputes it.
+const (
+	InvoiceStatusMatched     = "Matched"
+	InvoiceStatusDiscrepancy = "Discrepancy"
+	InvoiceStatusApproved    = "Approved"
+	InvoiceStatusDisputed    = "Disputed"
+)
+
+// ParamPriceTolerancePct is the system parameter holding how far, in percent,
+// an invoiced unit price may be from the ordered one and still match.
+const ParamPriceTolerancePct = "invoice.price_tolerance_pct"
+
+// invoiceIndex maps an order to its invoice ids.
+const invoiceIndex = "invoice~order"
+
+// InvoiceLine bills Quantity units of the order line LineNo at UnitPrice.
+type InvoiceLine struct {
+	LineNo    int    `json:"LineNo"`
+	SKU       string `json:"SKU"`
+	Quantity  int    `json:"Quantity"`
+	UnitPrice Money  `json:"UnitPrice"`
+}
+
+// Discrepancy is a difference the three-way match found between the invoice,
+// the purchase order and the goods received.
+type Discrepancy struct {
+	LineNo   int    `json:"LineNo"`
+	Field    string `json:"Field"`
+	Expected string `json:"Expected"`
+	Actual   string `json:"Actual"`
+}
+
+// Invoice is what the seller org bills the buyer org for an order.
+type Invoice struct {
+	DocType       string        `json:"DocType"`
+	InvoiceID     string        `json:"InvoiceID"`
+	OrderID       string        `json:"OrderID"`
+	SellerOrgID   string        `json:"SellerOrgID"`
+	BuyerOrgID    string        `json:"BuyerOrgID"`
+	IssuedBy      string        `json:"IssuedBy"`
+	Lines         []InvoiceLine `json:"Lines"`
+	Total         Money         `json:"Total"`
+	Status        string        `json:"Status"`
+	Discrepancies []Discrepancy `json:"Discrepancies"`
+	History       []OrderEvent  `json:"History"`
+}
+
+func (i *Invoice) record(ctx contractapi.TransactionContextInterface, action string, actorID string, reason string) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	i.History = append(i.History, OrderEvent{Action: action, ActorID: actorID, Reason: reason, Timestamp: now.String()})
+	return nil
+}
+
+// line returns the order line numbered lineNo.
+func (o *PurchaseOrder) line(lineNo int) *OrderLine {
+	for i := range o.Lines {
+		if o.Lines[i].LineNo == lineNo {
+			return &o.Lines[i]
+		}
+	}
+	return nil
+}
+
+// threeWayMatch compares every invoice line with the ordered line, its
+// received quantity not invoiced yet and its price. Each order line may only
+// appear once in lines.
+func threeWayMatch(order *PurchaseOrder, lines []InvoiceLine, tolerancePct *big.Rat) []Discrepancy {
+	discrepancies := []Discrepancy{}
+	for _, invoiced := range lines {
+		ordered := order.line(invoiced.LineNo)
+		if ordered == nil {
+			discrepancies = append(discrepancies, Discrepancy{LineNo: invoiced.LineNo, Field: "LineNo", Expected: "a line of " + order.OrderID, Actual: strconv.Itoa(invoiced.LineNo)})
+			continue
+		}
+
+		if invoiced.SKU != ordered.SKU {
+			discrepancies = append(discrepancies, Discrepancy{LineNo: invoiced.LineNo, Field: "SKU", Expected: ordered.SKU, Actual: invoiced.SKU})
+		}
+		if ordered.InvoicedQuantity+invoiced.Quantity > ordered.Quantity {
+			discrepancies = append(discrepancies, Discrepancy{LineNo: invoiced.LineNo, Field: "Quantity", Expected: fmt.Sprintf("at most %d ordered", ordered.Quantity-ordered.InvoicedQuantity), Actual: strconv.Itoa(invoiced.Quantity)})
+		}
+		uninvoiced := len(ordered.ReceivedProductIDs) - ordered.InvoicedQuantity
+		if invoiced.Quantity > uninvoiced {
+			discrepancies = append(discrepancies, Discrepancy{LineNo: invoiced.LineNo, Field: "Quantity", Expected: fmt.Sprintf("at most %d received", uninvoiced), Actual: strconv.Itoa(invoiced.Quantity)})
+		}
+		orderedPrice := ordered.UnitPrice.withCurrency(order.Currency)
+		difference := new(big.Rat).Sub(invoiced.UnitPrice.rat(), orderedPrice.rat())
+		tolerance := new(big.Rat).Mul(orderedPrice.rat(), tolerancePct)
+		tolerance.Quo(tolerance, big.NewRat(100, 1))
+		if invoiced.UnitPrice.Currency != orderedPrice.Currency || difference.Abs(difference).Cmp(tolerance) > 0 {
+			discrepancies = append(discrepancies, Discrepancy{LineNo: invoiced.LineNo, Field: "UnitPrice", Expected: orderedPrice.String(), Actual: invoiced.UnitPrice.String()})
+		}
+	}
+	return discrepancies
+}
+
+// setInvoicedQuantities adds sign times the quantities of lines to the
+// invoiced quantities of order.
+func setInvoicedQuantities(order *PurchaseOrder, lines []InvoiceLine, sign int) {
+	for _, invoiced := range lines {
+		ordered := order.line(invoiced.LineNo)
+		if ordered != nil {
+			ordered.InvoicedQuantity += sign * invoiced.Quantity
+		}
+	}
+}
+
+// ReceiveGoods records the buyer's goods receipt for products of orderID
+// that are now held by the buyer org.
+func (t *SupplyChain) ReceiveGoods(ctx contractapi.TransactionContextInterface, buyerUserID string, orderID string, productIDs []string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	buyer, err := authenticate(ctx, append([]string{buyerUserID, orderID}, productIDs...), buyerUserID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, buyer, ActionPlaceOrder, order.Status, order.BuyerOrgID)
+	if err != nil {
+		return err
+	}
+	if len(productIDs) == 0 {
+		return errValidation("at least one product must be given")
+	}
+
+	for _, productID := range productIDs {
+		product, err := LoadProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if product.OrderID != order.OrderID {
+			return errValidation("product %s was not shipped against %s", productID, orderID)
+		}
+		if product.HolderOrgID != order.BuyerOrgID {
+			return errInvalidTransition("product %s has not been delivered to %s yet", productID, order.BuyerOrgID)
+		}
+
+		received := false
+		for i := range order.Lines {
+			line := &order.Lines[i]
+			if !containsString(line.ProductIDs, productID) {
+				continue
+			}
+			if containsString(line.ReceivedProductIDs, productID) {
+				return errConflict("product %s was already received", productID)
+			}
+			line.ReceivedProductIDs = append(line.ReceivedProductIDs, productID)
+			received = true
+		}
+		if !received {
+			return errInternal("product %s is linked to %s but to none of its lines", productID, orderID)
+		}
+	}
+
+	err = order.record(ctx, "received", buyer.UserID, strconv.Itoa(len(productIDs))+" products")
+	if err != nil {
+		return err
+	}
+	return SavePurchaseOrder(ctx, order)
+}
+
+// IssueInvoice bills the buyer of orderID on behalf of the seller org. Without
+// lines the invoice covers every received unit not invoiced yet, at the
+// ordered price. The invoice is matched against the order and the goods
+// receipts right away. It returns the invoice id.
+func (t *SupplyChain) IssueInvoice(ctx contractapi.TransactionContextInterface, sellerUserID string, orderID string, lines []InvoiceLine) (string, error) {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return "", err
+	}
+
+	seller, err := authenticate(ctx, []string{sellerUserID, orderID}, sellerUserID)
+	if err != nil {
+		return "", err
+	}
+	err = authorizeOrderParty(ctx, seller, ActionIssueInvoice, order.Status, order.SellerOrgID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(lines) == 0 {
+		for _, line := range order.Lines {
+			uninvoiced := len(line.ReceivedProductIDs) - line.InvoicedQuantity
+			if uninvoiced > 0 {
+				lines = append(lines, InvoiceLine{LineNo: line.LineNo, SKU: line.SKU, Quantity: uninvoiced, UnitPrice: line.UnitPrice.withCurrency(order.Currency)})
+			}
+		}
+		if len(lines) == 0 {
+			return "", errInvalidTransition("nothing received for %s is left to invoice", orderID)
+		}
+	}
+
+	total := Money{Scale: currencyDigits[order.Currency], Currency: order.Currency}
+	seenLines := map[int]bool{}
+	for _, line := range lines {
+		// threeWayMatch checks each line against the order on its own, so
+		// two lines for one order line could each pass its quantity checks
+		if seenLines[line.LineNo] {
+			return "", errValidation("line %d is invoiced twice", line.LineNo)
+		}
+		seenLines[line.LineNo] = true
+		if line.Quantity <= 0 {
+			return "", errValidation("line %d quantity must be positive", line.LineNo)
+		}
+		err = validateMoney(line.UnitPrice, "line "+strconv.Itoa(line.LineNo)+" unit price")
+		if err != nil {
+			return "", err
+		}
+		amount, err := line.UnitPrice.times(line.Quantity)
+		if err != nil {
+			return "", err
+		}
+		// A line in another currency fails here, as totals can not mix them
+		total, err = total.plus(amount)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	tolerancePct := new(big.Rat)
+	if value := config.Parameters[ParamPriceTolerancePct]; value != "" {
+		tolerancePct, err = parseDecimal(value, maxDecimals)
+		if err != nil {
+			return "", errValidation("parameter %s must be a non-negative decimal, got %q", ParamPriceTolerancePct, value)
+		}
+	}
+
+	invoiceCounter, err := incrementCounter(ctx, "InvoiceCounterNO")
+	if err != nil {
+		return "", err
+	}
+	invoice := Invoice{
+		InvoiceID:     "Invoice" + strconv.Itoa(invoiceCounter),
+		OrderID:       order.OrderID,
+		SellerOrgID:   order.SellerOrgID,
+		BuyerOrgID:    order.BuyerOrgID,
+		IssuedBy:      seller.UserID,
+		Lines:         lines,
+		Total:         total,
+		Discrepancies: threeWayMatch(order, lines, tolerancePct),
+	}
+	invoice.Status = InvoiceStatusMatched
+	if len(invoice.Discrepancies) > 0 {
+		invoice.Status = InvoiceStatusDiscrepancy
+	}
+	err = invoice.record(ctx, "issued", seller.UserID, "")
+	if err != nil {
+		return "", err
+	}
+
+	// Invoiced units count as billed until the invoice is disputed
+	setInvoicedQuantities(order, lines, 1)
+	err = SavePurchaseOrder(ctx, order)
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveInvoice(ctx, &invoice)
+	if err != nil {
+		return "", err
+	}
+	err = putIndex(ctx, invoiceIndex, invoice.OrderID, invoice.InvoiceID)
+	if err != nil {
+		return "", err
+	}
+	return invoice.InvoiceID, nil
+}
+
+// ApproveInvoice approves invoiceID for payment on behalf of the buyer org.
+// Invoices with discrepancies can only be approved with a reason.
+func (t *SupplyChain) ApproveInvoice(ctx contractapi.TransactionContextInterface, approverID string, invoiceID string, reason string) error {
+	invoice, err := LoadInvoice(ctx, invoiceID)
+	if err != nil {
+		return err
+	}
+
+	approver, err := authenticate(ctx, []string{approverID, invoiceID, reason}, approverID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, approver, ActionApproveInvoice, invoice.Status, invoice.BuyerOrgID)
+	if err != nil {
+		return err
+	}
+
+	switch invoice.Status {
+	case InvoiceStatusMatched:
+	case InvoiceStatusDiscrepancy:
+		if len(reason) == 0 {
+			return errValidation("invoice %s has discrepancies, a reason must be given to approve it", invoiceID)
+		}
+	default:
+		return errInvalidTransition("invoice %s is %s", invoiceID, invoice.Status)
+	}
+
+	invoice.Status = InvoiceStatusApproved
+	err = invoice.record(ctx, "approved", approver.UserID, reason)
+	if err != nil {
+		return err
+	}
+	return SaveInvoice(ctx, invoice)
+}
+
+// DisputeInvoice refuses invoiceID on behalf of the buyer org. Its units can
+// be invoiced again.
+func (t *SupplyChain) DisputeInvoice(ctx contractapi.TransactionContextInterface, approverID string, invoiceID string, reason string) error {
+	invoice, err := LoadInvoice(ctx, invoiceID)
+	if err != nil {
+		return err
+	}
+
+	approver, err := authenticate(ctx, []string{approverID, invoiceID, reason}, approverID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, approver, ActionApproveInvoice, invoice.Status, invoice.BuyerOrgID)
+	if err != nil {
+		return err
+	}
+
+	if invoice.Status != InvoiceStatusMatched && invoice.Status != InvoiceStatusDiscrepancy {
+		return errInvalidTransition("invoice %s is %s", invoiceID, invoice.Status)
+	}
+	if len(reason) == 0 {
+		return errValidation("a reason must be given to dispute an invoice")
+	}
+
+	order, err := LoadPurchaseOrder(ctx, invoice.OrderID)
+	if err != nil {
+		return err
+	}
+	setInvoicedQuantities(order, invoice.Lines, -1)
+	err = SavePurchaseOrder(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	invoice.Status = InvoiceStatusDisputed
+	err = invoice.record(ctx, "disputed", approver.UserID, reason)
+	if err != nil {
+		return err
+	}
+	return SaveInvoice(ctx, invoice)
+}
+
+func (t *SupplyChain) QueryInvoice(ctx contractapi.TransactionContextInterface, invoiceID string) (*Invoice, error) {
+	return LoadInvoice(ctx, invoiceID)
+}
+
+// QueryInvoicesOf lists the invoices issued for orderID.
+func (t *SupplyChain) QueryInvoicesOf(ctx contractapi.TransactionContextInterface, orderID string) ([]*Invoice, error) {
+	ids, err := indexedIDs(ctx, invoiceIndex, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Invoice{}
+	for _, id := range ids {
+		invoice, err := LoadInvoice(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, invoice)
+	}
+	return results, nil
+}
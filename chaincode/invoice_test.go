@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestThreeWayMatch(t *testing.T) {
+	eur := func(units int64) Money {
+		return Money{Units: units, Scale: 2, Currency: "EUR"}
+	}
+	newOrder := func() *PurchaseOrder {
+		return &PurchaseOrder{
+			OrderID:  "Order1",
+			Currency: "EUR",
+			Lines: []OrderLine{
+				{LineNo: 1, SKU: "A", Quantity: 10, UnitPrice: eur(1250), ReceivedProductIDs: []string{"Product1", "Product2", "Product3", "Product4"}},
+				{LineNo: 2, SKU: "B", Quantity: 5, UnitPrice: Money{Units: 3}, ReceivedProductIDs: []string{"Product5", "Product6", "Product7", "Product8", "Product9"}, InvoicedQuantity: 3},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		lines     []InvoiceLine
+		tolerance *big.Rat
+		want      []string
+	}{
+		{"matches", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 4, UnitPrice: eur(1250)}}, new(big.Rat), []string{}},
+		{"legacy order price without currency", []InvoiceLine{{LineNo: 2, SKU: "B", Quantity: 2, UnitPrice: Money{Units: 300, Scale: 2, Currency: "EUR"}}}, new(big.Rat), []string{}},
+		{"price within tolerance", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 4, UnitPrice: eur(1262)}}, big.NewRat(1, 1), []string{}},
+		{"price beyond tolerance", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 4, UnitPrice: eur(1263)}}, big.NewRat(1, 1), []string{"UnitPrice"}},
+		{"price in another currency", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 4, UnitPrice: Money{Units: 1250, Scale: 2, Currency: "USD"}}}, new(big.Rat), []string{"UnitPrice"}},
+		{"more than received", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 5, UnitPrice: eur(1250)}}, new(big.Rat), []string{"Quantity"}},
+		{"more than ordered and received", []InvoiceLine{{LineNo: 2, SKU: "B", Quantity: 3, UnitPrice: eur(300)}}, new(big.Rat), []string{"Quantity", "Quantity"}},
+		{"wrong sku", []InvoiceLine{{LineNo: 1, SKU: "B", Quantity: 1, UnitPrice: eur(1250)}}, new(big.Rat), []string{"SKU"}},
+		{"unknown line", []InvoiceLine{{LineNo: 3, SKU: "C", Quantity: 1, UnitPrice: eur(100)}}, new(big.Rat), []string{"LineNo"}},
+		{"one discrepancy per line", []InvoiceLine{{LineNo: 1, SKU: "A", Quantity: 4, UnitPrice: eur(1300)}, {LineNo: 3, SKU: "C", Quantity: 1, UnitPrice: eur(100)}}, new(big.Rat), []string{"UnitPrice", "LineNo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := []string{}
+			for _, discrepancy := range threeWayMatch(newOrder(), tt.lines, tt.tolerance) {
+				fields = append(fields, discrepancy.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("discrepancies on %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
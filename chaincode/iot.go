@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- iot devices ------------------------------------------
+
+// Device key types.
+const (
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Device statuses.
+const (
+	DeviceStatusActive  = "Active"
+	DeviceStatusRetired = "Retired"
+)
+
+// deviceIndex maps an org to the ids of its devices.
+const deviceIndex = "device~org"
+
+// IoTDevice is a sensor registered by OrgID. PublicKey is the PEM encoded
+// PKIX public key, ECDSA or Ed25519, readings of the device are signed with.
+// AssignedTo is the product or container the device reports for, and
+// LastReadingAt the timestamp of its latest accepted reading, which later
+// readings must follow.
+type IoTDevice struct {
+	DocType       string `json:"DocType"`
+	DeviceID      string `json:"DeviceID"`
+	OrgID         string `json:"OrgID"`
+	Model         string `json:"Model"`
+	KeyType       string `json:"KeyType"`
+	PublicKey     string `json:"PublicKey"`
+	AssignedTo    string `json:"AssignedTo"`
+	Status        string `json:"Status"`
+	RegisteredBy  string `json:"RegisteredBy"`
+	LastReadingAt string `json:"LastReadingAt"`
+}
+
+// parseDevicePublicKey decodes a PEM encoded PKIX public key and returns it
+// with its key type.
+func parseDevicePublicKey(data string) (any, string, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, "", errValidation("public key must be a PEM encoded PUBLIC KEY block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", errValidation("can not parse public key: %s", err.Error())
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		return key, KeyTypeECDSA, nil
+	case ed25519.PublicKey:
+		return key, KeyTypeEd25519, nil
+	}
+	return nil, "", errValidation("public key must be ECDSA or Ed25519")
+}
+
+// readingMessage is what a device signs for reading taken for targetID:
+// the fields joined by "|", numbers in their shortest decimal form.
+func readingMessage(targetID string, reading *SensorReading) []byte {
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return []byte(strings.Join([]string{
+		targetID,
+		reading.DeviceID,
+		reading.Timestamp,
+		format(reading.Temperature),
+		format(reading.Humidity),
+		format(reading.Shock),
+	}, "|"))
+}
+
+// verifyReading checks the base64 signature on reading with the key of
+// device. ECDSA signatures are ASN.1 DER over the SHA-256 of the message,
+// Ed25519 signatures are over the message itself.
+func verifyReading(device *IoTDevice, targetID string, reading *SensorReading) error {
+	signature, err := base64.StdEncoding.DecodeString(reading.Signature)
+	if err != nil || len(signature) == 0 {
+		return errValidation("reading of %s at %s carries no valid base64 signature", reading.DeviceID, reading.Timestamp)
+	}
+	key, _, err := parseDevicePublicKey(device.PublicKey)
+	if err != nil {
+		return errInternal("stored key of %s is invalid: %s", device.DeviceID, err.Error())
+	}
+
+	message := readingMessage(targetID, reading)
+	valid := false
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		valid = ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, signature)
+	}
+	if !valid {
+		return errForbiddenRole("signature of %s on its reading at %s does not verify", reading.DeviceID, reading.Timestamp)
+	}
+	return nil
+}
+
+// verifyReadings checks that every reading comes from an active device
+// assigned to targetID, is signed by it and is newer than the device's
+// previous reading, then records the latest reading of each device so the
+// readings can not be replayed.
+func verifyReadings(ctx contractapi.TransactionContextInterface, targetID string, readings []SensorReading) error {
+	devices := map[string]*IoTDevice{}
+	for i := range readings {
+		reading := &readings[i]
+		device, ok := devices[reading.DeviceID]
+		if !ok {
+			var err error
+			device, err = LoadIoTDevice(ctx, reading.DeviceID)
+			if err != nil {
+				return err
+			}
+			if device.Status != DeviceStatusActive {
+				return errInvalidTransition("device %s is %s", device.DeviceID, device.Status)
+			}
+			if device.AssignedTo != targetID {
+				return errForbiddenRole("device %s is not assigned to %s", device.DeviceID, targetID)
+			}
+			devices[reading.DeviceID] = device
+		}
+
+		err := verifyReading(device, targetID, reading)
+		if err != nil {
+			return err
+		}
+
+		at, _ := time.Parse(time.RFC3339, reading.Timestamp)
+		if device.LastReadingAt != "" {
+			last, err := time.Parse(time.RFC3339, device.LastReadingAt)
+			if err == nil && !at.After(last) {
+				return errConflict("reading of %s at %s is not newer than its reading at %s", device.DeviceID, reading.Timestamp, device.LastReadingAt)
+			}
+		}
+		device.LastReadingAt = reading.Timestamp
+	}
+
+	for _, device := range devices {
+		err := SaveIoTDevice(ctx, device)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeDeviceAdmin authenticates adminID with the password in the
+// transient map and checks it may manage the devices of its org.
+func authorizeDeviceAdmin(ctx contractapi.TransactionContextInterface, args []string, adminID string) (*User, error) {
+	admin, err := authenticate(ctx, args, adminID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(admin)
+	if err != nil {
+		return nil, err
+	}
+	err = authorize(ctx, admin, ActionManageDevice, "")
+	if err != nil {
+		return nil, err
+	}
+	err = requireClientOrg(ctx, admin.OrgID, "manage its devices")
+	if err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+// loadOwnDevice loads deviceID and checks it belongs to the org of admin.
+func loadOwnDevice(ctx contractapi.TransactionContextInterface, admin *User, deviceID string) (*IoTDevice, error) {
+	device, err := LoadIoTDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device.OrgID != admin.OrgID {
+		return nil, errForbiddenRole("device %s is registered by %s", deviceID, device.OrgID)
+	}
+	return device, nil
+}
+
+// RegisterDevice registers a sensor of adminID's org under its DeviceID with
+// its PEM encoded public key. The admin authenticates with the password in
+// the transient map.
+func (t *SupplyChain) RegisterDevice(ctx contractapi.TransactionContextInterface, adminID string, device IoTDevice) error {
+	admin, err := authorizeDeviceAdmin(ctx, []string{adminID, device.DeviceID}, adminID)
+	if err != nil {
+		return err
+	}
+
+	if len(device.DeviceID) == 0 {
+		return errValidation("device id must be provided")
+	}
+	_, err = readState(ctx, device.DeviceID, DocTypeIoTDevice)
+	if err == nil {
+		return errConflict("%s is already registered", device.DeviceID)
+	}
+	if !hasCode(err, CodeNotFound) {
+		return err
+	}
+	_, keyType, err := parseDevicePublicKey(device.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	device.OrgID = admin.OrgID
+	device.KeyType = keyType
+	device.Status = DeviceStatusActive
+	device.RegisteredBy = admin.UserID
+	device.LastReadingAt = ""
+	err = SaveIoTDevice(ctx, &device)
+	if err != nil {
+		return err
+	}
+	return putIndex(ctx, deviceIndex, device.OrgID, device.DeviceID)
+}
+
+// AssignDevice makes deviceID report for targetID, a product or a container.
+// An empty targetID unassigns it.
+func (t *SupplyChain) AssignDevice(ctx contractapi.TransactionContextInterface, adminID string, deviceID string, targetID string) error {
+	admin, err := authorizeDeviceAdmin(ctx, []string{adminID, deviceID, targetID}, adminID)
+	if err != nil {
+		return err
+	}
+	device, err := loadOwnDevice(ctx, admin, deviceID)
+	if err != nil {
+		return err
+	}
+	if device.Status != DeviceStatusActive {
+		return errInvalidTransition("device %s is %s", deviceID, device.Status)
+	}
+
+	device.AssignedTo = targetID
+	return SaveIoTDevice(ctx, device)
+}
+
+// RetireDevice stops accepting readings from deviceID, for instance after its
+// key was compromised.
+func (t *SupplyChain) RetireDevice(ctx contractapi.TransactionContextInterface, adminID string, deviceID string) error {
+	admin, err := authorizeDeviceAdmin(ctx, []string{adminID, deviceID}, adminID)
+	if err != nil {
+		return err
+	}
+	device, err := loadOwnDevice(ctx, admin, deviceID)
+	if err != nil {
+		return err
+	}
+
+	device.Status = DeviceStatusRetired
+	device.AssignedTo = ""
+	return SaveIoTDevice(ctx, device)
+}
+
+func (t *SupplyChain) QueryDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*IoTDevice, error) {
+	return LoadIoTDevice(ctx, deviceID)
+}
+
+// QueryDevicesOf lists the devices registered by orgID.
+func (t *SupplyChain) QueryDevicesOf(ctx contractapi.TransactionContextInterface, orgID string) ([]*IoTDevice, error) {
+	ids, err := indexedIDs(ctx, deviceIndex, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*IoTDevice{}
+	for _, id := range ids {
+		device, err := LoadIoTDevice(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, device)
+	}
+	return results, nil
+}
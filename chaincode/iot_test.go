@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+)
+
+func TestReadingMessage(t *testing.T) {
+	tests := []struct {
+		reading SensorReading
+		want    string
+	}{
+		{SensorReading{DeviceID: "Sensor1", Timestamp: "2024-06-01T12:00:00Z", Temperature: 4.5, Humidity: 60, Shock: 0.25}, "Product1|Sensor1|2024-06-01T12:00:00Z|4.5|60|0.25"},
+		{SensorReading{DeviceID: "Sensor1", Timestamp: "2024-06-01T12:00:00Z", Temperature: -18, Humidity: 0.1, Shock: 0}, "Product1|Sensor1|2024-06-01T12:00:00Z|-18|0.1|0"},
+		{SensorReading{DeviceID: "Sensor1", Timestamp: "2024-06-01T12:00:00Z", Temperature: 1e21, Humidity: 100, Shock: 0.000001}, "Product1|Sensor1|2024-06-01T12:00:00Z|1000000000000000000000|100|0.000001"},
+	}
+	for _, tt := range tests {
+		if got := string(readingMessage("Product1", &tt.reading)); got != tt.want {
+			t.Errorf("readingMessage = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func encodePublicKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestParseDevicePublicKey(t *testing.T) {
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ed25519Key, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tests := []struct {
+		name    string
+		pem     string
+		keyType string
+		valid   bool
+	}{
+		{"ecdsa", encodePublicKey(t, &ecdsaKey.PublicKey), KeyTypeECDSA, true},
+		{"ed25519", encodePublicKey(t, ed25519Key), KeyTypeEd25519, true},
+		{"rsa", encodePublicKey(t, &rsaKey.PublicKey), "", false},
+		{"not PEM", "ssh-ed25519 AAAA", "", false},
+		{"wrong block", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})), "", false},
+		{"garbage", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1, 2, 3}})), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, keyType, err := parseDevicePublicKey(tt.pem)
+			if (err == nil) != tt.valid {
+				t.Fatalf("parseDevicePublicKey error = %v, want valid %v", err, tt.valid)
+			}
+			if keyType != tt.keyType {
+				t.Errorf("key type = %q, want %q", keyType, tt.keyType)
+			}
+		})
+	}
+}
+
+func TestVerifyReading(t *testing.T) {
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	ecdsaDevice := &IoTDevice{DeviceID: "Sensor1", PublicKey: encodePublicKey(t, &ecdsaKey.PublicKey)}
+	ed25519Device := &IoTDevice{DeviceID: "Sensor1", PublicKey: encodePublicKey(t, ed25519Key.Public())}
+
+	reading := SensorReading{DeviceID: "Sensor1", Timestamp: "2024-06-01T12:00:00Z", Temperature: 4.5, Humidity: 60, Shock: 0.25}
+	signECDSA := func(target string, r SensorReading) string {
+		digest := sha256.Sum256(readingMessage(target, &r))
+		signature, err := ecdsa.SignASN1(rand.Reader, ecdsaKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	signEd25519 := func(target string, r SensorReading) string {
+		signature, err := ed25519Key.Sign(nil, readingMessage(target, &r), crypto.Hash(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	warmer := reading
+	warmer.Temperature = 9
+
+	tests := []struct {
+		name      string
+		device    *IoTDevice
+		signature string
+		reading   SensorReading
+		code      ErrorCode
+	}{
+		{"ecdsa", ecdsaDevice, signECDSA("Product1", reading), reading, ""},
+		{"ed25519", ed25519Device, signEd25519("Product1", reading), reading, ""},
+		{"altered reading", ed25519Device, signEd25519("Product1", reading), warmer, CodeForbiddenRole},
+		{"signed for another target", ecdsaDevice, signECDSA("Product2", reading), reading, CodeForbiddenRole},
+		{"signed by another key", ecdsaDevice, signEd25519("Product1", reading), reading, CodeForbiddenRole},
+		{"no signature", ecdsaDevice, "", reading, CodeValidationFailed},
+		{"not base64", ecdsaDevice, "not base64!", reading, CodeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.reading
+			r.Signature = tt.signature
+			err := verifyReading(tt.device, "Product1", &r)
+			if tt.code == "" {
+				if err != nil {
+					t.Errorf("verifyReading error = %v", err)
+				}
+				return
+			}
+			if !hasCode(err, tt.code) {
+				t.Errorf("verifyReading error = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- location ------------------------------------------
+
+// locationAnomalyIndex maps an org to the products reported outside its
+// facilities.
+const locationAnomalyIndex = "anomaly~org~product"
+
+// LocationAnomalyEvent is the chaincode event emitted when a position is
+// reported outside the receiving org's facilities.
+const LocationAnomalyEvent = "LocationAnomaly"
+
+const earthRadiusMeters = 6371000
+
+// LocationAnomaly is the payload of a LocationAnomalyEvent.
+type LocationAnomaly struct {
+	ProductID  string  `json:"ProductID"`
+	OrgID      string  `json:"OrgID"`
+	FacilityID string  `json:"FacilityID"`
+	Latitude   float64 `json:"Latitude"`
+	Longitude  float64 `json:"Longitude"`
+	Date       string  `json:"Date"`
+}
+
+// UnmarshalJSON also accepts the string coordinates of positions recorded
+// before they were typed. A legacy coordinate that is not a number is flagged
+// as an anomaly instead of failing the read of the whole product.
+func (p *ProductPos) UnmarshalJSON(data []byte) error {
+	type position ProductPos
+	raw := struct {
+		*position
+		Latitude  json.RawMessage `json:"Latitude"`
+		Longitude json.RawMessage `json:"Longitude"`
+	}{position: (*position)(p)}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	latitude, latOK := legacyCoordinate(raw.Latitude)
+	longitude, lonOK := legacyCoordinate(raw.Longitude)
+	p.Latitude = latitude
+	p.Longitude = longitude
+	if (!latOK || !lonOK) && p.Anomaly == "" {
+		p.Anomaly = "recorded coordinates are not numbers"
+	}
+	return nil
+}
+
+func legacyCoordinate(raw json.RawMessage) (float64, bool) {
+	text := strings.TrimSpace(string(raw))
+	if text == "" || text == "null" {
+		return 0, true
+	}
+	if strings.HasPrefix(text, `"`) {
+		unquoted, err := strconv.Unquote(text)
+		if err != nil {
+			return 0, false
+		}
+		text = strings.TrimSpace(unquoted)
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+func validateCoordinates(latitude float64, longitude float64) error {
+	if math.IsNaN(latitude) || latitude < -90 || latitude > 90 {
+		return errValidation("latitude must be between -90 and 90, got %v", latitude)
+	}
+	if math.IsNaN(longitude) || longitude < -180 || longitude > 180 {
+		return errValidation("longitude must be between -180 and 180, got %v", longitude)
+	}
+	return nil
+}
+
+// parseCoordinates parses and range checks the coordinates passed as string
+// arguments to the legacy transactions.
+func parseCoordinates(latitude string, longitude string) (float64, float64, error) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latitude), 64)
+	if err != nil {
+		return 0, 0, errValidation("latitude %q is not a number", latitude)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(longitude), 64)
+	if err != nil {
+		return 0, 0, errValidation("longitude %q is not a number", longitude)
+	}
+	err = validateCoordinates(lat, lon)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
+
+// distanceMeters is the great-circle distance between two points.
+func distanceMeters(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// recordPosition appends the position reported as orgID receives product and
+// places the product at the facility it was received at. When facilityID is
+// given the position must lie inside that facility of orgID, otherwise inside
+// any of the org's facilities. A position outside them is kept but flagged,
+// and a LocationAnomaly event is emitted. Orgs without facilities are not
+// checked.
+func recordPosition(ctx contractapi.TransactionContextInterface, product *Product, orgID string, facilityID string, latitude string, longitude string) error {
+	lat, lon, err := parseCoordinates(latitude, longitude)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	position := ProductPos{Date: now.String(), Latitude: lat, Longitude: lon}
+
+	if facilityID != "" {
+		facility, err := LoadFacility(ctx, facilityID)
+		if err != nil {
+			return err
+		}
+		if facility.OrgID != orgID {
+			return errForbiddenRole("facility %s is not operated by %s", facilityID, orgID)
+		}
+		position.FacilityID = facility.FacilityID
+		if !facility.contains(lat, lon) {
+			position.Anomaly = "outside facility " + facility.FacilityID
+		}
+	} else {
+		ids, err := indexedIDs(ctx, facilityIndex, orgID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			facility, err := LoadFacility(ctx, id)
+			if err != nil {
+				return err
+			}
+			if facility.contains(lat, lon) {
+				position.FacilityID = facility.FacilityID
+				break
+			}
+		}
+		if len(ids) > 0 && position.FacilityID == "" {
+			position.Anomaly = "outside every facility of " + orgID
+		}
+	}
+
+	if position.Anomaly != "" {
+		err = putIndex(ctx, locationAnomalyIndex, orgID, product.ProductID)
+		if err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(LocationAnomaly{
+			ProductID:  product.ProductID,
+			OrgID:      orgID,
+			FacilityID: position.FacilityID,
+			Latitude:   lat,
+			Longitude:  lon,
+			Date:       position.Date,
+		})
+		if err != nil {
+			return errInternal("marshal error for location anomaly: %s", err.Error())
+		}
+		err = ctx.GetStub().SetEvent(LocationAnomalyEvent, payload)
+		if err != nil {
+			return errInternal("failed to emit %s event: %s", LocationAnomalyEvent, err.Error())
+		}
+	}
+
+	product.Position = append(product.Position, position)
+	return placeProduct(ctx, product, position.FacilityID)
+}
+
+// QueryLocationAnomalies lists the products that were reported outside the
+// facilities of orgID when it received them.
+func (t *SupplyChain) QueryLocationAnomalies(ctx contractapi.TransactionContextInterface, orgID string) ([]*Product, error) {
+	ids, err := indexedIDs(ctx, locationAnomalyIndex, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Product{}
+	for _, id := range ids {
+		product, err := LoadProduct(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+	}
+	return results, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestDistanceMeters(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 52.52, 13.405, 52.52, 13.405, 0},
+		{"one degree of latitude", 0, 0, 1, 0, 111194.93},
+		{"Berlin to Paris", 52.52, 13.405, 48.8566, 2.3522, 877463.33},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111194.93},
+		{"pole to pole", 90, 0, -90, 0, 20015086.80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distanceMeters(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+			if math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("distanceMeters = %.2f, want %.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCoordinates(t *testing.T) {
+	tests := []struct {
+		latitude, longitude string
+		lat, lon            float64
+		valid               bool
+	}{
+		{"52.52", "13.405", 52.52, 13.405, true},
+		{" -33.8688 ", "151.2093", -33.8688, 151.2093, true},
+		{"90", "-180", 90, -180, true},
+		{"90.1", "0", 0, 0, false},
+		{"0", "180.5", 0, 0, false},
+		{"NaN", "0", 0, 0, false},
+		{"north", "0", 0, 0, false},
+		{"", "0", 0, 0, false},
+	}
+	for _, tt := range tests {
+		lat, lon, err := parseCoordinates(tt.latitude, tt.longitude)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseCoordinates(%q, %q) error = %v, want valid %v", tt.latitude, tt.longitude, err, tt.valid)
+			continue
+		}
+		if tt.valid && (lat != tt.lat || lon != tt.lon) {
+			t.Errorf("parseCoordinates(%q, %q) = %v, %v, want %v, %v", tt.latitude, tt.longitude, lat, lon, tt.lat, tt.lon)
+		}
+	}
+}
+
+func TestProductPosLegacyCoordinates(t *testing.T) {
+	tests := []struct {
+		data    string
+		lat     float64
+		lon     float64
+		anomaly bool
+	}{
+		{`{"Latitude": 52.52, "Longitude": 13.405}`, 52.52, 13.405, false},
+		{`{"Latitude": "52.52", "Longitude": " 13.405 "}`, 52.52, 13.405, false},
+		{`{"Date": "2024-01-01"}`, 0, 0, false},
+		{`{"Latitude": "somewhere", "Longitude": "13.405"}`, 0, 13.405, true},
+	}
+	for _, tt := range tests {
+		var pos ProductPos
+		err := json.Unmarshal([]byte(tt.data), &pos)
+		if err != nil {
+			t.Errorf("Unmarshal(%s) error = %v", tt.data, err)
+			continue
+		}
+		if pos.Latitude != tt.lat || pos.Longitude != tt.lon || (pos.Anomaly != "") != tt.anomaly {
+			t.Errorf("Unmarshal(%s) = %+v, want %v, %v with anomaly %v", tt.data, pos, tt.lat, tt.lon, tt.anomaly)
+		}
+	}
+}
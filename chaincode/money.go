@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- money ------------------------------------------
+
+// currencyDigits maps the ISO 4217 codes accepted for prices to the number of
+// digits of their minor unit.
+var currencyDigits = map[string]int{
+	"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2,
+	"CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "MYR": 2, "NOK": 2,
+	"NZD": 2, "PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TRY": 2, "TWD": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+// maxDecimals bounds the fraction digits accepted when parsing decimals, such
+// as exchange rates and parameters.
+const maxDecimals = 12
+
+// Money is a fixed-point amount of Units minor units, worth Units / 10^Scale
+// of the ISO 4217 Currency. Scale is the number of digits of the currency's
+// minor unit, so 12.50 EUR is {1250, 2, "EUR"}. Being integers only, it
+// encodes to the same JSON on every endorser.
+type Money struct {
+	Units    int64  `json:"Units"`
+	Scale    int    `json:"Scale"`
+	Currency string `json:"Currency"`
+}
+
+// UnmarshalJSON also decodes the formats prices were stored in before they
+// were fixed-point: a bare number without currency, and an object with a
+// decimal Amount and a Currency. Such amounts keep the scale of their
+// decimals until migrated, see MigrateMoney.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if json.Unmarshal(data, &number) == nil {
+		legacy, err := legacyMoney(number.String(), "")
+		if err != nil {
+			return err
+		}
+		*m = legacy
+		return nil
+	}
+
+	var fields struct {
+		Units    int64        `json:"Units"`
+		Scale    int          `json:"Scale"`
+		Currency string       `json:"Currency"`
+		Amount   *json.Number `json:"Amount"`
+	}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if fields.Amount != nil {
+		legacy, err := legacyMoney(fields.Amount.String(), fields.Currency)
+		if err != nil {
+			return err
+		}
+		*m = legacy
+		return nil
+	}
+	*m = Money{Units: fields.Units, Scale: fields.Scale, Currency: fields.Currency}
+	return nil
+}
+
+// legacyMoney converts the decimal text of a float amount, at the scale of
+// its decimals, or of currency when that is known and loses nothing.
+func legacyMoney(text string, currency string) (Money, error) {
+	value, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return Money{}, errValidation("%q is not a decimal amount", text)
+	}
+	if _, known := currencyDigits[currency]; known {
+		m, err := moneyFromRat(value, currency)
+		if err == nil {
+			return m, nil
+		}
+	}
+
+	scale := 0
+	for !value.IsInt() && scale < maxDecimals {
+		value.Mul(value, big.NewRat(10, 1))
+		scale++
+	}
+	if !value.IsInt() || !value.Num().IsInt64() {
+		return Money{}, errValidation("amount %s can not be represented exactly", text)
+	}
+	return Money{Units: value.Num().Int64(), Scale: scale, Currency: currency}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// parseDecimal parses a non-negative decimal without exponent, such as
+// "1.0825", with at most maxScale fraction digits.
+func parseDecimal(text string, maxScale int) (*big.Rat, error) {
+	whole, fraction, hasPoint := strings.Cut(text, ".")
+	if whole == "" || (hasPoint && fraction == "") || strings.Trim(whole+fraction, "0123456789") != "" {
+		return nil, errValidation("%q is not a decimal number", text)
+	}
+	if len(fraction) > maxScale {
+		return nil, errValidation("%q has more than %d decimals", text, maxScale)
+	}
+	value, _ := new(big.Rat).SetString(text)
+	return value, nil
+}
+
+// roundHalfAway rounds value to an integer, halves away from zero.
+func roundHalfAway(value *big.Rat) *big.Int {
+	num := new(big.Int).Abs(value.Num())
+	quotient, remainder := new(big.Int).QuoRem(num, value.Denom(), new(big.Int))
+	if remainder.Lsh(remainder, 1).Cmp(value.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if value.Sign() < 0 {
+		quotient.Neg(quotient)
+	}
+	return quotient
+}
+
+func validateCurrency(currency string) error {
+	if _, ok := currencyDigits[currency]; !ok {
+		return errValidation("%q is not a supported ISO 4217 currency code", currency)
+	}
+	return nil
+}
+
+// parseMoney reads a decimal amount such as "12.50" in currency, refusing
+// more decimals than the currency's minor unit.
+func parseMoney(amount string, currency string) (Money, error) {
+	err := validateCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	value, err := parseDecimal(amount, currencyDigits[currency])
+	if err != nil {
+		return Money{}, err
+	}
+	return moneyFromRat(value, currency)
+}
+
+// moneyFromRat returns value in currency. It fails unless value is a whole
+// number of minor units that fits.
+func moneyFromRat(value *big.Rat, currency string) (Money, error) {
+	return exactMoney(value, currencyDigits[currency], currency)
+}
+
+// exactMoney returns value as units at scale, failing unless that is exact.
+func exactMoney(value *big.Rat, scale int, currency string) (Money, error) {
+	units := new(big.Rat).Mul(value, new(big.Rat).SetInt(pow10(scale)))
+	if !units.IsInt() {
+		digits := strings.TrimRight(strings.TrimRight(value.FloatString(maxDecimals), "0"), ".")
+		return Money{}, errValidation("%s has more than %d decimals for %s", digits, scale, currency)
+	}
+	if !units.Num().IsInt64() {
+		return Money{}, errValidation("%s %s is out of range", value.FloatString(scale), currency)
+	}
+	return Money{Units: units.Num().Int64(), Scale: scale, Currency: currency}, nil
+}
+
+// roundedMoney is moneyFromRat rounding value to the minor unit, halves away
+// from zero.
+func roundedMoney(value *big.Rat, currency string) (Money, error) {
+	scale := currencyDigits[currency]
+	units := roundHalfAway(new(big.Rat).Mul(value, new(big.Rat).SetInt(pow10(scale))))
+	if !units.IsInt64() {
+		return Money{}, errValidation("%s %s is out of range", value.FloatString(scale), currency)
+	}
+	return Money{Units: units.Int64(), Scale: scale, Currency: currency}, nil
+}
+
+// rat returns the exact value of m.
+func (m Money) rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.Units), pow10(m.Scale))
+}
+
+func (m Money) String() string {
+	return strings.TrimSpace(m.rat().FloatString(m.Scale) + " " + m.Currency)
+}
+
+// times returns m multiplied by quantity.
+func (m Money) times(quantity int) (Money, error) {
+	return exactMoney(new(big.Rat).Mul(m.rat(), big.NewRat(int64(quantity), 1)), m.Scale, m.Currency)
+}
+
+// plus returns the sum of m and other, which must be in the same currency.
+func (m Money) plus(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, errValidation("can not add %s to %s", other.Currency, m.Currency)
+	}
+	scale := m.Scale
+	if other.Scale > scale {
+		scale = other.Scale
+	}
+	return exactMoney(new(big.Rat).Add(m.rat(), other.rat()), scale, m.Currency)
+}
+
+// withCurrency returns m in currency when it was stored without one.
+func (m Money) withCurrency(currency string) Money {
+	if m.Currency == "" {
+		m.Currency = currency
+	}
+	return m
+}
+
+// validateMoney checks that m is a non-negative amount of a supported
+// currency at the scale of its minor unit.
+func validateMoney(m Money, what string) error {
+	err := validateCurrency(m.Currency)
+	if err != nil {
+		return errValidation("%s: %s", what, err.Error())
+	}
+	if m.Scale != currencyDigits[m.Currency] {
+		return errValidation("%s must have scale %d for %s, got %d", what, currencyDigits[m.Currency], m.Currency, m.Scale)
+	}
+	if m.Units < 0 {
+		return errValidation("%s can not be negative", what)
+	}
+	return nil
+}
+
+// migrateMoney rescales m to the minor unit of its currency, or of currency
+// when it was stored without one.
+func migrateMoney(m Money, currency string) (Money, error) {
+	m = m.withCurrency(currency)
+	err := validateCurrency(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return moneyFromRat(m.rat(), m.Currency)
+}
+
+// moveLegacyPrice moves the public price of product into its commercial
+// terms, salted with salt, as the first price version approved by admin. The
+// old value stays in the public history of the product key.
+func moveLegacyPrice(ctx contractapi.TransactionContextInterface, product *Product, admin *User, currency string, salt string) error {
+	if len(salt) == 0 {
+		return errValidation("%s still has a public price, a %s must be passed in the transient map to protect its terms", product.ProductID, TransientSalt)
+	}
+	price, err := legacyMoney(strconv.FormatFloat(product.LegacyPrice, 'f', -1, 64), currency)
+	if err != nil {
+		return errValidation("price of %s: %s", product.ProductID, err.Error())
+	}
+	price, err = migrateMoney(price, currency)
+	if err != nil {
+		return errValidation("price of %s: %s", product.ProductID, err.Error())
+	}
+
+	terms := &CommercialTerms{
+		ProductID: product.ProductID,
+		Price:     price,
+		SellerID:  product.ManufacturerID,
+		Salt:      salt,
+	}
+	err = recordPriceChange(ctx, product, admin, terms)
+	if err != nil {
+		return err
+	}
+	product.LegacyPrice = 0
+	return SaveProduct(ctx, product)
+}
+
+// migrateProductPrice rewrites the commercial terms of productID as
+// fixed-point and records their new hash on the product. Products that still
+// carry their price on the public record, and so have no terms yet, get it
+// moved to the terms.
+func migrateProductPrice(ctx contractapi.TransactionContextInterface, productID string, admin *User, currency string, salt string) error {
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if product.TermsHash == "" {
+		return moveLegacyPrice(ctx, product, admin, currency, salt)
+	}
+	terms, err := LoadCommercialTerms(ctx, productID)
+	if err != nil {
+		return err
+	}
+
+	terms.Price, err = migrateMoney(terms.Price, currency)
+	if err != nil {
+		return errValidation("price of %s: %s", productID, err.Error())
+	}
+	product.TermsHash, err = saveCommercialTerms(ctx, terms)
+	if err != nil {
+		return err
+	}
+	return SaveProduct(ctx, product)
+}
+
+// migrateOrderPrices rewrites the unit prices of orderID and the amounts of
+// its invoices as fixed-point. Orders placed without a currency get currency.
+func migrateOrderPrices(ctx contractapi.TransactionContextInterface, orderID string, currency string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.Currency == "" {
+		order.Currency = currency
+	}
+	for i := range order.Lines {
+		order.Lines[i].UnitPrice, err = migrateMoney(order.Lines[i].UnitPrice, order.Currency)
+		if err != nil {
+			return errValidation("line %d of %s: %s", order.Lines[i].LineNo, orderID, err.Error())
+		}
+	}
+	err = SavePurchaseOrder(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	invoiceIDs, err := indexedIDs(ctx, invoiceIndex, orderID)
+	if err != nil {
+		return err
+	}
+	for _, invoiceID := range invoiceIDs {
+		invoice, err := LoadInvoice(ctx, invoiceID)
+		if err != nil {
+			return err
+		}
+		for i := range invoice.Lines {
+			invoice.Lines[i].UnitPrice, err = migrateMoney(invoice.Lines[i].UnitPrice, order.Currency)
+			if err != nil {
+				return errValidation("line %d of %s: %s", invoice.Lines[i].LineNo, invoiceID, err.Error())
+			}
+		}
+		invoice.Total, err = migrateMoney(invoice.Total, order.Currency)
+		if err != nil {
+			return errValidation("total of %s: %s", invoiceID, err.Error())
+		}
+		err = SaveInvoice(ctx, invoice)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateMoney rewrites the prices of productIDs and orderIDs, stored as
+// floating point before amounts were fixed-point, in minor units. Amounts
+// stored without a currency are taken to be in currency. Public product
+// prices are moved to the commercial terms, salted with the salt passed in
+// the transient map. It needs a governance admin, who authenticates with the
+// password in the transient map, and must be endorsed by a peer of the
+// commercial terms collection as well as by the orgs holding the products.
+func (t *SupplyChain) MigrateMoney(ctx contractapi.TransactionContextInterface, adminID string, currency string, productIDs []string, orderIDs []string) error {
+	args := append(append([]string{adminID, currency}, productIDs...), orderIDs...)
+	admin, err := authorizeGovernor(ctx, args, adminID, "migrate_money")
+	if err != nil {
+		return err
+	}
+	err = validateCurrency(currency)
+	if err != nil {
+		return err
+	}
+	secrets, err := readOptionalSensitive(ctx, args, TransientSalt)
+	if err != nil {
+		return err
+	}
+
+	for _, productID := range productIDs {
+		err = migrateProductPrice(ctx, productID, admin, currency, secrets[TransientSalt])
+		if err != nil {
+			return err
+		}
+	}
+	for _, orderID := range orderIDs {
+		err = migrateOrderPrices(ctx, orderID, currency)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		valid    bool
+	}{
+		{"12.50", "EUR", Money{Units: 1250, Scale: 2, Currency: "EUR"}, true},
+		{"12.5", "EUR", Money{Units: 1250, Scale: 2, Currency: "EUR"}, true},
+		{"12", "EUR", Money{Units: 1200, Scale: 2, Currency: "EUR"}, true},
+		{"0.001", "KWD", Money{Units: 1, Scale: 3, Currency: "KWD"}, true},
+		{"1500", "JPY", Money{Units: 1500, Scale: 0, Currency: "JPY"}, true},
+		{"12.505", "EUR", Money{}, false},
+		{"1.5", "JPY", Money{}, false},
+		{"-1", "EUR", Money{}, false},
+		{"1e3", "EUR", Money{}, false},
+		{".5", "EUR", Money{}, false},
+		{"5.", "EUR", Money{}, false},
+		{"12.50", "XXX", Money{}, false},
+		{"92233720368547758.08", "EUR", Money{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.amount, tt.currency)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseMoney(%q, %q) error = %v, want valid %v", tt.amount, tt.currency, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMoney(%q, %q) = %#v, want %#v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestRoundedMoney(t *testing.T) {
+	tests := []struct {
+		value    *big.Rat
+		currency string
+		want     int64
+	}{
+		{big.NewRat(12345, 1000), "EUR", 1235},
+		{big.NewRat(12344, 1000), "EUR", 1234},
+		{big.NewRat(-12345, 1000), "EUR", -1235},
+		{big.NewRat(1, 3), "EUR", 33},
+		{big.NewRat(2, 3), "EUR", 67},
+		{big.NewRat(1, 2), "JPY", 1},
+		{big.NewRat(10825, 10000), "KWD", 1083},
+	}
+	for _, tt := range tests {
+		got, err := roundedMoney(tt.value, tt.currency)
+		if err != nil {
+			t.Errorf("roundedMoney(%s, %s) error = %v", tt.value, tt.currency, err)
+			continue
+		}
+		if got.Units != tt.want || got.Scale != currencyDigits[tt.currency] || got.Currency != tt.currency {
+			t.Errorf("roundedMoney(%s, %s) = %#v, want %d units", tt.value, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	price := Money{Units: 1250, Scale: 2, Currency: "EUR"}
+
+	total, err := price.times(3)
+	if err != nil || total != (Money{Units: 3750, Scale: 2, Currency: "EUR"}) {
+		t.Errorf("times(3) = %#v, %v", total, err)
+	}
+
+	sum, err := price.plus(Money{Units: 5, Scale: 1, Currency: "EUR"})
+	if err != nil || sum != (Money{Units: 1300, Scale: 2, Currency: "EUR"}) {
+		t.Errorf("plus = %#v, %v", sum, err)
+	}
+
+	// Legacy amounts keep a finer scale, which sums keep too
+	sum, err = price.plus(Money{Units: 1, Scale: 3, Currency: "EUR"})
+	if err != nil || sum != (Money{Units: 12501, Scale: 3, Currency: "EUR"}) {
+		t.Errorf("plus at a finer scale = %#v, %v", sum, err)
+	}
+
+	_, err = price.plus(Money{Units: 100, Scale: 2, Currency: "USD"})
+	if err == nil {
+		t.Error("plus mixed currencies")
+	}
+
+	if got := price.String(); got != "12.50 EUR" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (Money{Units: 3}).String(); got != "3" {
+		t.Errorf("String() without currency = %q", got)
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data  string
+		want  Money
+		valid bool
+	}{
+		{`{"Units": 1250, "Scale": 2, "Currency": "EUR"}`, Money{Units: 1250, Scale: 2, Currency: "EUR"}, true},
+		{`12.5`, Money{Units: 125, Scale: 1}, true},
+		{`100`, Money{Units: 100}, true},
+		{`0.1`, Money{Units: 1, Scale: 1}, true},
+		{`{"Amount": 12.5, "Currency": "EUR"}`, Money{Units: 1250, Scale: 2, Currency: "EUR"}, true},
+		{`{"Amount": 12.505, "Currency": "EUR"}`, Money{Units: 12505, Scale: 3, Currency: "EUR"}, true},
+		{`{"Amount": 7}`, Money{Units: 7}, true},
+		{`1e-13`, Money{}, false},
+		{`"12.50"`, Money{Units: 125, Scale: 1}, true},
+		{`"cheap"`, Money{}, false},
+	}
+	for _, tt := range tests {
+		var got Money
+		err := json.Unmarshal([]byte(tt.data), &got)
+		if (err == nil) != tt.valid {
+			t.Errorf("Unmarshal(%s) error = %v, want valid %v", tt.data, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSONRoundTrip(t *testing.T) {
+	m := Money{Units: 12050, Scale: 2, Currency: "EUR"}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Units":12050,"Scale":2,"Currency":"EUR"}` {
+		t.Errorf("Marshal = %s", data)
+	}
+	var decoded Money
+	err = json.Unmarshal(data, &decoded)
+	if err != nil || decoded != m {
+		t.Errorf("Unmarshal(%s) = %#v, %v", data, decoded, err)
+	}
+}
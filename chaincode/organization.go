@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- organization ------------------------------------------
+
+// productHolderIndex maps the org holding a product to the product ids, which
+// is the org's inventory.
+const productHolderIndex = "product~holder"
+
+// organizationIndex lists the ids of every organization.
+const organizationIndex = "organization"
+
+// Certification is a quality or compliance certificate held by an org.
+type Certification struct {
+	Name       string `json:"Name"`
+	Issuer     string `json:"Issuer"`
+	Number     string `json:"Number"`
+	ValidUntil string `json:"ValidUntil"`
+}
+
+// Organization is a company taking part in the supply chain. Every org is
+// identified by its MSP ID, which is also the OrgID of its users, so any
+// identity issued by the org's CA can act for it.
+type Organization struct {
+	DocType        string          `json:"DocType"`
+	OrgID          string          `json:"OrgID"`
+	LegalName      string          `json:"LegalName"`
+	MSPID          string          `json:"MSPID"`
+	Roles          []string        `json:"Roles"`
+	Addresses      []string        `json:"Addresses"`
+	Certifications []Certification `json:"Certifications"`
+}
+
+// requireClientOrg refuses callers whose identity was not issued by orgID.
+// Records written before products were held by orgs have no org and are not
+// restricted.
+func requireClientOrg(ctx contractapi.TransactionContextInterface, orgID string, action string) error {
+	if orgID == "" {
+		return nil
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if mspID != orgID {
+		return errForbiddenRole("only members of %s can %s", orgID, action)
+	}
+	return nil
+}
+
+// moveProduct records that product is now held by holderOrgID and owned by
+// ownerOrgID, and keeps the holder index in step.
+func moveProduct(ctx contractapi.TransactionContextInterface, product *Product, ownerOrgID string, holderOrgID string) error {
+	if product.HolderOrgID != "" {
+		err := deleteIndex(ctx, productHolderIndex, product.HolderOrgID, product.ProductID)
+		if err != nil {
+			return err
+		}
+	}
+
+	product.OwnerOrgID = ownerOrgID
+	product.HolderOrgID = holderOrgID
+	if holderOrgID == "" {
+		return nil
+	}
+	return putIndex(ctx, productHolderIndex, holderOrgID, product.ProductID)
+}
+
+// organizationIDs returns the ids of every organization taking part in the
+// supply chain.
+func organizationIDs(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	return indexedIDs(ctx, organizationIndex)
+}
+
+func (t *SupplyChain) QueryOrganization(ctx contractapi.TransactionContextInterface, orgID string) (*Organization, error) {
+	return LoadOrganization(ctx, orgID)
+}
+
+// QueryOrganizationInventory lists the products currently held by orgID.
+func (t *SupplyChain) QueryOrganizationInventory(ctx contractapi.TransactionContextInterface, orgID string) ([]*Product, error) {
+	ids, err := indexedIDs(ctx, productHolderIndex, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Product{}
+	for _, id := range ids {
+		product, err := LoadProduct(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+	}
+	return results, nil
+}
+
+// UpdateOrganization replaces the legal name, addresses and certifications of
+// orgID. Roles are part of the system configuration and can not be changed
+// here. adminID must be an admin of the org and authenticates with the
+// password in the transient map.
+func (t *SupplyChain) UpdateOrganization(ctx contractapi.TransactionContextInterface, adminID string, orgID string, legalName string, addresses []string, certifications []Certification) error {
+	admin, err := authenticate(ctx, []string{adminID, orgID, legalName}, adminID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(admin)
+	if err != nil {
+		return err
+	}
+
+	org, err := LoadOrganization(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	if admin.OrgID != org.OrgID {
+		return errForbiddenRole("only an admin of %s can update it", orgID)
+	}
+	err = authorize(ctx, admin, ActionUpdateOrganization, "")
+	if err != nil {
+		return err
+	}
+	err = requireClientOrg(ctx, org.OrgID, "update the organization")
+	if err != nil {
+		return err
+	}
+
+	if len(legalName) == 0 {
+		return errValidation("legal name must be provided")
+	}
+	for _, certification := range certifications {
+		if len(certification.Name) == 0 || len(certification.Issuer) == 0 {
+			return errValidation("every certification needs a name and an issuer")
+		}
+	}
+
+	org.LegalName = legalName
+	org.Addresses = addresses
+	org.Certifications = certifications
+	return SaveOrganization(ctx, org)
+}
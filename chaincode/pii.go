@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- personal data ------------------------------------------
+
+// UserPII is the personal data of a user. It lives in the implicit private
+// collection of the user's org and can be purged, while the public User only
+// keeps a salted hash of it.
+type UserPII struct {
+	UserID  string `json:"UserID"`
+	Name    string `json:"Name"`
+	Email   string `json:"Email"`
+	Address string `json:"Address"`
+	Salt    string `json:"Salt"`
+}
+
+// orgCollection returns the implicit private data collection of mspID, which
+// exists on every channel without being declared in collections_config.json.
+func orgCollection(mspID string) string {
+	return "_implicit_org_" + mspID
+}
+
+func piiHash(pii *UserPII) (string, []byte, error) {
+	data, err := json.Marshal(pii)
+	if err != nil {
+		return "", nil, errInternal("marshal error for personal data of %s: %s", pii.UserID, err.Error())
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
+
+// saveUserPII stores pii in the org collection of user and records its hash
+// on the public user. The caller still has to save the user.
+func saveUserPII(ctx contractapi.TransactionContextInterface, user *User, pii *UserPII) error {
+	if user.MSPID == "" {
+		return errValidation("user %s has no org to hold personal data", user.UserID)
+	}
+	if len(pii.Salt) == 0 {
+		return errValidation("personal data must include a salt")
+	}
+	pii.UserID = user.UserID
+
+	hash, data, err := piiHash(pii)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutPrivateData(orgCollection(user.MSPID), user.UserID, data)
+	if err != nil {
+		return errInternal("failed to put personal data of %s: %s", user.UserID, err.Error())
+	}
+
+	user.PIIHash = hash
+	user.PIIErased = false
+	return nil
+}
+
+// LoadUserPII reads the personal data of user. It only succeeds on peers of
+// the user's org.
+func LoadUserPII(ctx contractapi.TransactionContextInterface, user *User) (*UserPII, error) {
+	if user.PIIErased {
+		return nil, errNotFound("personal data of %s has been erased", user.UserID)
+	}
+
+	data, err := ctx.GetStub().GetPrivateData(orgCollection(user.MSPID), user.UserID)
+	if err != nil {
+		return nil, errInternal("failed to read personal data of %s: %s", user.UserID, err.Error())
+	}
+	if data == nil {
+		return nil, errNotFound("can not find personal data of user: %s", user.UserID)
+	}
+
+	pii := new(UserPII)
+	err = json.Unmarshal(data, pii)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for personal data of %s: %s", user.UserID, err.Error())
+	}
+	return pii, nil
+}
+
+// QueryUserInfo combines the public user record with its personal data.
+func (t *SupplyChain) QueryUserInfo(ctx contractapi.TransactionContextInterface, userID string) (*UserInfo, error) {
+	user, err := LoadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	pii, err := LoadUserPII(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserInfo{
+		Name:     pii.Name,
+		UserID:   user.UserID,
+		UserType: user.UserType,
+		Email:    pii.Email,
+		Address:  pii.Address,
+	}, nil
+}
+
+// EraseUserPII purges the personal data of a user from the org collection,
+// including its history on every peer. The public user record stays, so
+// products that reference the user id remain consistent. Only the user
+// itself, whatever its status, or an active admin of its org the ACL lets
+// manage users of its type can erase it. actorID authenticates with the
+// password in the transient map.
+func (t *SupplyChain) EraseUserPII(ctx contractapi.TransactionContextInterface, actorID string, userID string) error {
+	actor, err := authenticate(ctx, []string{actorID, userID}, actorID)
+	if err != nil {
+		return err
+	}
+
+	user := actor
+	if userID != actorID {
+		err = requireActive(actor)
+		if err != nil {
+			return err
+		}
+		user, err = LoadUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+	err = authorizeUserChange(ctx, actor, user)
+	if err != nil {
+		return err
+	}
+
+	if user.MSPID == "" {
+		return errValidation("user %s keeps no personal data in an org collection", userID)
+	}
+	err = requireClientOrg(ctx, user.MSPID, "erase personal data of "+userID)
+	if err != nil {
+		return err
+	}
+
+	if user.PIIErased {
+		return errConflict("personal data of %s is already erased", userID)
+	}
+
+	err = ctx.GetStub().PurgePrivateData(orgCollection(user.MSPID), user.UserID)
+	if err != nil {
+		return errInternal("failed to purge personal data of %s: %s", userID, err.Error())
+	}
+
+	user.PIIHash = ""
+	user.PIIErased = true
+	return SaveUser(ctx, user)
+}
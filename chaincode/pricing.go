@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- price history ------------------------------------------
+
+// Price record statuses. A change above the dual approval threshold stays
+// Pending until a second user approves or rejects it.
+const (
+	PriceStatusPending  = "Pending"
+	PriceStatusApproved = "Approved"
+	PriceStatusRejected = "Rejected"
+)
+
+// ParamPriceApprovalPct is the system parameter holding the price change, in
+// percent, above which a second user has to approve it. Dual approval is off
+// while it is not set.
+const ParamPriceApprovalPct = "price.dual_approval_pct"
+
+// priceRecordPrefix keys the price records of a product by version in the
+// commercial terms collection, since they carry the price.
+const priceRecordPrefix = "price~product~version"
+
+// PriceApproval is one approval of a price change: the user and the client
+// identity that submitted it.
+type PriceApproval struct {
+	UserID    string `json:"UserID"`
+	ClientID  string `json:"ClientID"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// PriceRecord is one version of the price of a product. ChangePct is the
+// change from PreviousPrice in percent, empty when the two can not be
+// compared. Terms holds the proposed terms while the record is pending.
+type PriceRecord struct {
+	ProductID     string           `json:"ProductID"`
+	Version       int              `json:"Version"`
+	Price         Money            `json:"Price"`
+	PreviousPrice *Money           `json:"PreviousPrice,omitempty"`
+	ChangePct     string           `json:"ChangePct"`
+	Status        string           `json:"Status"`
+	ProposedBy    string           `json:"ProposedBy"`
+	ApprovedBy    []PriceApproval  `json:"ApprovedBy"`
+	RejectedBy    string           `json:"RejectedBy,omitempty"`
+	Reason        string           `json:"Reason,omitempty"`
+	EffectiveDate string           `json:"EffectiveDate,omitempty"`
+	Terms         *CommercialTerms `json:"Terms,omitempty"`
+}
+
+func priceRecordKey(ctx contractapi.TransactionContextInterface, productID string, version int) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(priceRecordPrefix, []string{productID, fmt.Sprintf("%06d", version)})
+	if err != nil {
+		return "", errInternal("failed to create price record key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// LoadPriceRecord reads version of the price of productID from the commercial
+// terms collection.
+func LoadPriceRecord(ctx contractapi.TransactionContextInterface, productID string, version int) (*PriceRecord, error) {
+	key, err := priceRecordKey(ctx, productID, version)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ctx.GetStub().GetPrivateData(CommercialTermsCollection, key)
+	if err != nil {
+		return nil, errInternal("failed to read price record %s %d: %s", productID, version, err.Error())
+	}
+	if data == nil {
+		return nil, errNotFound("can not find version %d of the price of %s", version, productID)
+	}
+
+	record := new(PriceRecord)
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for price record %s %d: %s", productID, version, err.Error())
+	}
+	return record, nil
+}
+
+// SavePriceRecord writes record to the commercial terms collection.
+func SavePriceRecord(ctx contractapi.TransactionContextInterface, record *PriceRecord) error {
+	key, err := priceRecordKey(ctx, record.ProductID, record.Version)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errInternal("marshal error for price record %s %d: %s", record.ProductID, record.Version, err.Error())
+	}
+	err = ctx.GetStub().PutPrivateData(CommercialTermsCollection, key, data)
+	if err != nil {
+		return errInternal("failed to put price record %s %d: %s", record.ProductID, record.Version, err.Error())
+	}
+	return nil
+}
+
+// priceApproval records user, and the identity submitting the transaction,
+// as approving at the transaction time.
+func priceApproval(ctx contractapi.TransactionContextInterface, user *User) (PriceApproval, error) {
+	clientID, err := clientAccount(ctx)
+	if err != nil {
+		return PriceApproval{}, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return PriceApproval{}, err
+	}
+	return PriceApproval{UserID: user.UserID, ClientID: clientID, Timestamp: now.Format(time.RFC3339)}, nil
+}
+
+// priceChangePct returns how much, in percent, next differs from previous.
+// It is false when they can not be compared: a different currency or a
+// previous price of zero.
+func priceChangePct(previous Money, next Money) (*big.Rat, bool) {
+	if previous.Currency != next.Currency || previous.Units == 0 {
+		return nil, false
+	}
+	change := new(big.Rat).Sub(next.rat(), previous.rat())
+	change.Abs(change)
+	change.Mul(change, big.NewRat(100, 1))
+	return change.Quo(change, previous.rat()), true
+}
+
+// needsDualApproval reports whether a change of changePct, or an
+// incomparable change when ok is false, is above the configured threshold.
+func needsDualApproval(ctx contractapi.TransactionContextInterface, changePct *big.Rat, ok bool) (bool, error) {
+	config, err := LoadSystemConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	value := config.Parameters[ParamPriceApprovalPct]
+	if value == "" {
+		return false, nil
+	}
+	threshold, err := parseDecimal(value, maxDecimals)
+	if err != nil {
+		return false, errValidation("parameter %s must be a non-negative decimal, got %q", ParamPriceApprovalPct, value)
+	}
+	return !ok || changePct.Cmp(threshold) > 0, nil
+}
+
+// applyPriceRecord makes the terms of record the current terms of product.
+func applyPriceRecord(ctx contractapi.TransactionContextInterface, product *Product, record *PriceRecord, terms *CommercialTerms) error {
+	termsHash, err := saveCommercialTerms(ctx, terms)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	product.TermsHash = termsHash
+	record.Status = PriceStatusApproved
+	record.EffectiveDate = now.Format(time.RFC3339)
+	record.Terms = nil
+	return SavePriceRecord(ctx, record)
+}
+
+// recordPriceChange records terms as the next price version of product,
+// proposed by user. The terms take effect right away unless the change needs
+// a second approval, see ApprovePriceChange.
+func recordPriceChange(ctx contractapi.TransactionContextInterface, product *Product, user *User, terms *CommercialTerms) error {
+	record := &PriceRecord{
+		ProductID:  product.ProductID,
+		Version:    product.PriceVersion + 1,
+		Price:      terms.Price,
+		ProposedBy: user.UserID,
+		ApprovedBy: []PriceApproval{},
+	}
+
+	dual := false
+	if product.PriceVersion > 0 {
+		latest, err := LoadPriceRecord(ctx, product.ProductID, product.PriceVersion)
+		if err != nil {
+			return err
+		}
+		if latest.Status == PriceStatusPending {
+			return errConflict("version %d of the price of %s is still waiting for approval", latest.Version, product.ProductID)
+		}
+	}
+	if product.TermsHash != "" {
+		current, err := LoadCommercialTerms(ctx, product.ProductID)
+		if err != nil {
+			return err
+		}
+		if current.Price == terms.Price {
+			// Only the other terms changed, no new price version
+			product.TermsHash, err = saveCommercialTerms(ctx, terms)
+			return err
+		}
+
+		record.PreviousPrice = &current.Price
+		changePct, ok := priceChangePct(current.Price, terms.Price)
+		if ok {
+			record.ChangePct = changePct.FloatString(2)
+		}
+		dual, err = needsDualApproval(ctx, changePct, ok)
+		if err != nil {
+			return err
+		}
+	}
+
+	approval, err := priceApproval(ctx, user)
+	if err != nil {
+		return err
+	}
+	record.ApprovedBy = append(record.ApprovedBy, approval)
+	product.PriceVersion = record.Version
+
+	if dual {
+		record.Status = PriceStatusPending
+		record.Terms = terms
+		return SavePriceRecord(ctx, record)
+	}
+	return applyPriceRecord(ctx, product, record, terms)
+}
+
+// authorizePriceAuthority checks that user may set the price of product: the
+// manufacturer or a member of the org owning it, endorsed by that org.
+func authorizePriceAuthority(ctx contractapi.TransactionContextInterface, user *User, product *Product) error {
+	err := requireActive(user)
+	if err != nil {
+		return err
+	}
+	err = authorize(ctx, user, ActionUpdateProduct, product.Status)
+	if err != nil {
+		return err
+	}
+	if product.TransporterID != "" {
+		return errInvalidTransition("product sent to transporter, can not update price")
+	}
+	if user.UserID != product.ManufacturerID && (product.OwnerOrgID == "" || user.OrgID != product.OwnerOrgID) {
+		return errForbiddenRole("only the manufacturer or the owner of %s can change its price", product.ProductID)
+	}
+	return requireClientOrg(ctx, product.OwnerOrgID, "change the price of this product")
+}
+
+// decidePriceChange lets approverID, authenticated with the password in the
+// transient map, approve or reject the pending price of productID. The
+// approver must be another user, submitting with another client identity,
+// than the ones who proposed or already approved it.
+func decidePriceChange(ctx contractapi.TransactionContextInterface, approverID string, productID string, approve bool, reason string) error {
+	approver, err := authenticate(ctx, []string{approverID, productID, reason}, approverID)
+	if err != nil {
+		return err
+	}
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
+	}
+	err = authorizePriceAuthority(ctx, approver, product)
+	if err != nil {
+		return err
+	}
+
+	record, err := LoadPriceRecord(ctx, productID, product.PriceVersion)
+	if err != nil {
+		return err
+	}
+	if record.Status != PriceStatusPending {
+		return errInvalidTransition("version %d of the price of %s is %s", record.Version, productID, record.Status)
+	}
+	approval, err := priceApproval(ctx, approver)
+	if err != nil {
+		return err
+	}
+	for _, earlier := range record.ApprovedBy {
+		if earlier.UserID == approval.UserID {
+			return errForbiddenRole("%s already approved this price change, a second user has to decide", approver.UserID)
+		}
+		if earlier.ClientID == approval.ClientID {
+			return errForbiddenRole("this client identity already approved this price change as %s, a second user has to decide with their own", earlier.UserID)
+		}
+	}
+
+	if !approve {
+		record.Status = PriceStatusRejected
+		record.RejectedBy = approver.UserID
+		record.Reason = reason
+		record.Terms = nil
+		return SavePriceRecord(ctx, record)
+	}
+
+	record.ApprovedBy = append(record.ApprovedBy, approval)
+	record.Reason = reason
+	err = applyPriceRecord(ctx, product, record, record.Terms)
+	if err != nil {
+		return err
+	}
+	return SaveProduct(ctx, product)
+}
+
+// ApprovePriceChange is the second approval that puts the pending price of
+// productID into effect.
+func (t *SupplyChain) ApprovePriceChange(ctx contractapi.TransactionContextInterface, approverID string, productID string, reason string) error {
+	return decidePriceChange(ctx, approverID, productID, true, reason)
+}
+
+// RejectPriceChange discards the pending price of productID.
+func (t *SupplyChain) RejectPriceChange(ctx contractapi.TransactionContextInterface, approverID string, productID string, reason string) error {
+	if len(reason) == 0 {
+		return errValidation("a reason must be given for rejecting a price change")
+	}
+	return decidePriceChange(ctx, approverID, productID, false, reason)
+}
+
+// QueryPriceHistory lists every price version of productID, oldest first.
+// It only succeeds on peers of orgs that are members of the commercial terms
+// collection.
+func (t *SupplyChain) QueryPriceHistory(ctx contractapi.TransactionContextInterface, productID string) ([]*PriceRecord, error) {
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(CommercialTermsCollection, priceRecordPrefix, []string{productID})
+	if err != nil {
+		return nil, errInternal("failed to read price history of %s: %s", productID, err.Error())
+	}
+	defer iterator.Close()
+
+	results := []*PriceRecord{}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, errInternal("failed to read price history of %s: %s", productID, err.Error())
+		}
+		record := new(PriceRecord)
+		err = json.Unmarshal(entry.Value, record)
+		if err != nil {
+			return nil, errInternal("unmarshalling error for price record %s: %s", entry.Key, err.Error())
+		}
+		results = append(results, record)
+	}
+	return results, nil
+}
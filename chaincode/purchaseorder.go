@@ -0,0 +1,417 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- purchase order ------------------------------------------
+
+// Purchase order statuses.
+const (
+	OrderStatusCreated            = "Created"
+	OrderStatusConfirmed          = "Confirmed"
+	OrderStatusPartiallyFulfilled = "Partially fulfilled"
+	OrderStatusFulfilled          = "Fulfilled"
+	OrderStatusCancelled          = "Cancelled"
+)
+
+// orderIndex maps the buyer and the seller org to their order ids.
+const orderIndex = "order~org"
+
+// OrderLine is one line of a purchase order. FulfilledQuantity counts the
+// products linked to the line, which are listed in ProductIDs. Of those, the
+// buyer confirmed ReceivedProductIDs as received, and InvoicedQuantity were
+// invoiced, see invoice.go.
+type OrderLine struct {
+	LineNo             int      `json:"LineNo"`
+	SKU                string   `json:"SKU"`
+	Quantity           int      `json:"Quantity"`
+	UnitPrice          Money    `json:"UnitPrice"`
+	FulfilledQuantity  int      `json:"FulfilledQuantity"`
+	ProductIDs         []string `json:"ProductIDs"`
+	ReceivedProductIDs []string `json:"ReceivedProductIDs"`
+	InvoicedQuantity   int      `json:"InvoicedQuantity"`
+}
+
+// OrderEvent is one entry of a purchase order's audit trail.
+type OrderEvent struct {
+	Action    string `json:"Action"`
+	ActorID   string `json:"ActorID"`
+	Reason    string `json:"Reason"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// PurchaseOrder is an order placed by BuyerID, of BuyerOrgID, with the
+// SellerOrgID. Unit prices are in Currency. Amending an order bumps its
+// Revision and makes the seller confirm it again.
+type PurchaseOrder struct {
+	DocType       string       `json:"DocType"`
+	OrderID       string       `json:"OrderID"`
+	BuyerID       string       `json:"BuyerID"`
+	BuyerOrgID    string       `json:"BuyerOrgID"`
+	SellerOrgID   string       `json:"SellerOrgID"`
+	Lines         []OrderLine  `json:"Lines"`
+	Currency      string       `json:"Currency"`
+	DeliveryTerms string       `json:"DeliveryTerms"`
+	RequestedDate string       `json:"RequestedDate"`
+	Status        string       `json:"Status"`
+	Revision      int          `json:"Revision"`
+	History       []OrderEvent `json:"History"`
+}
+
+// validateOrderLines checks the lines, priced in currency, and numbers them
+// from 1.
+func validateOrderLines(lines []OrderLine, currency string) error {
+	if len(lines) == 0 {
+		return errValidation("a purchase order needs at least one line")
+	}
+	for i := range lines {
+		line := &lines[i]
+		if len(line.SKU) == 0 {
+			return errValidation("line %d needs a sku", i+1)
+		}
+		if line.Quantity <= 0 {
+			return errValidation("line %d quantity must be positive", i+1)
+		}
+		if line.UnitPrice.Currency != currency {
+			return errValidation("line %d is priced in %s, not the order currency %s", i+1, line.UnitPrice.Currency, currency)
+		}
+		err := validateMoney(line.UnitPrice, "line "+strconv.Itoa(i+1)+" unit price")
+		if err != nil {
+			return err
+		}
+		line.LineNo = i + 1
+		line.FulfilledQuantity = 0
+		line.ProductIDs = []string{}
+		line.ReceivedProductIDs = []string{}
+		line.InvoicedQuantity = 0
+	}
+	return nil
+}
+
+func validateRequestedDate(requestedDate string) error {
+	_, err := time.Parse("2006-01-02", requestedDate)
+	if err != nil {
+		return errValidation("requested date must be a YYYY-MM-DD date: %s", err.Error())
+	}
+	return nil
+}
+
+// fulfilled reports whether any product was linked to the order yet.
+func (o *PurchaseOrder) fulfilled() bool {
+	for _, line := range o.Lines {
+		if line.FulfilledQuantity > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends an audit trail entry at the transaction time.
+func (o *PurchaseOrder) record(ctx contractapi.TransactionContextInterface, action string, actorID string, reason string) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	o.History = append(o.History, OrderEvent{Action: action, ActorID: actorID, Reason: reason, Timestamp: now.String()})
+	return nil
+}
+
+// authorizeOrderParty checks that the ACL allows user action on an order in
+// status and that the user acts for orgID.
+func authorizeOrderParty(ctx contractapi.TransactionContextInterface, user *User, action string, status string, orgID string) error {
+	err := requireActive(user)
+	if err != nil {
+		return err
+	}
+	err = authorize(ctx, user, action, status)
+	if err != nil {
+		return err
+	}
+	if user.OrgID != orgID {
+		return errForbiddenRole("only members of %s can %s this order", orgID, action)
+	}
+	return requireClientOrg(ctx, orgID, action+" this order")
+}
+
+// CreatePurchaseOrder places an order with sellerOrgID for lines, priced in
+// the ISO 4217 currency, to be delivered under deliveryTerms by
+// requestedDate (YYYY-MM-DD). The buyer authenticates with the password in
+// the transient map. It returns the order id.
+func (t *SupplyChain) CreatePurchaseOrder(ctx contractapi.TransactionContextInterface, buyerID string, sellerOrgID string, lines []OrderLine, currency string, deliveryTerms string, requestedDate string) (string, error) {
+	buyer, err := authenticate(ctx, []string{buyerID, sellerOrgID, currency, deliveryTerms, requestedDate}, buyerID)
+	if err != nil {
+		return "", err
+	}
+	err = authorizeOrderParty(ctx, buyer, ActionPlaceOrder, OrderStatusCreated, buyer.OrgID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = LoadOrganization(ctx, sellerOrgID)
+	if err != nil {
+		return "", err
+	}
+	if sellerOrgID == buyer.OrgID {
+		return "", errValidation("can not order from your own org")
+	}
+	err = validateOrderLines(lines, currency)
+	if err != nil {
+		return "", err
+	}
+	err = validateRequestedDate(requestedDate)
+	if err != nil {
+		return "", err
+	}
+
+	orderCounter, err := incrementCounter(ctx, "OrderCounterNO")
+	if err != nil {
+		return "", err
+	}
+
+	order := PurchaseOrder{
+		OrderID:       "Order" + strconv.Itoa(orderCounter),
+		BuyerID:       buyer.UserID,
+		BuyerOrgID:    buyer.OrgID,
+		SellerOrgID:   sellerOrgID,
+		Lines:         lines,
+		Currency:      currency,
+		DeliveryTerms: deliveryTerms,
+		RequestedDate: requestedDate,
+		Status:        OrderStatusCreated,
+		Revision:      1,
+	}
+	err = order.record(ctx, "created", buyer.UserID, "")
+	if err != nil {
+		return "", err
+	}
+
+	err = SavePurchaseOrder(ctx, &order)
+	if err != nil {
+		return "", err
+	}
+	err = putIndex(ctx, orderIndex, order.BuyerOrgID, order.OrderID)
+	if err != nil {
+		return "", err
+	}
+	err = putIndex(ctx, orderIndex, order.SellerOrgID, order.OrderID)
+	if err != nil {
+		return "", err
+	}
+	return order.OrderID, nil
+}
+
+// ConfirmPurchaseOrder accepts the current revision of orderID on behalf of
+// the seller org.
+func (t *SupplyChain) ConfirmPurchaseOrder(ctx contractapi.TransactionContextInterface, sellerUserID string, orderID string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	seller, err := authenticate(ctx, []string{sellerUserID, orderID}, sellerUserID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, seller, ActionFulfillOrder, order.Status, order.SellerOrgID)
+	if err != nil {
+		return err
+	}
+
+	if order.Status != OrderStatusCreated {
+		return errInvalidTransition("order %s is %s, only created orders can be confirmed", orderID, order.Status)
+	}
+
+	order.Status = OrderStatusConfirmed
+	err = order.record(ctx, "confirmed", seller.UserID, "revision "+strconv.Itoa(order.Revision))
+	if err != nil {
+		return err
+	}
+	return SavePurchaseOrder(ctx, order)
+}
+
+// AmendPurchaseOrder replaces the lines, delivery terms and requested date of
+// orderID. The currency stays the one the order was placed in. Only orders
+// nothing was delivered for yet can be amended, and the seller has to
+// confirm the new revision.
+func (t *SupplyChain) AmendPurchaseOrder(ctx contractapi.TransactionContextInterface, buyerID string, orderID string, lines []OrderLine, deliveryTerms string, requestedDate string, reason string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	buyer, err := authenticate(ctx, []string{buyerID, orderID, deliveryTerms, requestedDate, reason}, buyerID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, buyer, ActionPlaceOrder, order.Status, order.BuyerOrgID)
+	if err != nil {
+		return err
+	}
+
+	if order.Status != OrderStatusCreated && order.Status != OrderStatusConfirmed {
+		return errInvalidTransition("order %s is %s and can no longer be amended", orderID, order.Status)
+	}
+	err = validateOrderLines(lines, order.Currency)
+	if err != nil {
+		return err
+	}
+	err = validateRequestedDate(requestedDate)
+	if err != nil {
+		return err
+	}
+
+	order.Lines = lines
+	order.DeliveryTerms = deliveryTerms
+	order.RequestedDate = requestedDate
+	order.Revision++
+	order.Status = OrderStatusCreated
+	err = order.record(ctx, "amended", buyer.UserID, reason)
+	if err != nil {
+		return err
+	}
+	return SavePurchaseOrder(ctx, order)
+}
+
+// CancelPurchaseOrder cancels orderID on behalf of the buyer or the seller
+// org, as long as nothing was delivered for it.
+func (t *SupplyChain) CancelPurchaseOrder(ctx contractapi.TransactionContextInterface, actorID string, orderID string, reason string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	actor, err := authenticate(ctx, []string{actorID, orderID, reason}, actorID)
+	if err != nil {
+		return err
+	}
+	action, orgID := ActionPlaceOrder, order.BuyerOrgID
+	if actor.OrgID == order.SellerOrgID {
+		action, orgID = ActionFulfillOrder, order.SellerOrgID
+	}
+	err = authorizeOrderParty(ctx, actor, action, order.Status, orgID)
+	if err != nil {
+		return err
+	}
+
+	if len(reason) == 0 {
+		return errValidation("a reason must be given to cancel an order")
+	}
+	if order.Status == OrderStatusCancelled || order.fulfilled() {
+		return errInvalidTransition("order %s is %s and can no longer be cancelled", orderID, order.Status)
+	}
+
+	order.Status = OrderStatusCancelled
+	err = order.record(ctx, "cancelled", actor.UserID, reason)
+	if err != nil {
+		return err
+	}
+	return SavePurchaseOrder(ctx, order)
+}
+
+// FulfillPurchaseOrder links the products the seller ships against orderID.
+// Each product is counted against the first line of its SKU that is not
+// fulfilled yet, and gets OrderID set. A product may be listed only once.
+func (t *SupplyChain) FulfillPurchaseOrder(ctx contractapi.TransactionContextInterface, sellerUserID string, orderID string, productIDs []string) error {
+	order, err := LoadPurchaseOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	seller, err := authenticate(ctx, append([]string{sellerUserID, orderID}, productIDs...), sellerUserID)
+	if err != nil {
+		return err
+	}
+	err = authorizeOrderParty(ctx, seller, ActionFulfillOrder, order.Status, order.SellerOrgID)
+	if err != nil {
+		return err
+	}
+
+	if order.Status != OrderStatusConfirmed && order.Status != OrderStatusPartiallyFulfilled {
+		return errInvalidTransition("order %s is %s, only confirmed orders can be fulfilled", orderID, order.Status)
+	}
+	if len(productIDs) == 0 {
+		return errValidation("at least one product must be given")
+	}
+
+	// A transaction does not read its own writes, so a product listed twice
+	// would still look unlinked the second time
+	seenProducts := map[string]bool{}
+	for _, productID := range productIDs {
+		if seenProducts[productID] {
+			return errValidation("product %s is listed twice", productID)
+		}
+		seenProducts[productID] = true
+
+		product, err := LoadProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if product.OrderID != "" {
+			return errConflict("product %s is already linked to %s", productID, product.OrderID)
+		}
+		if product.OwnerOrgID != order.SellerOrgID {
+			return errForbiddenRole("product %s is not owned by %s", productID, order.SellerOrgID)
+		}
+
+		line := order.openLine(product.SKU)
+		if line == nil {
+			return errValidation("order %s has no open line for sku %s", orderID, product.SKU)
+		}
+		line.FulfilledQuantity++
+		line.ProductIDs = append(line.ProductIDs, product.ProductID)
+
+		product.OrderID = order.OrderID
+		err = SaveProduct(ctx, product)
+		if err != nil {
+			return err
+		}
+	}
+
+	order.Status = OrderStatusFulfilled
+	for _, line := range order.Lines {
+		if line.FulfilledQuantity < line.Quantity {
+			order.Status = OrderStatusPartiallyFulfilled
+		}
+	}
+	err = order.record(ctx, "fulfilled", seller.UserID, strconv.Itoa(len(productIDs))+" products")
+	if err != nil {
+		return err
+	}
+	return SavePurchaseOrder(ctx, order)
+}
+
+// openLine returns the first line of sku that still waits for products.
+func (o *PurchaseOrder) openLine(sku string) *OrderLine {
+	for i := range o.Lines {
+		if o.Lines[i].SKU == sku && o.Lines[i].FulfilledQuantity < o.Lines[i].Quantity {
+			return &o.Lines[i]
+		}
+	}
+	return nil
+}
+
+func (t *SupplyChain) QueryPurchaseOrder(ctx contractapi.TransactionContextInterface, orderID string) (*PurchaseOrder, error) {
+	return LoadPurchaseOrder(ctx, orderID)
+}
+
+// QueryPurchaseOrdersOf lists the orders orgID placed or received.
+func (t *SupplyChain) QueryPurchaseOrdersOf(ctx contractapi.TransactionContextInterface, orgID string) ([]*PurchaseOrder, error) {
+	ids, err := indexedIDs(ctx, orderIndex, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*PurchaseOrder{}
+	for _, id := range ids {
+		order, err := LoadPurchaseOrder(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, order)
+	}
+	return results, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- registration ------------------------------------------
+
+// Registration statuses.
+const (
+	RegistrationPending  = "Pending"
+	RegistrationApproved = "Approved"
+	RegistrationRejected = "Rejected"
+)
+
+// registrationIndex maps status and user type to registration ids.
+const registrationIndex = "registration~status~type"
+
+// registrableRoles are the user types that need admin approval. Which admins
+// may approve them is decided by the ACL.
+var registrableRoles = map[string]bool{
+	"manufacturer": true,
+	"supplier":     true,
+	"transporter":  true,
+}
+
+// RegistrationEvent is one entry of a registration's audit trail.
+type RegistrationEvent struct {
+	Action    string `json:"Action"`
+	ActorID   string `json:"ActorID"`
+	Reason    string `json:"Reason"`
+	Timestamp string `json:"Timestamp"`
+}
+
+// Registration is an applicant's request to join as a manufacturer, supplier
+// or transporter. The applicant's user id is reserved up front so that the
+// personal data and password can already be stored in the org collection;
+// the user record itself is only written on approval. Applicant carries no
+// credentials, except on registrations filed before passwords were kept in
+// the org collection.
+type Registration struct {
+	DocType           string              `json:"DocType"`
+	RegistrationID    string              `json:"RegistrationID"`
+	Applicant         User                `json:"Applicant"`
+	KYCDocumentHashes []string            `json:"KYCDocumentHashes"`
+	Status            string              `json:"Status"`
+	History           []RegistrationEvent `json:"History"`
+}
+
+func validateKYCHashes(hashes []string) error {
+	if len(hashes) == 0 {
+		return errValidation("at least one KYC document hash must be provided")
+	}
+	for _, hash := range hashes {
+		decoded, err := hex.DecodeString(hash)
+		if err != nil || len(decoded) != 32 {
+			return errValidation("KYC document hash %q is not a hex encoded SHA-256", hash)
+		}
+	}
+	return nil
+}
+
+// RequestRegistration files a request to join as userType with the hashes of
+// the KYC documents handed to the org admin off-chain. Name, email, address,
+// password and salt are read from the transient map. It returns the
+// registration id.
+func (t *SupplyChain) RequestRegistration(ctx contractapi.TransactionContextInterface, userType string, kycDocumentHashes []string) (string, error) {
+	if !registrableRoles[userType] {
+		return "", errValidation("can not register as %q, expected manufacturer, supplier or transporter", userType)
+	}
+
+	err := validateKYCHashes(kycDocumentHashes)
+	if err != nil {
+		return "", err
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = requireRoleAllowed(ctx, mspID, userType)
+	if err != nil {
+		return "", err
+	}
+
+	args := append([]string{userType}, kycDocumentHashes...)
+	user, pii, err := newUserFromTransient(ctx, args, userType)
+	if err != nil {
+		return "", err
+	}
+
+	err = saveUserPII(ctx, user, pii)
+	if err != nil {
+		return "", err
+	}
+
+	timestamp, err := t.GetTxTimestamp(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	registrationCounter, err := incrementCounter(ctx, "RegistrationCounterNO")
+	if err != nil {
+		return "", err
+	}
+
+	registration := Registration{
+		RegistrationID:    "Registration" + strconv.Itoa(registrationCounter),
+		Applicant:         *user,
+		KYCDocumentHashes: kycDocumentHashes,
+		Status:            RegistrationPending,
+		History: []RegistrationEvent{
+			{Action: "Requested", ActorID: user.UserID, Timestamp: timestamp},
+		},
+	}
+
+	err = SaveRegistration(ctx, &registration)
+	if err != nil {
+		return "", err
+	}
+
+	err = putIndex(ctx, registrationIndex, registration.Status, userType, registration.RegistrationID)
+	if err != nil {
+		return "", err
+	}
+	return registration.RegistrationID, nil
+}
+
+// decideRegistration moves a pending registration to status on behalf of an
+// admin of the applicant's org responsible for the requested role. The admin
+// authenticates with the password in the transient map.
+func (t *SupplyChain) decideRegistration(ctx contractapi.TransactionContextInterface, adminID string, registrationID string, reason string, status string) (*Registration, error) {
+	admin, err := authenticate(ctx, []string{adminID, registrationID, reason}, adminID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(admin)
+	if err != nil {
+		return nil, err
+	}
+
+	registration, err := LoadRegistration(ctx, registrationID)
+	if err != nil {
+		return nil, err
+	}
+
+	applicant := &registration.Applicant
+	if !sameOrg(admin, applicant) {
+		return nil, errForbiddenRole("only an admin of %s can decide on %s", applicant.OrgID, registrationID)
+	}
+	err = authorize(ctx, admin, ActionDecideRegistration, applicant.UserType)
+	if err != nil {
+		return nil, err
+	}
+
+	if registration.Status != RegistrationPending {
+		return nil, errInvalidTransition("registration %s is already %s", registrationID, registration.Status)
+	}
+
+	timestamp, err := t.GetTxTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = deleteIndex(ctx, registrationIndex, registration.Status, applicant.UserType, registrationID)
+	if err != nil {
+		return nil, err
+	}
+
+	registration.Status = status
+	registration.History = append(registration.History, RegistrationEvent{
+		Action:    status,
+		ActorID:   admin.UserID,
+		Reason:    reason,
+		Timestamp: timestamp,
+	})
+
+	err = SaveRegistration(ctx, registration)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putIndex(ctx, registrationIndex, registration.Status, applicant.UserType, registrationID)
+	if err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+// ApproveRegistration creates the applicant's user. Its password is the one
+// stored in the org collection when the registration was filed.
+func (t *SupplyChain) ApproveRegistration(ctx contractapi.TransactionContextInterface, adminID string, registrationID string, reason string) error {
+	registration, err := t.decideRegistration(ctx, adminID, registrationID, reason, RegistrationApproved)
+	if err != nil {
+		return err
+	}
+
+	applicant := registration.Applicant
+	exists, err := UserExists(ctx, applicant.UserID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errConflict("user %s already exists", applicant.UserID)
+	}
+
+	if storesCredential(&applicant) {
+		key, err := credentialKey(ctx, applicant.UserID)
+		if err != nil {
+			return err
+		}
+		stored, err := ctx.GetStub().GetPrivateDataHash(orgCollection(applicant.MSPID), key)
+		if err != nil {
+			return errInternal("failed to read credentials of %s: %s", applicant.UserID, err.Error())
+		}
+		if stored == nil {
+			return errInvalidTransition("applicant %s has no password, it must register again", applicant.UserID)
+		}
+	}
+
+	return saveNewUser(ctx, &applicant)
+}
+
+// RejectRegistration purges the applicant's personal data and password
+// verifier, which were only kept for the admin's review.
+func (t *SupplyChain) RejectRegistration(ctx contractapi.TransactionContextInterface, adminID string, registrationID string, reason string) error {
+	if len(reason) == 0 {
+		return errValidation("a reason must be given when rejecting a registration")
+	}
+
+	registration, err := t.decideRegistration(ctx, adminID, registrationID, reason, RegistrationRejected)
+	if err != nil {
+		return err
+	}
+
+	applicant := registration.Applicant
+	err = ctx.GetStub().PurgePrivateData(orgCollection(applicant.MSPID), applicant.UserID)
+	if err != nil {
+		return errInternal("failed to purge personal data of %s: %s", applicant.UserID, err.Error())
+	}
+	if storesCredential(&applicant) {
+		return purgePassword(ctx, &applicant)
+	}
+	return nil
+}
+
+// withoutCredentials hides from query results the password hash and salt
+// that registrations filed before passwords were kept in the org collection
+// still carry.
+func withoutCredentials(registration *Registration) *Registration {
+	registration.Applicant.Password = ""
+	registration.Applicant.PasswordHash = ""
+	registration.Applicant.PasswordSalt = ""
+	return registration
+}
+
+func (t *SupplyChain) QueryRegistration(ctx contractapi.TransactionContextInterface, registrationID string) (*Registration, error) {
+	registration, err := LoadRegistration(ctx, registrationID)
+	if err != nil {
+		return nil, err
+	}
+	return withoutCredentials(registration), nil
+}
+
+// QueryPendingRegistrations lists the registrations awaiting a decision,
+// restricted to userType unless it is empty.
+func (t *SupplyChain) QueryPendingRegistrations(ctx contractapi.TransactionContextInterface, userType string) ([]*Registration, error) {
+	attributes := []string{RegistrationPending}
+	if userType != "" {
+		attributes = append(attributes, userType)
+	}
+
+	ids, err := indexedIDs(ctx, registrationIndex, attributes...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Registration{}
+	for _, id := range ids {
+		registration, err := LoadRegistration(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, withoutCredentials(registration))
+	}
+	return results, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestRegistrationKeepsNoCredentials(t *testing.T) {
+	t.Setenv("CORE_PEER_LOCALMSPID", "Org1MSP")
+	l := newTestLedger(t)
+	l.put(SystemConfigKey, "system config", &SystemConfig{DocType: "systemConfig", ConfigID: SystemConfigKey, Roles: []string{"supplier"}})
+	err := SaveOrganization(l.ctx, &Organization{OrgID: "Org1MSP", MSPID: "Org1MSP", Roles: []string{"supplier"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.stub.commit()
+	admin := l.addUser("Admin1", "admin", "Org1MSP")
+	admin.AdminRole = "supplier"
+	l.put(admin.UserID, DocTypeUser, admin)
+
+	hash := strings.Repeat("ab", 32)
+	for key, value := range map[string]string{TransientName: "Jane", TransientEmail: "jane@example.com", TransientAddress: "Main Street 1", TransientSalt: "pii salt", TransientPasswordSalt: "0123456789abcdef"} {
+		l.stub.transient[key] = []byte(value)
+	}
+	var registrationID string
+	err = l.submit("Org1MSP", "Passw0rd!", func(ctx contractapi.TransactionContextInterface) error {
+		registrationID, err = new(SupplyChain).RequestRegistration(ctx, "supplier", []string{hash})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RequestRegistration error = %v", err)
+	}
+	if stored := string(l.stub.state[registrationID]); strings.Contains(stored, "Password") {
+		t.Errorf("registration stores credentials: %s", stored)
+	}
+
+	err = l.submit("Org1MSP", "admin1", func(ctx contractapi.TransactionContextInterface) error {
+		return new(SupplyChain).ApproveRegistration(ctx, "Admin1", registrationID, "")
+	})
+	if err != nil {
+		t.Fatalf("ApproveRegistration error = %v", err)
+	}
+	registration, err := LoadRegistration(l.ctx, registrationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applicantID := registration.Applicant.UserID
+	if stored := string(l.stub.state[applicantID]); strings.Contains(stored, "Password") {
+		t.Errorf("user stores credentials: %s", stored)
+	}
+
+	l.stub.transient[TransientPassword] = []byte("Passw0rd!")
+	_, err = authenticate(l.ctx, []string{applicantID}, applicantID)
+	if err != nil {
+		t.Errorf("authenticate approved user error = %v", err)
+	}
+}
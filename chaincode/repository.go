@@ -0,0 +1,721 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- repository ------------------------------------------
+
+// Document types stored alongside every record so that a key holding a
+// different kind of asset is rejected instead of silently decoded.
+const (
+	DocTypeUser              = "user"
+	DocTypeProduct           = "product"
+	DocTypeRegistration      = "registration"
+	DocTypeOrganization      = "organization"
+	DocTypeDelegation        = "delegation"
+	DocTypeProposal          = "proposal"
+	DocTypeFacility          = "facility"
+	DocTypeInventoryLevel    = "inventoryLevel"
+	DocTypeInventoryMovement = "inventoryMovement"
+	DocTypeInventoryTransfer = "inventoryTransfer"
+	DocTypePurchaseOrder     = "purchaseOrder"
+	DocTypeInvoice           = "invoice"
+	DocTypeEscrow            = "escrow"
+	DocTypeFXRate            = "fxRate"
+	DocTypeTelemetryRange    = "telemetryRange"
+	DocTypeTelemetryBatch    = "telemetryBatch"
+	DocTypeIoTDevice         = "iotDevice"
+	DocTypeInspection        = "inspection"
+)
+
+// readState returns the raw bytes stored under key, or a NOT_FOUND error when
+// nothing is stored there.
+func readState(ctx contractapi.TransactionContextInterface, key string, docType string) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errValidation("%s id must be provided", docType)
+	}
+
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, errInternal("failed to read %s %s from world state: %s", docType, key, err.Error())
+	}
+	if data == nil {
+		return nil, errNotFound("can not find %s: %s", docType, key)
+	}
+	return data, nil
+}
+
+// writeState marshals value and stores it under key.
+func writeState(ctx contractapi.TransactionContextInterface, key string, docType string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errInternal("marshal error for %s %s: %s", docType, key, err.Error())
+	}
+
+	err = ctx.GetStub().PutState(key, data)
+	if err != nil {
+		return errInternal("failed to put %s %s to world state: %s", docType, key, err.Error())
+	}
+	return nil
+}
+
+// checkDocType verifies that a decoded record is of the expected type and
+// really belongs to the key it was read from.
+func checkDocType(key string, wantType string, gotType string, gotID string) error {
+	if gotType != "" && gotType != wantType {
+		return errConflict("record %s is a %s, not a %s", key, gotType, wantType)
+	}
+	if gotID != key {
+		return errConflict("record %s is not a valid %s", key, wantType)
+	}
+	return nil
+}
+
+func decodeUser(key string, data []byte) (*User, error) {
+	user := new(User)
+	err := json.Unmarshal(data, user)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for user %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeUser, user.DocType, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func decodeProduct(key string, data []byte) (*Product, error) {
+	product := new(Product)
+	err := json.Unmarshal(data, product)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for product %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeProduct, product.DocType, product.ProductID)
+	if err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+func decodeRegistration(key string, data []byte) (*Registration, error) {
+	registration := new(Registration)
+	err := json.Unmarshal(data, registration)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for registration %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeRegistration, registration.DocType, registration.RegistrationID)
+	if err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+func decodeOrganization(key string, data []byte) (*Organization, error) {
+	org := new(Organization)
+	err := json.Unmarshal(data, org)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for organization %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeOrganization, org.DocType, org.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func decodeDelegation(key string, data []byte) (*Delegation, error) {
+	delegation := new(Delegation)
+	err := json.Unmarshal(data, delegation)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for delegation %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeDelegation, delegation.DocType, delegation.DelegationID)
+	if err != nil {
+		return nil, err
+	}
+	return delegation, nil
+}
+
+func decodeProposal(key string, data []byte) (*Proposal, error) {
+	proposal := new(Proposal)
+	err := json.Unmarshal(data, proposal)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for proposal %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeProposal, proposal.DocType, proposal.ProposalID)
+	if err != nil {
+		return nil, err
+	}
+	return proposal, nil
+}
+
+func decodeFacility(key string, data []byte) (*Facility, error) {
+	facility := new(Facility)
+	err := json.Unmarshal(data, facility)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for facility %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeFacility, facility.DocType, facility.FacilityID)
+	if err != nil {
+		return nil, err
+	}
+	return facility, nil
+}
+
+func decodeInventoryLevel(key string, data []byte) (*InventoryLevel, error) {
+	level := new(InventoryLevel)
+	err := json.Unmarshal(data, level)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for inventory level %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeInventoryLevel, level.DocType, level.InventoryID)
+	if err != nil {
+		return nil, err
+	}
+	return level, nil
+}
+
+func decodeInventoryMovement(key string, data []byte) (*InventoryMovement, error) {
+	movement := new(InventoryMovement)
+	err := json.Unmarshal(data, movement)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for inventory movement %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeInventoryMovement, movement.DocType, movement.MovementID)
+	if err != nil {
+		return nil, err
+	}
+	return movement, nil
+}
+
+func decodeInventoryTransfer(key string, data []byte) (*InventoryTransfer, error) {
+	transfer := new(InventoryTransfer)
+	err := json.Unmarshal(data, transfer)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for inventory transfer %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeInventoryTransfer, transfer.DocType, transfer.TransferID)
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func decodePurchaseOrder(key string, data []byte) (*PurchaseOrder, error) {
+	order := new(PurchaseOrder)
+	err := json.Unmarshal(data, order)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for purchase order %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypePurchaseOrder, order.DocType, order.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func decodeInvoice(key string, data []byte) (*Invoice, error) {
+	invoice := new(Invoice)
+	err := json.Unmarshal(data, invoice)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for invoice %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeInvoice, invoice.DocType, invoice.InvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+func decodeEscrow(key string, data []byte) (*Escrow, error) {
+	escrow := new(Escrow)
+	err := json.Unmarshal(data, escrow)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for escrow %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeEscrow, escrow.DocType, escrow.EscrowID)
+	if err != nil {
+		return nil, err
+	}
+	return escrow, nil
+}
+
+func decodeFXRate(key string, data []byte) (*FXRate, error) {
+	rate := new(FXRate)
+	err := json.Unmarshal(data, rate)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for fx rate %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeFXRate, rate.DocType, rate.RateID)
+	if err != nil {
+		return nil, err
+	}
+	return rate, nil
+}
+
+func decodeTelemetryRange(key string, data []byte) (*TelemetryRange, error) {
+	telemetryRange := new(TelemetryRange)
+	err := json.Unmarshal(data, telemetryRange)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for telemetry range %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeTelemetryRange, telemetryRange.DocType, telemetryRange.RangeID)
+	if err != nil {
+		return nil, err
+	}
+	return telemetryRange, nil
+}
+
+func decodeTelemetryBatch(key string, data []byte) (*TelemetryBatch, error) {
+	batch := new(TelemetryBatch)
+	err := json.Unmarshal(data, batch)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for telemetry batch %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeTelemetryBatch, batch.DocType, batch.BatchID)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+func decodeIoTDevice(key string, data []byte) (*IoTDevice, error) {
+	device := new(IoTDevice)
+	err := json.Unmarshal(data, device)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for IoT device %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeIoTDevice, device.DocType, device.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func decodeInspection(key string, data []byte) (*Inspection, error) {
+	inspection := new(Inspection)
+	err := json.Unmarshal(data, inspection)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for inspection %s: %s", key, err.Error())
+	}
+	err = checkDocType(key, DocTypeInspection, inspection.DocType, inspection.InspectionID)
+	if err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+// LoadUser reads the user stored under userID.
+func LoadUser(ctx contractapi.TransactionContextInterface, userID string) (*User, error) {
+	data, err := readState(ctx, userID, DocTypeUser)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUser(userID, data)
+}
+
+// SaveUser writes user to the world state under its UserID.
+func SaveUser(ctx contractapi.TransactionContextInterface, user *User) error {
+	user.DocType = DocTypeUser
+	return writeState(ctx, user.UserID, DocTypeUser, user)
+}
+
+// UserExists reports whether any record is stored under userID.
+func UserExists(ctx contractapi.TransactionContextInterface, userID string) (bool, error) {
+	return recordExists(ctx, userID)
+}
+
+// recordExists reports whether any record, of whatever type, is stored under
+// key.
+func recordExists(ctx contractapi.TransactionContextInterface, key string) (bool, error) {
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, errInternal("failed to read %s from world state: %s", key, err.Error())
+	}
+	return data != nil, nil
+}
+
+// LoadProduct reads the product stored under productID.
+func LoadProduct(ctx contractapi.TransactionContextInterface, productID string) (*Product, error) {
+	data, err := readState(ctx, productID, DocTypeProduct)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProduct(productID, data)
+}
+
+// SaveProduct writes product to the world state under its ProductID.
+func SaveProduct(ctx contractapi.TransactionContextInterface, product *Product) error {
+	product.DocType = DocTypeProduct
+	return writeState(ctx, product.ProductID, DocTypeProduct, product)
+}
+
+// LoadRegistration reads the registration request stored under registrationID.
+func LoadRegistration(ctx contractapi.TransactionContextInterface, registrationID string) (*Registration, error) {
+	data, err := readState(ctx, registrationID, DocTypeRegistration)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRegistration(registrationID, data)
+}
+
+// SaveRegistration writes registration to the world state under its
+// RegistrationID.
+func SaveRegistration(ctx contractapi.TransactionContextInterface, registration *Registration) error {
+	registration.DocType = DocTypeRegistration
+	return writeState(ctx, registration.RegistrationID, DocTypeRegistration, registration)
+}
+
+// LoadOrganization reads the organization stored under orgID.
+func LoadOrganization(ctx contractapi.TransactionContextInterface, orgID string) (*Organization, error) {
+	data, err := readState(ctx, orgID, DocTypeOrganization)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOrganization(orgID, data)
+}
+
+// SaveOrganization writes org to the world state under its OrgID.
+func SaveOrganization(ctx contractapi.TransactionContextInterface, org *Organization) error {
+	org.DocType = DocTypeOrganization
+	return writeState(ctx, org.OrgID, DocTypeOrganization, org)
+}
+
+// LoadDelegation reads the delegation stored under delegationID.
+func LoadDelegation(ctx contractapi.TransactionContextInterface, delegationID string) (*Delegation, error) {
+	data, err := readState(ctx, delegationID, DocTypeDelegation)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDelegation(delegationID, data)
+}
+
+// SaveDelegation writes delegation to the world state under its DelegationID.
+func SaveDelegation(ctx contractapi.TransactionContextInterface, delegation *Delegation) error {
+	delegation.DocType = DocTypeDelegation
+	return writeState(ctx, delegation.DelegationID, DocTypeDelegation, delegation)
+}
+
+// LoadProposal reads the governance proposal stored under proposalID.
+func LoadProposal(ctx contractapi.TransactionContextInterface, proposalID string) (*Proposal, error) {
+	data, err := readState(ctx, proposalID, DocTypeProposal)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProposal(proposalID, data)
+}
+
+// SaveProposal writes proposal to the world state under its ProposalID.
+func SaveProposal(ctx contractapi.TransactionContextInterface, proposal *Proposal) error {
+	proposal.DocType = DocTypeProposal
+	return writeState(ctx, proposal.ProposalID, DocTypeProposal, proposal)
+}
+
+// LoadFacility reads the facility stored under facilityID.
+func LoadFacility(ctx contractapi.TransactionContextInterface, facilityID string) (*Facility, error) {
+	data, err := readState(ctx, facilityID, DocTypeFacility)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFacility(facilityID, data)
+}
+
+// SaveFacility writes facility to the world state under its FacilityID.
+func SaveFacility(ctx contractapi.TransactionContextInterface, facility *Facility) error {
+	facility.DocType = DocTypeFacility
+	return writeState(ctx, facility.FacilityID, DocTypeFacility, facility)
+}
+
+// LoadInventoryLevel reads the inventory level stored under inventoryID.
+func LoadInventoryLevel(ctx contractapi.TransactionContextInterface, inventoryID string) (*InventoryLevel, error) {
+	data, err := readState(ctx, inventoryID, DocTypeInventoryLevel)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInventoryLevel(inventoryID, data)
+}
+
+// SaveInventoryLevel writes level to the world state under its InventoryID.
+func SaveInventoryLevel(ctx contractapi.TransactionContextInterface, level *InventoryLevel) error {
+	level.DocType = DocTypeInventoryLevel
+	return writeState(ctx, level.InventoryID, DocTypeInventoryLevel, level)
+}
+
+// LoadInventoryMovement reads the inventory movement stored under movementID.
+func LoadInventoryMovement(ctx contractapi.TransactionContextInterface, movementID string) (*InventoryMovement, error) {
+	data, err := readState(ctx, movementID, DocTypeInventoryMovement)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInventoryMovement(movementID, data)
+}
+
+// SaveInventoryMovement writes movement to the world state under its MovementID.
+func SaveInventoryMovement(ctx contractapi.TransactionContextInterface, movement *InventoryMovement) error {
+	movement.DocType = DocTypeInventoryMovement
+	return writeState(ctx, movement.MovementID, DocTypeInventoryMovement, movement)
+}
+
+// LoadInventoryTransfer reads the inventory transfer stored under transferID.
+func LoadInventoryTransfer(ctx contractapi.TransactionContextInterface, transferID string) (*InventoryTransfer, error) {
+	data, err := readState(ctx, transferID, DocTypeInventoryTransfer)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInventoryTransfer(transferID, data)
+}
+
+// SaveInventoryTransfer writes transfer to the world state under its TransferID.
+func SaveInventoryTransfer(ctx contractapi.TransactionContextInterface, transfer *InventoryTransfer) error {
+	transfer.DocType = DocTypeInventoryTransfer
+	return writeState(ctx, transfer.TransferID, DocTypeInventoryTransfer, transfer)
+}
+
+// LoadPurchaseOrder reads the purchase order stored under orderID.
+func LoadPurchaseOrder(ctx contractapi.TransactionContextInterface, orderID string) (*PurchaseOrder, error) {
+	data, err := readState(ctx, orderID, DocTypePurchaseOrder)
+	if err != nil {
+		return nil, err
+	}
+	return decodePurchaseOrder(orderID, data)
+}
+
+// SavePurchaseOrder writes order to the world state under its OrderID.
+func SavePurchaseOrder(ctx contractapi.TransactionContextInterface, order *PurchaseOrder) error {
+	order.DocType = DocTypePurchaseOrder
+	return writeState(ctx, order.OrderID, DocTypePurchaseOrder, order)
+}
+
+// LoadInvoice reads the invoice stored under invoiceID.
+func LoadInvoice(ctx contractapi.TransactionContextInterface, invoiceID string) (*Invoice, error) {
+	data, err := readState(ctx, invoiceID, DocTypeInvoice)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInvoice(invoiceID, data)
+}
+
+// SaveInvoice writes invoice to the world state under its InvoiceID.
+func SaveInvoice(ctx contractapi.TransactionContextInterface, invoice *Invoice) error {
+	invoice.DocType = DocTypeInvoice
+	return writeState(ctx, invoice.InvoiceID, DocTypeInvoice, invoice)
+}
+
+// LoadEscrow reads the escrow stored under escrowID.
+func LoadEscrow(ctx contractapi.TransactionContextInterface, escrowID string) (*Escrow, error) {
+	data, err := readState(ctx, escrowID, DocTypeEscrow)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEscrow(escrowID, data)
+}
+
+// SaveEscrow writes escrow to the world state under its EscrowID.
+func SaveEscrow(ctx contractapi.TransactionContextInterface, escrow *Escrow) error {
+	escrow.DocType = DocTypeEscrow
+	return writeState(ctx, escrow.EscrowID, DocTypeEscrow, escrow)
+}
+
+// LoadFXRate reads the fx rate stored under rateID.
+func LoadFXRate(ctx contractapi.TransactionContextInterface, rateID string) (*FXRate, error) {
+	data, err := readState(ctx, rateID, DocTypeFXRate)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFXRate(rateID, data)
+}
+
+// SaveFXRate writes rate to the world state under its RateID.
+func SaveFXRate(ctx contractapi.TransactionContextInterface, rate *FXRate) error {
+	rate.DocType = DocTypeFXRate
+	return writeState(ctx, rate.RateID, DocTypeFXRate, rate)
+}
+
+// LoadTelemetryRange reads the telemetry range stored under rangeID.
+func LoadTelemetryRange(ctx contractapi.TransactionContextInterface, rangeID string) (*TelemetryRange, error) {
+	data, err := readState(ctx, rangeID, DocTypeTelemetryRange)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTelemetryRange(rangeID, data)
+}
+
+// SaveTelemetryRange writes telemetryRange to the world state under its RangeID.
+func SaveTelemetryRange(ctx contractapi.TransactionContextInterface, telemetryRange *TelemetryRange) error {
+	telemetryRange.DocType = DocTypeTelemetryRange
+	return writeState(ctx, telemetryRange.RangeID, DocTypeTelemetryRange, telemetryRange)
+}
+
+// LoadTelemetryBatch reads the telemetry batch stored under batchID.
+func LoadTelemetryBatch(ctx contractapi.TransactionContextInterface, batchID string) (*TelemetryBatch, error) {
+	data, err := readState(ctx, batchID, DocTypeTelemetryBatch)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTelemetryBatch(batchID, data)
+}
+
+// SaveTelemetryBatch writes batch to the world state under its BatchID.
+func SaveTelemetryBatch(ctx contractapi.TransactionContextInterface, batch *TelemetryBatch) error {
+	batch.DocType = DocTypeTelemetryBatch
+	return writeState(ctx, batch.BatchID, DocTypeTelemetryBatch, batch)
+}
+
+// LoadIoTDevice reads the IoT device stored under deviceID.
+func LoadIoTDevice(ctx contractapi.TransactionContextInterface, deviceID string) (*IoTDevice, error) {
+	data, err := readState(ctx, deviceID, DocTypeIoTDevice)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIoTDevice(deviceID, data)
+}
+
+// SaveIoTDevice writes device to the world state under its DeviceID.
+func SaveIoTDevice(ctx contractapi.TransactionContextInterface, device *IoTDevice) error {
+	device.DocType = DocTypeIoTDevice
+	return writeState(ctx, device.DeviceID, DocTypeIoTDevice, device)
+}
+
+// LoadInspection reads the inspection stored under inspectionID.
+func LoadInspection(ctx contractapi.TransactionContextInterface, inspectionID string) (*Inspection, error) {
+	data, err := readState(ctx, inspectionID, DocTypeInspection)
+	if err != nil {
+		return nil, err
+	}
+	return decodeInspection(inspectionID, data)
+}
+
+// SaveInspection writes inspection to the world state under its InspectionID.
+func SaveInspection(ctx contractapi.TransactionContextInterface, inspection *Inspection) error {
+	inspection.DocType = DocTypeInspection
+	return writeState(ctx, inspection.InspectionID, DocTypeInspection, inspection)
+}
+
+// LoadProductRange returns every product stored between startKey and endKey.
+// Records of another type found in the range are reported as errors.
+func LoadProductRange(ctx contractapi.TransactionContextInterface, startKey string, endKey string) ([]*Product, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, errInternal("failed to query world state: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	results := []*Product{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, errInternal("failed to iterate world state: %s", err.Error())
+		}
+
+		product, err := decodeProduct(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, product)
+	}
+
+	return results, nil
+}
+
+// getCounter returns the current value of the counter stored under assetType.
+func getCounter(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
+	counterAsBytes, err := ctx.GetStub().GetState(assetType)
+	if err != nil {
+		return 0, errInternal("failed to read counter %s: %s", assetType, err.Error())
+	}
+
+	counter := CounterNO{}
+	if counterAsBytes != nil {
+		err = json.Unmarshal(counterAsBytes, &counter)
+		if err != nil {
+			return 0, errInternal("unmarshalling error for counter %s: %s", assetType, err.Error())
+		}
+	}
+
+	return counter.Counter, nil
+}
+
+// incrementCounter bumps the counter stored under assetType and returns the
+// new value.
+func incrementCounter(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
+	return reserveCounter(ctx, assetType, 1)
+}
+
+// reserveCounter advances the counter stored under assetType by count and
+// returns the first of the count new values. A transaction does not read its
+// own writes, so one that needs several values must reserve them at once
+// rather than incrementing twice.
+func reserveCounter(ctx contractapi.TransactionContextInterface, assetType string, count int) (int, error) {
+	current, err := getCounter(ctx, assetType)
+	if err != nil {
+		return 0, err
+	}
+
+	counter := CounterNO{Counter: current + count}
+	err = writeState(ctx, assetType, "counter", counter)
+	if err != nil {
+		return 0, err
+	}
+	return current + 1, nil
+}
+
+// putIndex writes the composite key objectType~attributes with an empty value
+// so that records can later be found by GetStateByPartialCompositeKey.
+func putIndex(ctx contractapi.TransactionContextInterface, objectType string, attributes ...string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return errInternal("failed to create %s index key: %s", objectType, err.Error())
+	}
+
+	err = ctx.GetStub().PutState(key, []byte{0x00})
+	if err != nil {
+		return errInternal("failed to put %s index: %s", objectType, err.Error())
+	}
+	return nil
+}
+
+// deleteIndex removes a composite key written by putIndex.
+func deleteIndex(ctx contractapi.TransactionContextInterface, objectType string, attributes ...string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return errInternal("failed to create %s index key: %s", objectType, err.Error())
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return errInternal("failed to delete %s index: %s", objectType, err.Error())
+	}
+	return nil
+}
+
+// indexedIDs returns the last attribute of every composite key of objectType
+// starting with attributes, which by convention is the id of the record.
+func indexedIDs(ctx contractapi.TransactionContextInterface, objectType string, attributes ...string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, errInternal("failed to query %s index: %s", objectType, err.Error())
+	}
+	defer resultsIterator.Close()
+
+	ids := []string{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, errInternal("failed to iterate %s index: %s", objectType, err.Error())
+		}
+
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, errInternal("failed to split %s index key: %s", objectType, err.Error())
+		}
+		if len(keyParts) == 0 {
+			continue
+		}
+		ids = append(ids, keyParts[len(keyParts)-1])
+	}
+
+	return ids, nil
+}
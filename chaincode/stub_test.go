@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ledgerStub is an in-memory world state and private data store. Like a
+// peer, it serves reads from the committed state only, so a transaction does
+// not see its own writes until commit is called. Calls it does not implement
+// panic on the nil embedded interface.
+type ledgerStub struct {
+	shim.ChaincodeStubInterface
+	state     map[string][]byte
+	private   map[string]map[string][]byte
+	writes    map[string][]byte
+	pvtWrites map[string]map[string][]byte
+	endorsers map[string][]byte
+	transient map[string][]byte
+	now       time.Time
+	invoke    func(name string, args [][]byte, channel string) peer.Response
+}
+
+func newLedgerStub() *ledgerStub {
+	return &ledgerStub{
+		state:     map[string][]byte{},
+		private:   map[string]map[string][]byte{},
+		writes:    map[string][]byte{},
+		pvtWrites: map[string]map[string][]byte{},
+		endorsers: map[string][]byte{},
+		transient: map[string][]byte{},
+		now:       time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// commit applies the writes of the current transaction. Deletes are written
+// as nil values.
+func (s *ledgerStub) commit() {
+	for key, value := range s.writes {
+		if value == nil {
+			delete(s.state, key)
+		} else {
+			s.state[key] = value
+		}
+	}
+	for collection, writes := range s.pvtWrites {
+		if s.private[collection] == nil {
+			s.private[collection] = map[string][]byte{}
+		}
+		for key, value := range writes {
+			if value == nil {
+				delete(s.private[collection], key)
+			} else {
+				s.private[collection][key] = value
+			}
+		}
+	}
+	s.writes = map[string][]byte{}
+	s.pvtWrites = map[string]map[string][]byte{}
+	s.transient = map[string][]byte{}
+}
+
+func (s *ledgerStub) GetTxID() string {
+	return "tx1"
+}
+
+func (s *ledgerStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now.Unix()}, nil
+}
+
+func (s *ledgerStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *ledgerStub) GetState(key string) ([]byte, error) {
+	return s.state[key], nil
+}
+
+func (s *ledgerStub) PutState(key string, value []byte) error {
+	s.writes[key] = value
+	return nil
+}
+
+func (s *ledgerStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+func (s *ledgerStub) SetStateValidationParameter(key string, ep []byte) error {
+	s.endorsers[key] = ep
+	return nil
+}
+
+func (s *ledgerStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+func (s *ledgerStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (s *ledgerStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.Trim(compositeKey, "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+func (s *ledgerStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return rangeOf(s.state, func(key string) bool {
+		return key >= startKey && (endKey == "" || key < endKey) && !strings.HasPrefix(key, "\x00")
+	}), nil
+}
+
+func (s *ledgerStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return rangeOf(s.state, func(key string) bool { return strings.HasPrefix(key, prefix) }), nil
+}
+
+func (s *ledgerStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	return s.private[collection][key], nil
+}
+
+func (s *ledgerStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value, ok := s.private[collection][key]
+	if !ok {
+		return nil, nil
+	}
+	sum := sha256.Sum256(value)
+	return sum[:], nil
+}
+
+func (s *ledgerStub) PutPrivateData(collection string, key string, value []byte) error {
+	if s.pvtWrites[collection] == nil {
+		s.pvtWrites[collection] = map[string][]byte{}
+	}
+	s.pvtWrites[collection][key] = value
+	return nil
+}
+
+func (s *ledgerStub) PurgePrivateData(collection string, key string) error {
+	return s.PutPrivateData(collection, key, nil)
+}
+
+func (s *ledgerStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := shim.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return rangeOf(s.private[collection], func(key string) bool { return strings.HasPrefix(key, prefix) }), nil
+}
+
+func (s *ledgerStub) InvokeChaincode(name string, args [][]byte, channel string) peer.Response {
+	if s.invoke == nil {
+		return shim.Error("no chaincode " + name)
+	}
+	return s.invoke(name, args, channel)
+}
+
+// kvIterator iterates a sorted snapshot of key-value pairs.
+type kvIterator struct {
+	kvs []*queryresult.KV
+}
+
+func rangeOf(values map[string][]byte, match func(key string) bool) *kvIterator {
+	iterator := &kvIterator{}
+	for key, value := range values {
+		if match(key) {
+			iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(iterator.kvs, func(i, j int) bool { return iterator.kvs[i].Key < iterator.kvs[j].Key })
+	return iterator
+}
+
+func (it *kvIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *kvIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *kvIterator) Close() error {
+	return nil
+}
+
+// testIdentity is the client identity submitting a test transaction.
+type testIdentity struct {
+	id    string
+	mspID string
+}
+
+func (c *testIdentity) GetID() (string, error) {
+	return c.id, nil
+}
+
+func (c *testIdentity) GetMSPID() (string, error) {
+	return c.mspID, nil
+}
+
+func (c *testIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (c *testIdentity) AssertAttributeValue(attrName string, attrValue string) error {
+	return errForbiddenRole("no attribute %s", attrName)
+}
+
+func (c *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// testLedger couples a ledgerStub with the identity submitting to it.
+type testLedger struct {
+	t      *testing.T
+	stub   *ledgerStub
+	client *testIdentity
+	ctx    *contractapi.TransactionContext
+}
+
+func newTestLedger(t *testing.T) *testLedger {
+	l := &testLedger{t: t, stub: newLedgerStub(), client: &testIdentity{}}
+	l.ctx = new(contractapi.TransactionContext)
+	l.ctx.SetStub(l.stub)
+	l.ctx.SetClientIdentity(l.client)
+	return l
+}
+
+// submit runs a transaction as a client of mspID with password in the
+// transient map, and commits its writes if it succeeds.
+func (l *testLedger) submit(mspID string, password string, tx func(ctx contractapi.TransactionContextInterface) error) error {
+	l.client.id = "x509::CN=client::" + mspID
+	l.client.mspID = mspID
+	if password != "" {
+		l.stub.transient[TransientPassword] = []byte(password)
+	}
+	err := tx(l.ctx)
+	if err == nil {
+		l.stub.commit()
+	} else {
+		l.stub.writes = map[string][]byte{}
+		l.stub.pvtWrites = map[string]map[string][]byte{}
+		l.stub.transient = map[string][]byte{}
+	}
+	return err
+}
+
+// put stores value under key as committed state.
+func (l *testLedger) put(key string, docType string, value any) {
+	l.t.Helper()
+	err := writeState(l.ctx, key, docType, value)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	l.stub.commit()
+}
+
+// addUser stores an active user of mspID whose password is its id in lower
+// case. It uses a legacy password hash, which is cheap to check.
+func (l *testLedger) addUser(userID string, userType string, mspID string) *User {
+	user := &User{
+		DocType:      DocTypeUser,
+		UserID:       userID,
+		UserType:     userType,
+		MSPID:        mspID,
+		OrgID:        mspID,
+		PasswordSalt: "salt",
+		PasswordHash: legacyPasswordHash("salt", strings.ToLower(userID)),
+		Status:       UserStatusActive,
+	}
+	l.put(userID, DocTypeUser, user)
+	return user
+}
@@ -19,13 +19,32 @@ type CounterNO struct {
 	Counter int `json:"Counter"`
 }
 
+// User is the public part of a participant. Name, email and address are kept
+// in UserPII, see pii.go.
 type User struct {
-	Name     string `json:"Name"`
+	DocType  string `json:"DocType"`
 	UserID   string `json:"UserID"`
 	UserType string `json:"UserType"`
-	Email    string `json:"Email"`
-	Address  string `json:"Address"`
-	Password string `json:"Password"`
+	Password string `json:"Password,omitempty"`
+	MSPID    string `json:"MSPID"`
+	// OrgID is the Organization the user works for
+	OrgID string `json:"OrgID"`
+	// AdminRole is the user type an admin approves registrations for
+	AdminRole string `json:"AdminRole,omitempty"`
+
+	// PasswordHash and PasswordSalt are only set on users created before
+	// passwords were kept in the org collection, see credentials.go
+	PasswordHash string `json:"PasswordHash,omitempty"`
+	PasswordSalt string `json:"PasswordSalt,omitempty"`
+	PIIHash      string `json:"PIIHash"`
+	PIIErased    bool   `json:"PIIErased"`
+
+	Status          string `json:"Status"`
+	StatusReason    string `json:"StatusReason"`
+	StatusChangedBy string `json:"StatusChangedBy"`
+
+	// PaymentAccount is the token account escrowed payments use
+	PaymentAccount string `json:"PaymentAccount,omitempty"`
 }
 
 type UserInfo struct {
@@ -36,559 +55,720 @@ type UserInfo struct {
 	Address  string `json:"Address"`
 }
 
+// Product statuses, in the order a product moves through them.
+const (
+	StatusAvailable   = "Available"
+	StatusAtWarehouse = "At warehouse"
+	StatusInTransit   = "In transit"
+	StatusSold        = "Sold"
+)
+
+// ProductPos is a position reported for a product. FacilityID is the facility
+// of the receiving org it was reported at and Anomaly explains why it was
+// flagged, see location.go.
 type ProductPos struct {
-	Date      string `json:"Date"`
-	Latitude  string `json:"Latitude"`
-	Longitude string `json:"Longitude"`
+	Date       string  `json:"Date"`
+	Latitude   float64 `json:"Latitude"`
+	Longitude  float64 `json:"Longitude"`
+	FacilityID string  `json:"FacilityID"`
+	Anomaly    string  `json:"Anomaly"`
 }
 
 type Product struct {
+	DocType string `json:"DocType"`
 	// Product Data
 	ProductID      string       `json:"ProductID"`
 	OrderID        string       `json:"OrderID"`
 	Name           string       `json:"Name"`
+	SKU            string       `json:"SKU"`
 	CustomerID     string       `json:"CustomerID"`
 	ManufacturerID string       `json:"ManufacturerID"`
 	SupplierID     string       `json:"SupplierID"`
 	TransporterID  string       `json:"TransporterID"`
 	Status         string       `json:"Status"`
-	Price          float64      `json:"Price"`
+	TermsHash      string       `json:"TermsHash"`
+	PriceVersion   int          `json:"PriceVersion"`
+	OwnerOrgID     string       `json:"OwnerOrgID"`
+	HolderOrgID    string       `json:"HolderOrgID"`
+	FacilityID     string       `json:"FacilityID"`
+	ContainerID    string       `json:"ContainerID"`
+	Excursions     int          `json:"Excursions"`
+	QualityHold    string       `json:"QualityHold"`
 	Position       []ProductPos `json:"Position"`
+	// LegacyPrice is the public price products carried before prices moved
+	// to the commercial terms collection, kept until MigrateMoney moves it
+	LegacyPrice float64 `json:"Price,omitempty"`
 }
 
 func (t *SupplyChain) Invoke(ctx contractapi.TransactionContextInterface) error {
 	function, args := ctx.GetStub().GetFunctionAndParameters()
-	fmt.Println("invoke is running" + function)
 
 	switch function {
 	case "InitLedger":
-		return t.InitLedger(ctx)
+		if len(args) != 1 {
+			return errValidation("insufficient arguments, expected 1 for InitLedger")
+		}
+		return t.InitLedger(ctx, args[0])
 	case "signIn":
 		return t.signIn(ctx, args)
 	case "createUser":
 		return t.createUser(ctx, args)
+	// Product transactions that move a product take an optional facility id,
+	// where the receiving org takes it in, and every product transaction takes
+	// an optional trailing delegate id, the user acting for the named
+	// participant under a Delegation. Positions are always passed as latitude,
+	// then longitude
 	case "createProduct":
-		if len(args) != 5 {
-			return fmt.Errorf("insufficient arguments expected 5 for create-product")
+		if len(args) < 5 || len(args) > 7 {
+			return errValidation("insufficient arguments, expected 5 to 7 for createProduct")
 		}
-		name, userID, longitude, latitude, price := args[0], args[1], args[2], args[3], args[4]
-		return t.createProduct(ctx, name, userID, longitude, latitude, price)
+		name, userID, latitude, longitude, sku := args[0], args[1], args[2], args[3], args[4]
+		return t.createProduct(ctx, name, userID, latitude, longitude, sku, optionalArg(args, 5), optionalArg(args, 6))
 	case "updateProduct":
-		if len(args) != 4 {
-			return fmt.Errorf("insufficient arguments expected 4 for update-product")
+		if len(args) != 3 && len(args) != 4 {
+			return errValidation("insufficient arguments, expected 3 or 4 for updateProduct")
 		}
-		userID, productID, name, price := args[0], args[1], args[2], args[3]
-		return t.updateProduct(ctx, userID, productID, name, price)
+		userID, productID, name := args[0], args[1], args[2]
+		return t.updateProduct(ctx, userID, productID, name, optionalArg(args, 3))
 	case "toSupplier":
-		if len(args) != 4 {
-			return fmt.Errorf("insufficient arguments expected 4 for to-supplier")
+		if len(args) < 4 || len(args) > 6 {
+			return errValidation("insufficient arguments, expected 4 to 6 for toSupplier")
 		}
-		productID, supplierID, longitude, latitude := args[0], args[1], args[2], args[3]
-		return t.toSupplier(ctx, productID, supplierID, longitude, latitude)
+		productID, supplierID, latitude, longitude := args[0], args[1], args[2], args[3]
+		return t.toSupplier(ctx, productID, supplierID, latitude, longitude, optionalArg(args, 4), optionalArg(args, 5))
 	case "toTransporter":
-		if len(args) != 4 {
-			return fmt.Errorf("insufficient arguments expected 4 for to-transporter")
+		if len(args) < 4 || len(args) > 6 {
+			return errValidation("insufficient arguments, expected 4 to 6 for toTransporter")
 		}
-		productID, transporterID, longitude, latitude := args[0], args[1], args[2], args[3]
-		return t.toTransporter(ctx, productID, transporterID, longitude, latitude)
+		productID, transporterID, latitude, longitude := args[0], args[1], args[2], args[3]
+		return t.toTransporter(ctx, productID, transporterID, latitude, longitude, optionalArg(args, 4), optionalArg(args, 5))
 	case "sellToCustomer":
-		if len(args) != 3 {
-			return fmt.Errorf("insufficient arguments expected 3 for sell-to-customer")
+		if len(args) < 4 || len(args) > 6 {
+			return errValidation("insufficient arguments, expected 4 to 6 for sellToCustomer")
 		}
 		productID, customerID, latitude, longitude := args[0], args[1], args[2], args[3]
-		return t.sellToCustomer(ctx, productID, customerID, latitude, longitude)
+		return t.sellToCustomer(ctx, productID, customerID, latitude, longitude, optionalArg(args, 4), optionalArg(args, 5))
 	// Add more functions here...
 	default:
-		return fmt.Errorf("invalid function name: %s", function)
+		return errValidation("invalid function name: %s", function)
 	}
 }
 
 // //  ---------------------------- functions ------------------------------------------
 
-func getCounter(ctx contractapi.TransactionContextInterface, AssetType string) int {
-	counterAsBytes, _ := ctx.GetStub().GetState(AssetType)
-	counter := CounterNO{}
-
-	json.Unmarshal(counterAsBytes, &counter)
-	fmt.Printf("Counter Current Value %d of  Asset Type %s  ", counter.Counter, AssetType)
-
-	return counter.Counter
+// optionalArg returns args[i], or an empty string when it was not passed.
+func optionalArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
 }
 
-func incrementCounter(ctx contractapi.TransactionContextInterface, AssetType string) int {
-	counterAsBytes, _ := ctx.GetStub().GetState(AssetType)
-	counter := CounterNO{}
-
-	json.Unmarshal(counterAsBytes, &counter)
-	counter.Counter++
-	counterAsBytes, _ = json.Marshal(counter)
-
-	err := ctx.GetStub().PutState(AssetType, counterAsBytes)
+// txTime returns the transaction timestamp, which is the same on every
+// endorser, in UTC.
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	txTimeAsPtr, err := ctx.GetStub().GetTxTimestamp()
 	if err != nil {
-		fmt.Printf("Failed to Increment Counter")
+		return time.Time{}, errInternal("failed to read transaction timestamp: %s", err.Error())
 	}
-	return counter.Counter
+	return time.Unix(txTimeAsPtr.Seconds, int64(txTimeAsPtr.Nanos)).UTC(), nil
 }
 
 // Get the TimeStamp of transaction when chaicode was executed
 func (t *SupplyChain) GetTxTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
-	txTimeAsPtr, err := ctx.GetStub().GetTxTimestamp()
+	now, err := txTime(ctx)
 	if err != nil {
 		return "Error", err
 	}
-	timeStr := time.Unix(txTimeAsPtr.Seconds, int64(txTimeAsPtr.Nanos)).String()
-	return timeStr, nil
+	return now.String(), nil
 }
 
-func (t *SupplyChain) InitLedger(ctx contractapi.TransactionContextInterface) error {
-	// Init Manufacturer admin
-	userManufacturer := User{
-		Name:     "Manufacturer_Admin",
-		UserID:   "manufacturer-admin",
-		UserType: "admin",
-		Email:    "mfg.admin@scm.com",
-		Address:  "fabric",
-		Password: "admin@123",
+// InitLedger bootstraps the ledger from a JSON BootstrapConfig: the
+// participating organizations and their roles, the enabled roles, system
+// parameters and the admin users. Admin passwords are read from the
+// admin_passwords transient entry, the salts of their passwords and personal
+// data from password_salt and salt. It can only run once and only for an
+// identity carrying the deployer attribute.
+func (t *SupplyChain) InitLedger(ctx contractapi.TransactionContextInterface, configJSON string) error {
+	err := requireDeployer(ctx)
+	if err != nil {
+		return err
 	}
 
-	userManufacturerBytes, err := json.Marshal(userManufacturer)
+	markerBytes, err := ctx.GetStub().GetState(InitMarkerKey)
 	if err != nil {
-		return fmt.Errorf("marshal error: %s", err.Error())
+		return errInternal("failed to read init marker: %s", err.Error())
+	}
+	if markerBytes != nil {
+		return errConflict("ledger is already initialized")
 	}
 
-	err = ctx.GetStub().PutState(userManufacturer.UserID, userManufacturerBytes)
+	config := BootstrapConfig{}
+	err = json.Unmarshal([]byte(configJSON), &config)
 	if err != nil {
-		return fmt.Errorf("failed to put manufacturer to world state: %s", err.Error())
+		return errValidation("bootstrap config is not valid JSON: %s", err.Error())
 	}
-
-	// Init Supplier admin
-	userSupplier := User{
-		Name:     "Supplier_Admin",
-		UserID:   "supplier-admin",
-		UserType: "admin",
-		Email:    "supplier.admin@scm.com",
-		Address:  "fabric",
-		Password: "admin@123",
+	err = validateBootstrapConfig(&config)
+	if err != nil {
+		return err
 	}
 
-	userSupplierBytes, err := json.Marshal(userSupplier)
-	if err != nil {
-		return fmt.Errorf("marshal error: %s", err.Error())
+	passwords := map[string]string{}
+	salts := map[string]string{}
+	if len(config.Admins) > 0 {
+		err = transientJSON(ctx, TransientAdminPasswords, &passwords)
+		if err != nil {
+			return err
+		}
+		salts, err = readSensitive(ctx, []string{configJSON}, TransientSalt, TransientPasswordSalt)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = ctx.GetStub().PutState(userSupplier.UserID, userSupplierBytes)
-	if err != nil {
-		return fmt.Errorf("failed to put supplier to world state: %s", err.Error())
+	for _, orgConfig := range config.Organizations {
+		exists, err := recordExists(ctx, orgConfig.MSPID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errConflict("key %s is already in use", orgConfig.MSPID)
+		}
+
+		err = SaveOrganization(ctx, &Organization{
+			OrgID:          orgConfig.MSPID,
+			LegalName:      orgConfig.Name,
+			MSPID:          orgConfig.MSPID,
+			Roles:          orgConfig.Roles,
+			Addresses:      orgConfig.Addresses,
+			Certifications: orgConfig.Certifications,
+		})
+		if err != nil {
+			return err
+		}
+		err = putIndex(ctx, organizationIndex, orgConfig.MSPID)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Init Transporter admin
-	userTransporter := User{
-		Name:     "Transporter_Admin",
-		UserID:   "transporter-admin",
-		UserType: "admin",
-		Email:    "transporter.admin@scm.com",
-		Address:  "fabric",
-		Password: "admin@123",
+	for _, admin := range config.Admins {
+		password := passwords[admin.UserID]
+		if len(password) == 0 {
+			return errValidation("no password passed for admin %s", admin.UserID)
+		}
+
+		exists, err := UserExists(ctx, admin.UserID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errConflict("user %s already exists", admin.UserID)
+		}
+
+		user := User{
+			UserID:    admin.UserID,
+			UserType:  "admin",
+			MSPID:     admin.MSPID,
+			OrgID:     admin.MSPID,
+			AdminRole: admin.AdminRole,
+		}
+		err = setPassword(ctx, &user, password, salts[TransientPasswordSalt])
+		if err != nil {
+			return err
+		}
+
+		err = saveUserPII(ctx, &user, &UserPII{Name: admin.Name, Email: admin.Email, Address: admin.Address, Salt: salts[TransientSalt]})
+		if err != nil {
+			return err
+		}
+		err = saveNewUser(ctx, &user)
+		if err != nil {
+			return err
+		}
 	}
 
-	userTransporterBytes, err := json.Marshal(userTransporter)
+	parameters := config.Parameters
+	if parameters == nil {
+		parameters = map[string]string{}
+	}
+	err = SaveSystemConfig(ctx, &SystemConfig{
+		Roles:      config.Roles,
+		Parameters: parameters,
+	})
 	if err != nil {
-		return fmt.Errorf("marshal error: %s", err.Error())
+		return err
 	}
 
-	err = ctx.GetStub().PutState(userTransporter.UserID, userTransporterBytes)
+	deployerID, err := ctx.GetClientIdentity().GetID()
 	if err != nil {
-		return fmt.Errorf("failed to put supplier to world state: %s", err.Error())
+		return errInternal("failed to read client identity: %s", err.Error())
+	}
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	timestamp, err := t.GetTxTimestamp(ctx)
+	if err != nil {
+		return err
 	}
 
-	return nil
-
+	return writeState(ctx, InitMarkerKey, "init marker", InitMarker{
+		InitializedBy: deployerID,
+		MSPID:         mspID,
+		Timestamp:     timestamp,
+	})
 }
 
+// signIn takes the user id as argument and the password from the transient
+// map.
 func (t *SupplyChain) signIn(ctx contractapi.TransactionContextInterface, args []string) error {
-	if len(args) != 2 {
-		return fmt.Errorf("insufficient arguments. expected 2")
+	if len(args) != 1 {
+		return errValidation("expected 1 argument, the password must be passed in the transient map")
 	}
 
 	if len(args[0]) == 0 {
-		return fmt.Errorf("user id must be provided")
-	}
-	if len(args[1]) == 0 {
-		return fmt.Errorf("password must be provided")
+		return errValidation("user id must be provided")
 	}
 
-	userID := args[0]
-	userBytes, err := ctx.GetStub().GetState(userID)
+	user, err := authenticate(ctx, args, args[0])
 	if err != nil {
-		return fmt.Errorf("error retrieving user data: %w", err)
-	}
-	if userBytes == nil {
-		return fmt.Errorf("User not found: %s", userID)
+		return err
 	}
 
-	user := User{}
-	err = json.Unmarshal(userBytes, &user)
+	err = requireActive(user)
 	if err != nil {
-		return fmt.Errorf("unmarshalling error: %w", err)
-	}
-
-	// Verify password
-	if user.Password != args[1] {
-		return fmt.Errorf("incorred Userid or passsword")
+		return err
 	}
 
 	// No data returned, only error handling (success implied by lack of error)
 	return nil
 }
 
+// createUser lets customers sign up directly. Manufacturers, suppliers and
+// transporters have to go through RequestRegistration and be approved by an
+// admin. Name, email, address, password and the salt used to hash the
+// personal data are read from the transient map.
 func (t *SupplyChain) createUser(ctx contractapi.TransactionContextInterface, args []string) error {
-	if len(args) != 5 {
-		return fmt.Errorf("insufficient arguments, expected 5")
+	if len(args) != 1 {
+		return errValidation("expected 1 argument, name, email, address, password and salt must be passed in the transient map")
 	}
 
 	if len(args[0]) == 0 {
-		return fmt.Errorf("provide name for User")
+		return errValidation("please specify type of user")
 	}
 
-	if len(args[1]) == 0 {
-		return fmt.Errorf("provide Email")
+	if args[0] != "customer" {
+		return errForbiddenRole("only customers can sign up directly, use RequestRegistration for %s", args[0])
 	}
 
-	if len(args[2]) == 0 {
-		return fmt.Errorf("please specify type of uer")
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	err = requireRoleAllowed(ctx, mspID, args[0])
+	if err != nil {
+		return err
 	}
 
-	if len(args[3]) == 0 {
-		return fmt.Errorf("please provide non-empty address")
+	user, pii, err := newUserFromTransient(ctx, args, args[0])
+	if err != nil {
+		return err
 	}
 
-	if len(args[4]) == 0 {
-		return fmt.Errorf("please enter valid non-empty password")
+	err = saveUserPII(ctx, user, pii)
+	if err != nil {
+		return err
 	}
 
-	userCounter := getCounter(ctx, "UserCounterNO")
-	userCounter++
+	return saveNewUser(ctx, user)
+}
 
-	user := User{
-		Name:     args[0],
-		UserID:   "User" + strconv.Itoa(userCounter),
-		Email:    args[1],
-		UserType: args[2],
-		Address:  args[3],
-		Password: args[4],
+// createProduct expects the price and contract terms as CommercialTerms in
+// the transient map, so they never reach the public ledger.
+func (t *SupplyChain) createProduct(ctx contractapi.TransactionContextInterface, name string, userId string, latitude string, longitude string, sku string, facilityID string, delegateID string) error {
+	user, err := LoadUser(ctx, userId)
+	if err != nil {
+		return err
 	}
 
-	userAsBytes, err := json.Marshal(user)
+	err = authorize(ctx, user, ActionCreateProduct, "")
 	if err != nil {
-		return fmt.Errorf("marshal error: %s", err.Error())
+		return err
 	}
 
-	errPut := ctx.GetStub().PutState(user.UserID, userAsBytes)
-	if errPut != nil {
-		return fmt.Errorf("error storing date: %w", errPut)
+	if len(sku) == 0 {
+		return errValidation("sku must be provided")
 	}
 
-	incrementCounter(ctx, "UserCounterNO")
-	fmt.Println("Successfully created user")
-
-	return nil
-
-}
-
-func (t *SupplyChain) createProduct(ctx contractapi.TransactionContextInterface, name string, userId string, longitude string, latitude string, price string) error {
-
-	userBytes, _ := ctx.GetStub().GetState(userId)
-	if userBytes == nil {
-		return fmt.Errorf("can not find user: %v", userId)
+	err = requireActive(user)
+	if err != nil {
+		return err
 	}
-
-	user := User{}
-	json.Unmarshal(userBytes, &user)
-
-	if user.UserType != "manufacturer" {
-		return fmt.Errorf("only manufacturer can create product")
+	err = requireClientOrg(ctx, user.OrgID, "create products for "+user.UserID)
+	if err != nil {
+		return err
 	}
 
-	priceAsFloat, err := strconv.ParseFloat(price, 64)
+	args := []string{name, userId, latitude, longitude, sku, facilityID, delegateID}
+	actor, err := authorizeActing(ctx, args, user, delegateID, ActionCreateProduct, nil, sku)
 	if err != nil {
-		return fmt.Errorf("error converting price: %s", err.Error())
+		return err
 	}
 
-	productCounter := getCounter(ctx, "ProductCounterNO")
-	productCounter++
-
-	txTimeAsPtr, err := t.GetTxTimestamp(ctx)
+	productCounter, err := incrementCounter(ctx, "ProductCounterNO")
 	if err != nil {
-		return fmt.Errorf("error in transaction timestamp")
+		return err
 	}
 
-	position := ProductPos{}
-	position.Date = txTimeAsPtr
-	position.Latitude = latitude
-	position.Longitude = longitude
+	productID := "Product" + strconv.Itoa(productCounter)
+	terms, err := readTransientTerms(ctx, productID)
+	if err != nil {
+		return err
+	}
+	if terms.SellerID == "" {
+		terms.SellerID = user.UserID
+	}
 
 	product := Product{
-		ProductID:      "Product" + strconv.Itoa(productCounter),
+		ProductID:      productID,
 		Name:           name,
+		SKU:            sku,
 		ManufacturerID: user.UserID,
 		SupplierID:     "",
 		TransporterID:  "",
 		CustomerID:     "",
-		Status:         "Available",
-		Position:       []ProductPos{position},
-		Price:          priceAsFloat,
+		Status:         StatusAvailable,
+		Position:       []ProductPos{},
 	}
 
-	productAsBytes, err := json.Marshal(product)
+	// The first price needs no second approval
+	err = recordPriceChange(ctx, &product, actor, terms)
 	if err != nil {
 		return err
 	}
 
-	err = ctx.GetStub().PutState(product.ProductID, productAsBytes)
+	err = recordPosition(ctx, &product, user.OrgID, facilityID, latitude, longitude)
 	if err != nil {
-		return fmt.Errorf("failed to put to world state %v", err.Error())
+		return err
+	}
+	err = moveProductStock(ctx, &product, "", facilityID, actor.UserID, "", MovementReceipt)
+	if err != nil {
+		return err
 	}
 
-	incrementCounter(ctx, "ProductCounterNO")
-
-	return nil
-}
-
-func (t *SupplyChain) updateProduct(ctx contractapi.TransactionContextInterface, userID string, productID string, name string, price string) error {
-
-	userBytes, _ := ctx.GetStub().GetState(userID)
-	if userBytes == nil {
-		return fmt.Errorf("can not find user")
+	err = moveProduct(ctx, &product, user.OrgID, user.OrgID)
+	if err != nil {
+		return err
 	}
 
-	user := User{}
-	json.Unmarshal(userBytes, &user)
-	if user.UserType == "customer" {
-		return fmt.Errorf("customer can not update product")
+	err = SaveProduct(ctx, &product)
+	if err != nil {
+		return err
 	}
 
-	productBytes, err := ctx.GetStub().GetState(productID)
+	// Until it leaves the manufacturer only the manufacturer org may endorse
+	return setKeyEndorsers(ctx, product.ProductID, user.MSPID)
+}
 
+// updateProduct replaces the name and, when they are passed in the transient
+// map, the commercial terms of a product. A new price is recorded as the next
+// price version and may need a second approval before it takes effect, see
+// pricing.go.
+func (t *SupplyChain) updateProduct(ctx contractapi.TransactionContextInterface, userID string, productID string, name string, delegateID string) error {
+	user, err := LoadUser(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to read product from world-state: %s", err.Error())
+		return err
 	}
 
-	if productBytes == nil {
-		return fmt.Errorf("can not find the product")
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
 	}
 
-	product := Product{}
-	json.Unmarshal(productBytes, &product)
-
-	if product.TransporterID != "" {
-		return fmt.Errorf("product sent to transporter. can not update price")
+	err = authorizePriceAuthority(ctx, user, product)
+	if err != nil {
+		return err
 	}
-
-	priceAsFloat, err := strconv.ParseFloat(price, 64)
+	actor, err := authorizeActing(ctx, []string{userID, productID, name, delegateID}, user, delegateID, ActionUpdateProduct, product, "")
 	if err != nil {
-		return fmt.Errorf("failed to convert price to float: %s", err.Error())
+		return err
 	}
 
-	product.Name = name
-	product.Price = priceAsFloat
-
-	updateProductAsBytes, err := json.Marshal(product)
+	// Name and price belong to the manufacturer, so its org has to endorse
+	// as well. The holder org still endorses through the policy on the
+	// product key: Fabric checks a write against the policy committed before
+	// the transaction, so it can not be lifted for this update alone
+	manufacturer, err := LoadUser(ctx, product.ManufacturerID)
+	if err != nil {
+		return err
+	}
+	err = requireOrgEndorsement(ctx, manufacturer)
 	if err != nil {
 		return err
 	}
 
-	ctx.GetStub().PutState(product.ProductID, updateProductAsBytes)
-	return nil
+	// A rename alone keeps the current terms
+	_, hasTerms, err := lookupTransient(ctx, TransientTermsKey)
+	if err != nil {
+		return err
+	}
+	if hasTerms {
+		terms, err := readTransientTerms(ctx, productID)
+		if err != nil {
+			return err
+		}
+		if terms.SellerID == "" {
+			terms.SellerID = product.ManufacturerID
+		}
+		err = recordPriceChange(ctx, product, actor, terms)
+		if err != nil {
+			return err
+		}
+	}
 
+	product.Name = name
+	return SaveProduct(ctx, product)
 }
 
-func (t *SupplyChain) toSupplier(ctx contractapi.TransactionContextInterface, productID string, supplierID string, longitude string, latitude string) error {
-
-	userBytes, _ := ctx.GetStub().GetState(supplierID)
-
-	if userBytes == nil {
-		return fmt.Errorf("can not find Supplier")
+func (t *SupplyChain) toSupplier(ctx contractapi.TransactionContextInterface, productID string, supplierID string, latitude string, longitude string, facilityID string, delegateID string) error {
+	user, err := LoadUser(ctx, supplierID)
+	if err != nil {
+		return err
 	}
 
-	user := User{}
-	json.Unmarshal(userBytes, &user)
-
-	if user.UserType != "supplier" {
-		return fmt.Errorf("User must be a Supplier")
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
 	}
 
-	productBytes, err := ctx.GetStub().GetState(productID)
-
+	err = authorize(ctx, user, ActionAcceptTransfer, product.Status)
 	if err != nil {
-		return fmt.Errorf("failed to get product from world state: %s", productID)
+		return err
 	}
 
-	if productBytes == nil {
-		return fmt.Errorf("can not find the product")
+	if product.SupplierID != "" {
+		return errInvalidTransition("product is sent to supplier already")
+	}
+	err = requireNoQualityHold(product)
+	if err != nil {
+		return err
 	}
 
-	product := Product{}
-	json.Unmarshal(productBytes, &product)
-
-	if product.SupplierID != "" {
-		return fmt.Errorf("Product is sent to Supplier already")
+	err = requireClientOrg(ctx, product.HolderOrgID, "hand over this product")
+	if err != nil {
+		return err
 	}
 
-	// Trnasaction Timestamp
-	txTimeAsPtr, errTx := t.GetTxTimestamp(ctx)
-	if errTx != nil {
-		return fmt.Errorf("error getting transaction timestamp")
+	// Both sides of the handoff must be active, but only the sender's side
+	// authenticates
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+	actor, err := authorizeHandOver(ctx, []string{productID, supplierID, latitude, longitude, facilityID, delegateID}, product.ManufacturerID, delegateID, product)
+	if err != nil {
+		return err
 	}
 
 	product.SupplierID = user.UserID
-	product.Position = append(product.Position, ProductPos{Date: txTimeAsPtr, Latitude: latitude, Longitude: longitude})
-	product.Status = "At warehouse"
-
-	updateProductAsBytes, err := json.Marshal(product)
+	previousFacilityID := product.FacilityID
+	err = recordPosition(ctx, product, user.OrgID, facilityID, latitude, longitude)
 	if err != nil {
-		return fmt.Errorf(fmt.Sprintf("Marshal Error: %s", err))
+		return err
 	}
+	err = moveProductStock(ctx, product, previousFacilityID, facilityID, actor.UserID, MovementTransferOut, MovementTransferIn)
+	if err != nil {
+		return err
+	}
+	product.Status = StatusAtWarehouse
 
-	ctx.GetStub().PutState(product.ProductID, updateProductAsBytes)
-	return nil
-}
-
-func (t *SupplyChain) toTransporter(ctx contractapi.TransactionContextInterface, productID string, transporterID string, longitude string, latitude string) error {
+	// The supplier buys the goods and holds them in its warehouse
+	err = moveProduct(ctx, product, user.OrgID, user.OrgID)
+	if err != nil {
+		return err
+	}
 
-	userBytes, _ := ctx.GetStub().GetState(transporterID)
+	err = lockEscrow(ctx, product, user.UserID, product.ManufacturerID)
+	if err != nil {
+		return err
+	}
 
-	if userBytes == nil {
-		return fmt.Errorf("can not find user")
+	err = transferCustody(ctx, product, user)
+	if err != nil {
+		return err
 	}
 
-	user := User{}
-	json.Unmarshal(userBytes, &user)
+	return SaveProduct(ctx, product)
+}
 
-	if user.UserType != "transporter" {
-		return fmt.Errorf("User must be a Transporter")
+func (t *SupplyChain) toTransporter(ctx contractapi.TransactionContextInterface, productID string, transporterID string, latitude string, longitude string, facilityID string, delegateID string) error {
+	user, err := LoadUser(ctx, transporterID)
+	if err != nil {
+		return err
 	}
 
-	productBytes, _ := ctx.GetStub().GetState(productID)
-	if productBytes == nil {
-		return fmt.Errorf("can not find the product")
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
 	}
 
-	product := Product{}
-	json.Unmarshal(productBytes, &product)
+	err = authorize(ctx, user, ActionAcceptTransfer, product.Status)
+	if err != nil {
+		return err
+	}
 
 	if product.SupplierID == "" {
-		return fmt.Errorf("product not sent to supplier yet")
+		return errInvalidTransition("product not sent to supplier yet")
 	}
 
 	if product.TransporterID != "" {
-		return fmt.Errorf("product is sent to transporter already")
+		return errInvalidTransition("product is sent to transporter already")
+	}
+	err = requireNoQualityHold(product)
+	if err != nil {
+		return err
 	}
 
-	// Trnasaction Timestamp
-	txTimeAsPtr, errTx := t.GetTxTimestamp(ctx)
-	if errTx != nil {
-		return fmt.Errorf("error getting transaction timeStamp")
+	err = requireClientOrg(ctx, product.HolderOrgID, "hand over this product")
+	if err != nil {
+		return err
+	}
+
+	// Both sides of the handoff must be active, but only the sender's side
+	// authenticates
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+	actor, err := authorizeHandOver(ctx, []string{productID, transporterID, latitude, longitude, facilityID, delegateID}, product.SupplierID, delegateID, product)
+	if err != nil {
+		return err
 	}
 
 	product.TransporterID = user.UserID
-	product.Position = append(product.Position, ProductPos{Date: txTimeAsPtr, Latitude: latitude, Longitude: longitude})
-	product.Status = "In transit"
+	previousFacilityID := product.FacilityID
+	err = recordPosition(ctx, product, user.OrgID, facilityID, latitude, longitude)
+	if err != nil {
+		return err
+	}
+	err = moveProductStock(ctx, product, previousFacilityID, facilityID, actor.UserID, MovementTransferOut, MovementTransferIn)
+	if err != nil {
+		return err
+	}
+	product.Status = StatusInTransit
 
-	updateProductAsBytes, errMarshal := json.Marshal(product)
-	if errMarshal != nil {
-		return fmt.Errorf("marshal error in user %s", errMarshal)
+	// The transporter only holds the goods, the supplier still owns them
+	err = moveProduct(ctx, product, product.OwnerOrgID, user.OrgID)
+	if err != nil {
+		return err
 	}
 
-	errPut := ctx.GetStub().PutState(product.ProductID, updateProductAsBytes)
-	if errPut != nil {
-		return fmt.Errorf("failed to send to transporter: %s", product.ProductID)
+	// The supplier pays for the transport
+	err = lockEscrow(ctx, product, product.SupplierID, user.UserID)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Product successfully sent for Transporting")
-	return nil
+	err = transferCustody(ctx, product, user)
+	if err != nil {
+		return err
+	}
 
+	return SaveProduct(ctx, product)
 }
 
-func (t *SupplyChain) sellToCustomer(ctx contractapi.TransactionContextInterface, productID string, customerID string, longitude string, latitude string) error {
-	productBytes, _ := ctx.GetStub().GetState(productID)
-	if productBytes == nil {
-		return fmt.Errorf("can not find the product")
+func (t *SupplyChain) sellToCustomer(ctx contractapi.TransactionContextInterface, productID string, customerID string, latitude string, longitude string, facilityID string, delegateID string) error {
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return err
 	}
 
-	product := Product{}
-	json.Unmarshal(productBytes, &product)
-
 	if product.TransporterID == "" {
-		return fmt.Errorf("Product not sent to transporter yet")
+		return errInvalidTransition("product not sent to transporter yet")
 	}
 	if product.CustomerID != "" {
-		return fmt.Errorf("Product already sold")
+		return errConflict("product already sold")
+	}
+	err = requireNoQualityHold(product)
+	if err != nil {
+		return err
 	}
 
-	// Transaction Timestamp
-	txTimeAsPtr, errTx := t.GetTxTimestamp(ctx)
-	if errTx != nil {
-		return fmt.Errorf("error in timestamp")
+	err = requireClientOrg(ctx, product.HolderOrgID, "hand over this product")
+	if err != nil {
+		return err
 	}
 
-	product.CustomerID = customerID
-	product.Position = append(product.Position, ProductPos{Date: txTimeAsPtr, Latitude: latitude, Longitude: longitude})
-	product.Status = "Sold"
+	customer, err := LoadUser(ctx, customerID)
+	if err != nil {
+		return err
+	}
 
-	updateProductAsBytes, errMarshal := json.Marshal(product)
-	if errMarshal != nil {
-		return fmt.Errorf("marshal error in user %s", errMarshal)
+	err = authorize(ctx, customer, ActionAcceptTransfer, product.Status)
+	if err != nil {
+		return err
 	}
 
-	ctx.GetStub().PutState(product.ProductID, updateProductAsBytes)
-	return nil
-}
+	// Both sides of the handoff must be active, but only the sender's side
+	// authenticates
+	err = requireActive(customer)
+	if err != nil {
+		return err
+	}
+	actor, err := authorizeHandOver(ctx, []string{productID, customerID, latitude, longitude, facilityID, delegateID}, product.TransporterID, delegateID, product)
+	if err != nil {
+		return err
+	}
 
-func (t *SupplyChain) QueryProduct(ctx contractapi.TransactionContextInterface, productId string) (*Product, error) {
-	productAsBytes, err := ctx.GetStub().GetState(productId)
+	product.CustomerID = customer.UserID
+	previousFacilityID := product.FacilityID
+	err = recordPosition(ctx, product, customer.OrgID, facilityID, latitude, longitude)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from world state: %s", err.Error())
+		return err
 	}
-	if productAsBytes == nil {
-		return nil, fmt.Errorf("Product %s does not exist", productId)
+	err = moveProductStock(ctx, product, previousFacilityID, facilityID, actor.UserID, MovementSale, MovementTransferIn)
+	if err != nil {
+		return err
 	}
-	product := new(Product)
-	err = json.Unmarshal(productAsBytes, &product)
+	product.Status = StatusSold
+
+	err = moveProduct(ctx, product, customer.OrgID, customer.OrgID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return product, nil
-}
 
-func (t *SupplyChain) QueryAllProducts(ctx contractapi.TransactionContextInterface) ([]*Product, error) {
-	startKey := "Product1"
-	endKey := "Product999"
+	err = lockEscrow(ctx, product, customer.UserID, product.SupplierID)
+	if err != nil {
+		return err
+	}
 
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	err = transferCustody(ctx, product, customer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resultsIterator.Close()
 
-	results := []*Product{}
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, err
-		}
+	return SaveProduct(ctx, product)
+}
 
-		product := new(Product)
-		_ = json.Unmarshal(queryResponse.Value, product)
-		results = append(results, product)
-	}
+func (t *SupplyChain) QueryProduct(ctx contractapi.TransactionContextInterface, productId string) (*Product, error) {
+	return LoadProduct(ctx, productId)
+}
+
+// QueryAllProducts lists every product. Product ids are "Product" followed by
+// digits, so the range runs up to ':', the character after '9', which leaves
+// out ProductCounterNO.
+func (t *SupplyChain) QueryAllProducts(ctx contractapi.TransactionContextInterface) ([]*Product, error) {
+	startKey := "Product0"
+	endKey := "Product:"
 
-	return results, nil
+	return LoadProductRange(ctx, startKey, endKey)
 }
 
 //  ---------------------------- main ------------------------------------------
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(new(SupplyChain))
+	chaincode, err := contractapi.NewChaincode(new(SupplyChain), new(TokenContract))
 	if err != nil {
 		fmt.Printf("Error creating chaincode: %s", err.Error())
 		return
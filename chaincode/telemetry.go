@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- cold chain telemetry ------------------------------------------
+
+// TelemetryExcursionEvent is emitted with the excursions a telemetry batch
+// found.
+const TelemetryExcursionEvent = "TelemetryExcursion"
+
+// maxTelemetryBatch bounds the readings accepted in one transaction.
+const maxTelemetryBatch = 500
+
+// telemetryIndex maps a product to the telemetry batches covering it.
+const telemetryIndex = "telemetry~product"
+
+// containerIndex maps a container to the products loaded in it.
+const containerIndex = "product~container"
+
+// Telemetry metrics.
+const (
+	MetricTemperature = "temperature"
+	MetricHumidity    = "humidity"
+	MetricShock       = "shock"
+)
+
+// SensorReading is one reading of a sensor: Temperature in degrees Celsius,
+// relative Humidity in percent and Shock in g. Signature is the base64
+// signature of the registered device DeviceID over the reading, see
+// readingMessage.
+type SensorReading struct {
+	DeviceID    string  `json:"DeviceID"`
+	Timestamp   string  `json:"Timestamp"`
+	Temperature float64 `json:"Temperature"`
+	Humidity    float64 `json:"Humidity"`
+	Shock       float64 `json:"Shock"`
+	Signature   string  `json:"Signature"`
+}
+
+// TelemetryRange is the range of conditions products of SKU tolerate. Only
+// members of OrgID, the org that first set it, can change it.
+type TelemetryRange struct {
+	DocType        string  `json:"DocType"`
+	RangeID        string  `json:"RangeID"`
+	SKU            string  `json:"SKU"`
+	OrgID          string  `json:"OrgID"`
+	MinTemperature float64 `json:"MinTemperature"`
+	MaxTemperature float64 `json:"MaxTemperature"`
+	MinHumidity    float64 `json:"MinHumidity"`
+	MaxHumidity    float64 `json:"MaxHumidity"`
+	MaxShock       float64 `json:"MaxShock"`
+	SetBy          string  `json:"SetBy"`
+}
+
+// Excursion is a reading outside the range of the product's SKU.
+type Excursion struct {
+	ProductID string  `json:"ProductID"`
+	DeviceID  string  `json:"DeviceID"`
+	Timestamp string  `json:"Timestamp"`
+	Metric    string  `json:"Metric"`
+	Value     float64 `json:"Value"`
+	Min       float64 `json:"Min"`
+	Max       float64 `json:"Max"`
+}
+
+// TelemetryBatch is a batch of readings reported for TargetID, a product or
+// a container, and applies to ProductIDs. Ranges are the ranges in force for
+// the SKUs of the products when the batch was recorded, which its readings
+// were checked against. Batches recorded before ranges were kept have none.
+type TelemetryBatch struct {
+	DocType    string           `json:"DocType"`
+	BatchID    string           `json:"BatchID"`
+	TargetID   string           `json:"TargetID"`
+	ProductIDs []string         `json:"ProductIDs"`
+	ReporterID string           `json:"ReporterID"`
+	Readings   []SensorReading  `json:"Readings"`
+	Excursions []Excursion      `json:"Excursions"`
+	Ranges     []TelemetryRange `json:"Ranges"`
+	RecordedAt string           `json:"RecordedAt"`
+}
+
+// rangeOf returns the range the batch checked readings of sku against, or
+// nil when the SKU had none.
+func (b *TelemetryBatch) rangeOf(sku string) *TelemetryRange {
+	for i := range b.Ranges {
+		if b.Ranges[i].SKU == sku {
+			return &b.Ranges[i]
+		}
+	}
+	return nil
+}
+
+// ComplianceReport sums up the conditions a product was shipped in. Range is
+// the range in force when its latest telemetry was recorded, or the current
+// range when it has none.
+type ComplianceReport struct {
+	ProductID      string          `json:"ProductID"`
+	SKU            string          `json:"SKU"`
+	Range          *TelemetryRange `json:"Range,omitempty"`
+	ReadingCount   int             `json:"ReadingCount"`
+	FirstReading   string          `json:"FirstReading"`
+	LastReading    string          `json:"LastReading"`
+	MinTemperature float64         `json:"MinTemperature"`
+	MaxTemperature float64         `json:"MaxTemperature"`
+	MinHumidity    float64         `json:"MinHumidity"`
+	MaxHumidity    float64         `json:"MaxHumidity"`
+	MaxShock       float64         `json:"MaxShock"`
+	Excursions     []Excursion     `json:"Excursions"`
+	Compliant      bool            `json:"Compliant"`
+}
+
+func telemetryRangeID(sku string) string {
+	return "TelemetryRange" + sku
+}
+
+func finite(values ...float64) bool {
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateTelemetryRange(r *TelemetryRange) error {
+	if len(r.SKU) == 0 {
+		return errValidation("sku must be provided")
+	}
+	if !finite(r.MinTemperature, r.MaxTemperature, r.MinHumidity, r.MaxHumidity, r.MaxShock) {
+		return errValidation("range bounds must be numbers")
+	}
+	if r.MinTemperature > r.MaxTemperature {
+		return errValidation("minimum temperature is above the maximum")
+	}
+	if r.MinHumidity < 0 || r.MaxHumidity > 100 || r.MinHumidity > r.MaxHumidity {
+		return errValidation("humidity range must lie within 0 to 100 percent")
+	}
+	if r.MaxShock <= 0 {
+		return errValidation("maximum shock must be positive")
+	}
+	return nil
+}
+
+func validateReading(i int, reading *SensorReading) error {
+	if len(reading.DeviceID) == 0 {
+		return errValidation("reading %d needs a device id", i+1)
+	}
+	_, err := time.Parse(time.RFC3339, reading.Timestamp)
+	if err != nil {
+		return errValidation("reading %d timestamp must be RFC 3339: %s", i+1, err.Error())
+	}
+	if !finite(reading.Temperature, reading.Humidity, reading.Shock) {
+		return errValidation("reading %d values must be numbers", i+1)
+	}
+	if reading.Humidity < 0 || reading.Humidity > 100 || reading.Shock < 0 {
+		return errValidation("reading %d is out of the physical range", i+1)
+	}
+	return nil
+}
+
+// loadTelemetryRange returns the range of sku, or nil when none is set.
+func loadTelemetryRange(ctx contractapi.TransactionContextInterface, sku string) (*TelemetryRange, error) {
+	r, err := LoadTelemetryRange(ctx, telemetryRangeID(sku))
+	if hasCode(err, CodeNotFound) {
+		return nil, nil
+	}
+	return r, err
+}
+
+// excursions returns the values of reading outside r, flagged for productID.
+func excursions(productID string, r *TelemetryRange, reading SensorReading) []Excursion {
+	found := []Excursion{}
+	check := func(metric string, value float64, min float64, max float64) {
+		if value < min || value > max {
+			found = append(found, Excursion{ProductID: productID, DeviceID: reading.DeviceID, Timestamp: reading.Timestamp, Metric: metric, Value: value, Min: min, Max: max})
+		}
+	}
+	check(MetricTemperature, reading.Temperature, r.MinTemperature, r.MaxTemperature)
+	check(MetricHumidity, reading.Humidity, r.MinHumidity, r.MaxHumidity)
+	check(MetricShock, reading.Shock, 0, r.MaxShock)
+	return found
+}
+
+// telemetryProducts returns the products targetID stands for: the product
+// itself, or the products loaded in the container.
+func telemetryProducts(ctx contractapi.TransactionContextInterface, targetID string) ([]*Product, error) {
+	product, err := LoadProduct(ctx, targetID)
+	if err == nil {
+		return []*Product{product}, nil
+	}
+	if !hasCode(err, CodeNotFound) {
+		return nil, err
+	}
+
+	ids, err := indexedIDs(ctx, containerIndex, targetID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errNotFound("%s is neither a product nor a loaded container", targetID)
+	}
+	products := []*Product{}
+	for _, id := range ids {
+		product, err := LoadProduct(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+// authenticateReporter authenticates userID with the password in the
+// transient map.
+func authenticateReporter(ctx contractapi.TransactionContextInterface, args []string, userID string) (*User, error) {
+	user, err := authenticate(ctx, args, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// requireHolder checks that user belongs to the org holding product and may
+// report on it.
+func requireHolder(ctx contractapi.TransactionContextInterface, user *User, product *Product) error {
+	err := authorize(ctx, user, ActionRecordTelemetry, product.Status)
+	if err != nil {
+		return err
+	}
+	if user.OrgID != product.HolderOrgID {
+		return errForbiddenRole("only members of %s, holding %s, can report on it", product.HolderOrgID, product.ProductID)
+	}
+	return requireClientOrg(ctx, product.HolderOrgID, "report on this product")
+}
+
+// SetTelemetryRange sets the conditions products of telemetryRange.SKU
+// tolerate. The org of the first user to set the range of a SKU owns it, and
+// only its members can change it later. The user authenticates with the
+// password in the transient map.
+func (t *SupplyChain) SetTelemetryRange(ctx contractapi.TransactionContextInterface, userID string, telemetryRange TelemetryRange) error {
+	user, err := authenticate(ctx, []string{userID, telemetryRange.SKU}, userID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+	err = authorize(ctx, user, ActionSetTelemetryRange, telemetryRange.SKU)
+	if err != nil {
+		return err
+	}
+	err = requireClientOrg(ctx, user.OrgID, "set telemetry ranges")
+	if err != nil {
+		return err
+	}
+
+	err = validateTelemetryRange(&telemetryRange)
+	if err != nil {
+		return err
+	}
+	current, err := loadTelemetryRange(ctx, telemetryRange.SKU)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		owner := current.OrgID
+		if owner == "" {
+			// Ranges set before they were owned belong to the org of the
+			// user who set them
+			setBy, err := LoadUser(ctx, current.SetBy)
+			if err != nil {
+				return err
+			}
+			owner = setBy.OrgID
+		}
+		if owner != user.OrgID {
+			return errForbiddenRole("the range of %s is owned by %s", telemetryRange.SKU, owner)
+		}
+	}
+
+	telemetryRange.RangeID = telemetryRangeID(telemetryRange.SKU)
+	telemetryRange.OrgID = user.OrgID
+	telemetryRange.SetBy = user.UserID
+	err = SaveTelemetryRange(ctx, &telemetryRange)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		// Only the owning org endorses later changes of the range
+		return setKeyEndorsers(ctx, telemetryRange.RangeID, telemetryRange.OrgID)
+	}
+	return nil
+}
+
+func (t *SupplyChain) QueryTelemetryRange(ctx contractapi.TransactionContextInterface, sku string) (*TelemetryRange, error) {
+	return LoadTelemetryRange(ctx, telemetryRangeID(sku))
+}
+
+// AssignContainer loads productIDs into containerID, so that telemetry
+// reported for the container covers them. An empty containerID unloads
+// them. The user must belong to the org holding the products and
+// authenticates with the password in the transient map.
+func (t *SupplyChain) AssignContainer(ctx contractapi.TransactionContextInterface, userID string, containerID string, productIDs []string) error {
+	if len(productIDs) == 0 {
+		return errValidation("at least one product must be given")
+	}
+	user, err := authenticateReporter(ctx, append([]string{userID, containerID}, productIDs...), userID)
+	if err != nil {
+		return err
+	}
+	if containerID != "" {
+		_, err = LoadProduct(ctx, containerID)
+		if err == nil {
+			return errValidation("container id %s is a product id", containerID)
+		}
+	}
+
+	for _, productID := range productIDs {
+		product, err := LoadProduct(ctx, productID)
+		if err != nil {
+			return err
+		}
+		err = requireHolder(ctx, user, product)
+		if err != nil {
+			return err
+		}
+
+		if product.ContainerID != "" {
+			err = deleteIndex(ctx, containerIndex, product.ContainerID, product.ProductID)
+			if err != nil {
+				return err
+			}
+		}
+		product.ContainerID = containerID
+		if containerID != "" {
+			err = putIndex(ctx, containerIndex, containerID, product.ProductID)
+			if err != nil {
+				return err
+			}
+		}
+		err = SaveProduct(ctx, product)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordTelemetry stores readings reported for targetID, a product or a
+// container, checks them against the range of each product's SKU and flags
+// the excursions. Every reading must be signed by a registered device
+// assigned to targetID. The reporter must belong to the org holding the
+// products and authenticates with the password in the transient map. It
+// returns the batch id.
+func (t *SupplyChain) RecordTelemetry(ctx contractapi.TransactionContextInterface, reporterID string, targetID string, readings []SensorReading) (string, error) {
+	if len(readings) == 0 || len(readings) > maxTelemetryBatch {
+		return "", errValidation("a batch holds 1 to %d readings", maxTelemetryBatch)
+	}
+	for i := range readings {
+		err := validateReading(i, &readings[i])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	reporter, err := authenticateReporter(ctx, []string{reporterID, targetID}, reporterID)
+	if err != nil {
+		return "", err
+	}
+	products, err := telemetryProducts(ctx, targetID)
+	if err != nil {
+		return "", err
+	}
+	err = verifyReadings(ctx, targetID, readings)
+	if err != nil {
+		return "", err
+	}
+
+	batchCounter, err := incrementCounter(ctx, "TelemetryCounterNO")
+	if err != nil {
+		return "", err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	batch := TelemetryBatch{
+		BatchID:    "Telemetry" + strconv.Itoa(batchCounter),
+		TargetID:   targetID,
+		ProductIDs: []string{},
+		ReporterID: reporter.UserID,
+		Readings:   readings,
+		Excursions: []Excursion{},
+		Ranges:     []TelemetryRange{},
+		RecordedAt: now.Format(time.RFC3339),
+	}
+
+	for _, product := range products {
+		err = requireHolder(ctx, reporter, product)
+		if err != nil {
+			return "", err
+		}
+		batch.ProductIDs = append(batch.ProductIDs, product.ProductID)
+
+		r := batch.rangeOf(product.SKU)
+		if r == nil {
+			r, err = loadTelemetryRange(ctx, product.SKU)
+			if err != nil {
+				return "", err
+			}
+			if r != nil {
+				batch.Ranges = append(batch.Ranges, *r)
+			}
+		}
+		if r != nil {
+			found := []Excursion{}
+			for _, reading := range readings {
+				found = append(found, excursions(product.ProductID, r, reading)...)
+			}
+			if len(found) > 0 {
+				product.Excursions += len(found)
+				err = SaveProduct(ctx, product)
+				if err != nil {
+					return "", err
+				}
+				batch.Excursions = append(batch.Excursions, found...)
+			}
+		}
+
+		err = putIndex(ctx, telemetryIndex, product.ProductID, batch.BatchID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = SaveTelemetryBatch(ctx, &batch)
+	if err != nil {
+		return "", err
+	}
+
+	if len(batch.Excursions) > 0 {
+		payload, err := json.Marshal(batch.Excursions)
+		if err != nil {
+			return "", errInternal("marshal error for excursions: %s", err.Error())
+		}
+		err = ctx.GetStub().SetEvent(TelemetryExcursionEvent, payload)
+		if err != nil {
+			return "", errInternal("failed to emit %s event: %s", TelemetryExcursionEvent, err.Error())
+		}
+	}
+	return batch.BatchID, nil
+}
+
+func (t *SupplyChain) QueryTelemetryBatch(ctx contractapi.TransactionContextInterface, batchID string) (*TelemetryBatch, error) {
+	return LoadTelemetryBatch(ctx, batchID)
+}
+
+// QueryComplianceReport sums up every reading covering productID during its
+// shipment and whether it stayed within the range of its SKU. Each batch is
+// judged by the range in force when it was recorded, so a later change of
+// the range does not change the verdict. Batches recorded before ranges were
+// kept with them are judged by the current range.
+func (t *SupplyChain) QueryComplianceReport(ctx contractapi.TransactionContextInterface, productID string) (*ComplianceReport, error) {
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := loadTelemetryRange(ctx, product.SKU)
+	if err != nil {
+		return nil, err
+	}
+	batchIDs, err := indexedIDs(ctx, telemetryIndex, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ComplianceReport{
+		ProductID:  productID,
+		SKU:        product.SKU,
+		Range:      current,
+		Excursions: []Excursion{},
+	}
+	checked := true
+	latest := ""
+	var first, last time.Time
+	for _, batchID := range batchIDs {
+		batch, err := LoadTelemetryBatch(ctx, batchID)
+		if err != nil {
+			return nil, err
+		}
+		r := current
+		if batch.Ranges != nil {
+			r = batch.rangeOf(product.SKU)
+		}
+		if r == nil {
+			checked = false
+		}
+		if batch.RecordedAt >= latest {
+			latest = batch.RecordedAt
+			report.Range = r
+		}
+
+		for _, reading := range batch.Readings {
+			at, _ := time.Parse(time.RFC3339, reading.Timestamp)
+			if report.ReadingCount == 0 {
+				first, last = at, at
+				report.MinTemperature, report.MaxTemperature = reading.Temperature, reading.Temperature
+				report.MinHumidity, report.MaxHumidity = reading.Humidity, reading.Humidity
+			}
+			report.ReadingCount++
+			if at.Before(first) {
+				first = at
+			}
+			if at.After(last) {
+				last = at
+			}
+			report.MinTemperature = math.Min(report.MinTemperature, reading.Temperature)
+			report.MaxTemperature = math.Max(report.MaxTemperature, reading.Temperature)
+			report.MinHumidity = math.Min(report.MinHumidity, reading.Humidity)
+			report.MaxHumidity = math.Max(report.MaxHumidity, reading.Humidity)
+			report.MaxShock = math.Max(report.MaxShock, reading.Shock)
+		}
+		for _, excursion := range batch.Excursions {
+			if excursion.ProductID == productID {
+				report.Excursions = append(report.Excursions, excursion)
+			}
+		}
+	}
+
+	if report.ReadingCount > 0 {
+		report.FirstReading = first.Format(time.RFC3339)
+		report.LastReading = last.Format(time.RFC3339)
+	}
+	report.Compliant = checked && report.ReadingCount > 0 && len(report.Excursions) == 0
+	return report, nil
+}
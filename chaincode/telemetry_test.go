@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestExcursions(t *testing.T) {
+	r := &TelemetryRange{SKU: "Vaccine", MinTemperature: 2, MaxTemperature: 8, MinHumidity: 20, MaxHumidity: 80, MaxShock: 3}
+	tests := []struct {
+		name    string
+		reading SensorReading
+		want    []string
+	}{
+		{"within range", SensorReading{Temperature: 5, Humidity: 50, Shock: 1}, []string{}},
+		{"on the bounds", SensorReading{Temperature: 8, Humidity: 20, Shock: 3}, []string{}},
+		{"too warm", SensorReading{Temperature: 8.1, Humidity: 50}, []string{MetricTemperature}},
+		{"too cold and dry", SensorReading{Temperature: 1.9, Humidity: 19}, []string{MetricTemperature, MetricHumidity}},
+		{"dropped", SensorReading{Temperature: 5, Humidity: 50, Shock: 3.5}, []string{MetricShock}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := []string{}
+			for _, excursion := range excursions("Product1", r, tt.reading) {
+				metrics = append(metrics, excursion.Metric)
+			}
+			if !reflect.DeepEqual(metrics, tt.want) {
+				t.Errorf("excursions on %v, want %v", metrics, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTelemetryRange(t *testing.T) {
+	valid := TelemetryRange{SKU: "Vaccine", MinTemperature: 2, MaxTemperature: 8, MinHumidity: 20, MaxHumidity: 80, MaxShock: 3}
+	tests := []struct {
+		name   string
+		change func(*TelemetryRange)
+		valid  bool
+	}{
+		{"valid", func(r *TelemetryRange) {}, true},
+		{"no sku", func(r *TelemetryRange) { r.SKU = "" }, false},
+		{"inverted temperatures", func(r *TelemetryRange) { r.MinTemperature = 9 }, false},
+		{"humidity above 100", func(r *TelemetryRange) { r.MaxHumidity = 101 }, false},
+		{"no shock tolerance", func(r *TelemetryRange) { r.MaxShock = 0 }, false},
+		{"not a number", func(r *TelemetryRange) { r.MaxTemperature = math.NaN() }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid
+			tt.change(&r)
+			err := validateTelemetryRange(&r)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateTelemetryRange error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestBatchRangeOf(t *testing.T) {
+	batch := TelemetryBatch{Ranges: []TelemetryRange{{SKU: "Vaccine", MaxShock: 3}, {SKU: "Insulin", MaxShock: 2}}}
+	if r := batch.rangeOf("Insulin"); r == nil || r.MaxShock != 2 {
+		t.Errorf("rangeOf(Insulin) = %+v", r)
+	}
+	if r := batch.rangeOf("Plasma"); r != nil {
+		t.Errorf("rangeOf(Plasma) = %+v, want nil", r)
+	}
+}
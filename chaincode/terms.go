@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- commercial terms ------------------------------------------
+
+// CommercialTermsCollection is the private data collection that holds prices
+// and contract terms. It is declared in collections_config.json, a template
+// whose member orgs must be edited to match the orgs of the channel.
+const CommercialTermsCollection = "collectionCommercialTerms"
+
+// TransientTermsKey is the transient map entry carrying CommercialTerms.
+const TransientTermsKey = "commercial_terms"
+
+// CommercialTerms is kept off the public ledger. Only its hash is stored on
+// the product, so counterparties holding the terms can prove what was agreed.
+// Salt must be a random value chosen by the submitter; without it a low
+// entropy price could be recovered from the public hash by brute force.
+// DiscountBps is the discount in basis points, 250 being 2.5%.
+type CommercialTerms struct {
+	ProductID     string `json:"ProductID"`
+	Price         Money  `json:"Price"`
+	DiscountBps   int    `json:"DiscountBps"`
+	BuyerID       string `json:"BuyerID"`
+	SellerID      string `json:"SellerID"`
+	ContractTerms string `json:"ContractTerms"`
+	Salt          string `json:"Salt"`
+}
+
+// UnmarshalJSON also decodes the percentage Discount terms carried before
+// discounts were stored in basis points.
+func (c *CommercialTerms) UnmarshalJSON(data []byte) error {
+	type plain CommercialTerms
+	var fields struct {
+		plain
+		Discount *json.Number `json:"Discount"`
+	}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	*c = CommercialTerms(fields.plain)
+	if fields.Discount == nil {
+		return nil
+	}
+
+	pct, ok := new(big.Rat).SetString(fields.Discount.String())
+	if !ok {
+		return errValidation("discount %q is not a number", fields.Discount.String())
+	}
+	bps := pct.Mul(pct, big.NewRat(100, 1))
+	if !bps.IsInt() || !bps.Num().IsInt64() {
+		return errValidation("discount %s%% is finer than a basis point", fields.Discount.String())
+	}
+	c.DiscountBps = int(bps.Num().Int64())
+	return nil
+}
+
+func validateTerms(terms *CommercialTerms) error {
+	err := validateMoney(terms.Price, "price")
+	if err != nil {
+		return err
+	}
+	if terms.DiscountBps < 0 || terms.DiscountBps > 10000 {
+		return errValidation("discount must be between 0 and 10000 basis points")
+	}
+	if len(terms.Salt) == 0 {
+		return errValidation("commercial terms must include a salt")
+	}
+	return nil
+}
+
+// termsHash returns the hex encoded SHA-256 of the canonical JSON encoding of
+// terms, which is exactly what is stored in the private collection.
+func termsHash(terms *CommercialTerms) (string, []byte, error) {
+	data, err := json.Marshal(terms)
+	if err != nil {
+		return "", nil, errInternal("marshal error for commercial terms: %s", err.Error())
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
+
+// readTransientTerms decodes and validates the commercial terms passed in the
+// transient map for productID.
+func readTransientTerms(ctx contractapi.TransactionContextInterface, productID string) (*CommercialTerms, error) {
+	terms := new(CommercialTerms)
+	err := transientJSON(ctx, TransientTermsKey, terms)
+	if err != nil {
+		return nil, err
+	}
+
+	if terms.ProductID != "" && terms.ProductID != productID {
+		return nil, errValidation("commercial terms are for %s, not %s", terms.ProductID, productID)
+	}
+	terms.ProductID = productID
+
+	err = validateTerms(terms)
+	if err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// saveCommercialTerms writes terms to the private collection and returns the
+// hash to be recorded on the public product.
+func saveCommercialTerms(ctx contractapi.TransactionContextInterface, terms *CommercialTerms) (string, error) {
+	hash, data, err := termsHash(terms)
+	if err != nil {
+		return "", err
+	}
+
+	err = ctx.GetStub().PutPrivateData(CommercialTermsCollection, terms.ProductID, data)
+	if err != nil {
+		return "", errInternal("failed to put commercial terms for %s: %s", terms.ProductID, err.Error())
+	}
+	return hash, nil
+}
+
+// LoadCommercialTerms reads the private terms of productID. It only succeeds
+// on peers of orgs that are members of the collection.
+func LoadCommercialTerms(ctx contractapi.TransactionContextInterface, productID string) (*CommercialTerms, error) {
+	data, err := ctx.GetStub().GetPrivateData(CommercialTermsCollection, productID)
+	if err != nil {
+		return nil, errInternal("failed to read commercial terms for %s: %s", productID, err.Error())
+	}
+	if data == nil {
+		return nil, errNotFound("can not find commercial terms for product: %s", productID)
+	}
+
+	terms := new(CommercialTerms)
+	err = json.Unmarshal(data, terms)
+	if err != nil {
+		return nil, errInternal("unmarshalling error for commercial terms %s: %s", productID, err.Error())
+	}
+	return terms, nil
+}
+
+func (t *SupplyChain) QueryCommercialTerms(ctx contractapi.TransactionContextInterface, productID string) (*CommercialTerms, error) {
+	return LoadCommercialTerms(ctx, productID)
+}
+
+// VerifyCommercialTerms checks the terms passed in the transient map against
+// the hash on the public product without revealing them to the ledger. The
+// terms are not validated, and terms stored in an older format, such as float
+// prices, verify when passed exactly as they were stored.
+func (t *SupplyChain) VerifyCommercialTerms(ctx contractapi.TransactionContextInterface, productID string) (bool, error) {
+	product, err := LoadProduct(ctx, productID)
+	if err != nil {
+		return false, err
+	}
+
+	raw, err := transientValue(ctx, TransientTermsKey)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(raw)
+	if product.TermsHash != "" && hex.EncodeToString(sum[:]) == product.TermsHash {
+		return true, nil
+	}
+
+	terms := new(CommercialTerms)
+	err = transientJSON(ctx, TransientTermsKey, terms)
+	if err != nil {
+		return false, err
+	}
+	if terms.ProductID == "" {
+		terms.ProductID = productID
+	}
+	if terms.ProductID != productID {
+		return false, nil
+	}
+
+	hash, _, err := termsHash(terms)
+	if err != nil {
+		return false, err
+	}
+	return hash == product.TermsHash, nil
+}
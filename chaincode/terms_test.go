@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCommercialTermsLegacyDiscount(t *testing.T) {
+	tests := []struct {
+		data  string
+		want  int
+		valid bool
+	}{
+		{`{"DiscountBps": 250}`, 250, true},
+		{`{"Discount": 2.5}`, 250, true},
+		{`{"Discount": 5}`, 500, true},
+		{`{"Discount": 0.01}`, 1, true},
+		{`{"Discount": 0}`, 0, true},
+		{`{}`, 0, true},
+		{`{"Discount": 0.005}`, 0, false},
+		{`{"Discount": "five"}`, 0, false},
+	}
+	for _, tt := range tests {
+		var terms CommercialTerms
+		err := json.Unmarshal([]byte(tt.data), &terms)
+		if (err == nil) != tt.valid {
+			t.Errorf("Unmarshal(%s) error = %v, want valid %v", tt.data, err, tt.valid)
+			continue
+		}
+		if terms.DiscountBps != tt.want {
+			t.Errorf("Unmarshal(%s) DiscountBps = %d, want %d", tt.data, terms.DiscountBps, tt.want)
+		}
+	}
+}
+
+func TestLegacyTermsKeepOtherFields(t *testing.T) {
+	var terms CommercialTerms
+	err := json.Unmarshal([]byte(`{"ProductID": "Product1", "Price": 12.5, "Discount": 10, "SellerID": "User2", "Salt": "s"}`), &terms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CommercialTerms{ProductID: "Product1", Price: Money{Units: 125, Scale: 1}, DiscountBps: 1000, SellerID: "User2", Salt: "s"}
+	if terms != want {
+		t.Errorf("Unmarshal = %+v, want %+v", terms, want)
+	}
+}
+
+func TestValidateTerms(t *testing.T) {
+	price := Money{Units: 1250, Scale: 2, Currency: "EUR"}
+	tests := []struct {
+		name  string
+		terms CommercialTerms
+		valid bool
+	}{
+		{"valid", CommercialTerms{Price: price, DiscountBps: 250, Salt: "s"}, true},
+		{"full discount", CommercialTerms{Price: price, DiscountBps: 10000, Salt: "s"}, true},
+		{"discount above 100%", CommercialTerms{Price: price, DiscountBps: 10001, Salt: "s"}, false},
+		{"negative discount", CommercialTerms{Price: price, DiscountBps: -1, Salt: "s"}, false},
+		{"no salt", CommercialTerms{Price: price}, false},
+		{"price without currency", CommercialTerms{Price: Money{Units: 125, Scale: 1}, Salt: "s"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTerms(&tt.terms)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateTerms error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
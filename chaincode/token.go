@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+//  ---------------------------- reference token ------------------------------------------
+
+// TokenContract is a minimal fungible token implementing the escrow interface
+// the supply chain calls, see escrow.go. It is shipped in the same chaincode
+// package so that a single peer can run both by installing the package twice,
+// once under the token chaincode name. Production networks point the
+// escrow.token_chaincode parameter at their own token chaincode exposing the
+// same functions.
+type TokenContract struct {
+	contractapi.Contract
+}
+
+// Composite key prefixes of the token state.
+const (
+	tokenBalancePrefix   = "token~balance"
+	tokenAllowancePrefix = "token~allowance"
+	tokenHoldPrefix      = "token~hold"
+	tokenAgentKey        = "TokenEscrowAgent"
+)
+
+// Token hold statuses.
+const (
+	HoldStatusLocked   = "Locked"
+	HoldStatusReleased = "Released"
+	HoldStatusRefunded = "Refunded"
+)
+
+// TokenHold is an amount taken from Payer and held until it is released to
+// Payee or refunded.
+type TokenHold struct {
+	EscrowID string `json:"EscrowID"`
+	Payer    string `json:"Payer"`
+	Payee    string `json:"Payee"`
+	Amount   int64  `json:"Amount"`
+	Status   string `json:"Status"`
+}
+
+func tokenKey(ctx contractapi.TransactionContextInterface, prefix string, attributes ...string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(prefix, attributes)
+	if err != nil {
+		return "", errInternal("failed to create %s key: %s", prefix, err.Error())
+	}
+	return key, nil
+}
+
+func readTokenAmount(ctx contractapi.TransactionContextInterface, prefix string, attributes ...string) (int64, error) {
+	key, err := tokenKey(ctx, prefix, attributes...)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, errInternal("failed to read %s: %s", prefix, err.Error())
+	}
+	if data == nil {
+		return 0, nil
+	}
+	amount, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, errInternal("corrupt %s %s: %s", prefix, key, err.Error())
+	}
+	return amount, nil
+}
+
+func writeTokenAmount(ctx contractapi.TransactionContextInterface, amount int64, prefix string, attributes ...string) error {
+	key, err := tokenKey(ctx, prefix, attributes...)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, []byte(strconv.FormatInt(amount, 10)))
+	if err != nil {
+		return errInternal("failed to write %s: %s", prefix, err.Error())
+	}
+	return nil
+}
+
+// addBalance adds delta to the balance of account, refusing overdrafts.
+func addBalance(ctx contractapi.TransactionContextInterface, account string, delta int64) error {
+	balance, err := readTokenAmount(ctx, tokenBalancePrefix, account)
+	if err != nil {
+		return err
+	}
+	if balance+delta < 0 {
+		return errInvalidTransition("account %s holds %d, can not debit %d", account, balance, -delta)
+	}
+	return writeTokenAmount(ctx, balance+delta, tokenBalancePrefix, account)
+}
+
+func requirePositiveAmount(amount int64) error {
+	if amount <= 0 {
+		return errValidation("amount must be positive, got %d", amount)
+	}
+	return nil
+}
+
+// clientAccount is the token account of the submitting identity.
+func clientAccount(ctx contractapi.TransactionContextInterface) (string, error) {
+	id, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", errInternal("failed to read client identity: %s", err.Error())
+	}
+	return id, nil
+}
+
+// proposalChaincode returns the name of the chaincode the client's proposal
+// targeted. When the token is called through InvokeChaincode this is the
+// calling chaincode.
+func proposalChaincode(ctx contractapi.TransactionContextInterface) (string, error) {
+	signedProposal, err := ctx.GetStub().GetSignedProposal()
+	if err != nil || signedProposal == nil {
+		return "", errInternal("failed to read signed proposal")
+	}
+
+	proposal := &peer.Proposal{}
+	err = proto.Unmarshal(signedProposal.ProposalBytes, proposal)
+	if err != nil {
+		return "", errInternal("failed to unmarshal proposal: %s", err.Error())
+	}
+	header := &common.Header{}
+	err = proto.Unmarshal(proposal.Header, header)
+	if err != nil {
+		return "", errInternal("failed to unmarshal proposal header: %s", err.Error())
+	}
+	channelHeader := &common.ChannelHeader{}
+	err = proto.Unmarshal(header.ChannelHeader, channelHeader)
+	if err != nil {
+		return "", errInternal("failed to unmarshal channel header: %s", err.Error())
+	}
+	extension := &peer.ChaincodeHeaderExtension{}
+	err = proto.Unmarshal(channelHeader.Extension, extension)
+	if err != nil {
+		return "", errInternal("failed to unmarshal chaincode header: %s", err.Error())
+	}
+	if extension.ChaincodeId == nil {
+		return "", errInternal("proposal names no chaincode")
+	}
+	return extension.ChaincodeId.Name, nil
+}
+
+// requireEscrowAgent refuses calls that do not come through the escrow agent
+// chaincode.
+func requireEscrowAgent(ctx contractapi.TransactionContextInterface) (string, error) {
+	agent, err := ctx.GetStub().GetState(tokenAgentKey)
+	if err != nil {
+		return "", errInternal("failed to read escrow agent: %s", err.Error())
+	}
+	if agent == nil {
+		return "", errInvalidTransition("no escrow agent is set")
+	}
+
+	caller, err := proposalChaincode(ctx)
+	if err != nil {
+		return "", err
+	}
+	if caller != string(agent) {
+		return "", errForbiddenRole("only chaincode %s can move escrowed funds", string(agent))
+	}
+	return caller, nil
+}
+
+func loadHold(ctx contractapi.TransactionContextInterface, escrowID string) (string, *TokenHold, error) {
+	key, err := tokenKey(ctx, tokenHoldPrefix, escrowID)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", nil, errInternal("failed to read hold %s: %s", escrowID, err.Error())
+	}
+	if data == nil {
+		return key, nil, nil
+	}
+	hold := new(TokenHold)
+	err = json.Unmarshal(data, hold)
+	if err != nil {
+		return "", nil, errInternal("unmarshalling error for hold %s: %s", escrowID, err.Error())
+	}
+	return key, hold, nil
+}
+
+// settleHold pays a locked hold out to account and marks it status.
+func settleHold(ctx contractapi.TransactionContextInterface, escrowID string, status string) error {
+	_, err := requireEscrowAgent(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, hold, err := loadHold(ctx, escrowID)
+	if err != nil {
+		return err
+	}
+	if hold == nil {
+		return errNotFound("can not find hold: %s", escrowID)
+	}
+	if hold.Status != HoldStatusLocked {
+		return errInvalidTransition("hold %s is %s", escrowID, hold.Status)
+	}
+
+	account := hold.Payee
+	if status == HoldStatusRefunded {
+		account = hold.Payer
+	}
+	err = addBalance(ctx, account, hold.Amount)
+	if err != nil {
+		return err
+	}
+
+	hold.Status = status
+	return writeState(ctx, key, "hold", hold)
+}
+
+// Mint credits amount to account. Only the deployer can mint.
+func (c *TokenContract) Mint(ctx contractapi.TransactionContextInterface, account string, amount int64) error {
+	err := requireDeployer(ctx)
+	if err != nil {
+		return err
+	}
+	err = requirePositiveAmount(amount)
+	if err != nil {
+		return err
+	}
+	return addBalance(ctx, account, amount)
+}
+
+// ClientAccountID returns the token account of the caller.
+func (c *TokenContract) ClientAccountID(ctx contractapi.TransactionContextInterface) (string, error) {
+	return clientAccount(ctx)
+}
+
+func (c *TokenContract) BalanceOf(ctx contractapi.TransactionContextInterface, account string) (int64, error) {
+	return readTokenAmount(ctx, tokenBalancePrefix, account)
+}
+
+// Transfer moves amount from the caller's account to the account to.
+func (c *TokenContract) Transfer(ctx contractapi.TransactionContextInterface, to string, amount int64) error {
+	err := requirePositiveAmount(amount)
+	if err != nil {
+		return err
+	}
+	from, err := clientAccount(ctx)
+	if err != nil {
+		return err
+	}
+	// Both balances are read before either is written, so a transfer to the
+	// caller's own account would credit it without the debit
+	if to == from {
+		return errValidation("can not transfer to your own account")
+	}
+	err = addBalance(ctx, from, -amount)
+	if err != nil {
+		return err
+	}
+	return addBalance(ctx, to, amount)
+}
+
+// Approve lets the chaincode spender lock up to amount of the caller's funds
+// in escrow.
+func (c *TokenContract) Approve(ctx contractapi.TransactionContextInterface, spender string, amount int64) error {
+	if amount < 0 {
+		return errValidation("allowance can not be negative")
+	}
+	owner, err := clientAccount(ctx)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, amount, tokenAllowancePrefix, owner, spender)
+}
+
+func (c *TokenContract) Allowance(ctx contractapi.TransactionContextInterface, owner string, spender string) (int64, error) {
+	return readTokenAmount(ctx, tokenAllowancePrefix, owner, spender)
+}
+
+// SetEscrowAgent names the chaincode allowed to lock, release and refund
+// escrowed funds. Only the deployer can set it.
+func (c *TokenContract) SetEscrowAgent(ctx contractapi.TransactionContextInterface, chaincodeName string) error {
+	err := requireDeployer(ctx)
+	if err != nil {
+		return err
+	}
+	if len(chaincodeName) == 0 {
+		return errValidation("chaincode name must be provided")
+	}
+	err = ctx.GetStub().PutState(tokenAgentKey, []byte(chaincodeName))
+	if err != nil {
+		return errInternal("failed to write escrow agent: %s", err.Error())
+	}
+	return nil
+}
+
+// LockFrom takes amount from payer, within the allowance payer gave the
+// escrow agent, and holds it under escrowID for payee.
+func (c *TokenContract) LockFrom(ctx contractapi.TransactionContextInterface, escrowID string, payer string, payee string, amount int64) error {
+	agent, err := requireEscrowAgent(ctx)
+	if err != nil {
+		return err
+	}
+	err = requirePositiveAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	key, hold, err := loadHold(ctx, escrowID)
+	if err != nil {
+		return err
+	}
+	if hold != nil {
+		return errConflict("hold %s already exists", escrowID)
+	}
+
+	allowance, err := readTokenAmount(ctx, tokenAllowancePrefix, payer, agent)
+	if err != nil {
+		return err
+	}
+	if allowance < amount {
+		return errForbiddenRole("%s allowed %s to lock %d, not %d", payer, agent, allowance, amount)
+	}
+	err = writeTokenAmount(ctx, allowance-amount, tokenAllowancePrefix, payer, agent)
+	if err != nil {
+		return err
+	}
+	err = addBalance(ctx, payer, -amount)
+	if err != nil {
+		return err
+	}
+
+	return writeState(ctx, key, "hold", TokenHold{EscrowID: escrowID, Payer: payer, Payee: payee, Amount: amount, Status: HoldStatusLocked})
+}
+
+// Release pays the funds held under escrowID to the payee.
+func (c *TokenContract) Release(ctx contractapi.TransactionContextInterface, escrowID string) error {
+	return settleHold(ctx, escrowID, HoldStatusReleased)
+}
+
+// Refund returns the funds held under escrowID to the payer.
+func (c *TokenContract) Refund(ctx contractapi.TransactionContextInterface, escrowID string) error {
+	return settleHold(ctx, escrowID, HoldStatusRefunded)
+}
+
+func (c *TokenContract) QueryHold(ctx contractapi.TransactionContextInterface, escrowID string) (*TokenHold, error) {
+	_, hold, err := loadHold(ctx, escrowID)
+	if err != nil {
+		return nil, err
+	}
+	if hold == nil {
+		return nil, errNotFound("can not find hold: %s", escrowID)
+	}
+	return hold, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestTransfer(t *testing.T) {
+	const sender = "x509::CN=client::Org1MSP"
+	tests := []struct {
+		name   string
+		to     string
+		amount int64
+		want   map[string]int64
+		code   ErrorCode
+	}{
+		{"to another account", "Bob", 30, map[string]int64{sender: 70, "Bob": 30}, ""},
+		{"whole balance", "Bob", 100, map[string]int64{sender: 0, "Bob": 100}, ""},
+		{"overdraft", "Bob", 101, map[string]int64{sender: 100, "Bob": 0}, CodeInvalidStateTransition},
+		{"to itself", sender, 30, map[string]int64{sender: 100}, CodeValidationFailed},
+		{"nothing", "Bob", 0, map[string]int64{sender: 100, "Bob": 0}, CodeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			err := writeTokenAmount(l.ctx, 100, tokenBalancePrefix, sender)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.stub.commit()
+
+			err = l.submit("Org1MSP", "", func(ctx contractapi.TransactionContextInterface) error {
+				return new(TokenContract).Transfer(ctx, tt.to, tt.amount)
+			})
+			if tt.code == "" && err != nil || tt.code != "" && !hasCode(err, tt.code) {
+				t.Fatalf("Transfer error = %v, want %q", err, tt.code)
+			}
+			for account, want := range tt.want {
+				balance, err := new(TokenContract).BalanceOf(l.ctx, account)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if balance != want {
+					t.Errorf("balance of %s = %d, want %d", account, balance, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- transient ------------------------------------------
+
+// transientValue returns the raw value passed in the proposal's transient
+// map under key. Transient data is never written to the block, which makes it
+// the only safe channel for confidential input.
+func transientValue(ctx contractapi.TransactionContextInterface, key string) ([]byte, error) {
+	value, ok, err := lookupTransient(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errValidation("%s must be passed in the transient map", key)
+	}
+	return value, nil
+}
+
+// lookupTransient is transientValue for optional entries, it reports whether a
+// non-empty value was passed.
+func lookupTransient(ctx contractapi.TransactionContextInterface, key string) ([]byte, bool, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, false, errInternal("failed to read transient map: %s", err.Error())
+	}
+
+	value, ok := transientMap[key]
+	return value, ok && len(value) > 0, nil
+}
+
+// transientJSON decodes the JSON object passed in the transient map under key
+// into v.
+func transientJSON(ctx contractapi.TransactionContextInterface, key string, v any) error {
+	value, err := transientValue(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(value, v)
+	if err != nil {
+		return errValidation("transient %s is not valid JSON: %s", key, err.Error())
+	}
+	return nil
+}
+
+// Transient map entries for sensitive user input.
+const (
+	TransientPassword = "password"
+	TransientName     = "name"
+	TransientEmail    = "email"
+	TransientAddress  = "address"
+	TransientSalt     = "salt"
+
+	TransientNewPassword  = "new_password"
+	TransientPasswordSalt = "password_salt"
+)
+
+// readSensitive reads every key from the transient map and rejects the call
+// if any of the values was also passed as a regular argument, since that
+// would record it permanently in the block.
+func readSensitive(ctx contractapi.TransactionContextInterface, args []string, keys ...string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range keys {
+		value, err := transientValue(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = string(value)
+	}
+	err := rejectSensitiveArgs(args, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// readOptionalSensitive is readSensitive for optional entries. Keys missing
+// from the transient map are missing from the result as well.
+func readOptionalSensitive(ctx contractapi.TransactionContextInterface, args []string, keys ...string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, key := range keys {
+		value, ok, err := lookupTransient(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[key] = string(value)
+		}
+	}
+	err := rejectSensitiveArgs(args, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func rejectSensitiveArgs(args []string, keys []string, values map[string]string) error {
+	for _, arg := range args {
+		for _, key := range keys {
+			if value, ok := values[key]; ok && arg == value {
+				return errValidation("%s must only be passed in the transient map, not as an argument", key)
+			}
+		}
+	}
+	return nil
+}
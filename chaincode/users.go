@@ -0,0 +1,231 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+//  ---------------------------- user lifecycle ------------------------------------------
+
+// User statuses. Records created before statuses existed have none and are
+// treated as active.
+const (
+	UserStatusActive      = "Active"
+	UserStatusSuspended   = "Suspended"
+	UserStatusDeactivated = "Deactivated"
+)
+
+// newUserFromTransient allocates a user id for a new user of userType in the
+// caller's org. Its password and personal data are read from the transient
+// map. Nothing is written except the user counter.
+func newUserFromTransient(ctx contractapi.TransactionContextInterface, args []string, userType string) (*User, *UserPII, error) {
+	secrets, err := readSensitive(ctx, args, TransientName, TransientEmail, TransientAddress, TransientPassword, TransientSalt, TransientPasswordSalt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mspID, err := clientMSPID(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	userCounter, err := incrementCounter(ctx, "UserCounterNO")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user := &User{
+		UserID:   "User" + strconv.Itoa(userCounter),
+		UserType: userType,
+		MSPID:    mspID,
+		OrgID:    mspID,
+	}
+	exists, err := UserExists(ctx, user.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists {
+		return nil, nil, errConflict("user %s already exists", user.UserID)
+	}
+
+	err = setPassword(ctx, user, secrets[TransientPassword], secrets[TransientPasswordSalt])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pii := &UserPII{
+		Name:    secrets[TransientName],
+		Email:   secrets[TransientEmail],
+		Address: secrets[TransientAddress],
+		Salt:    secrets[TransientSalt],
+	}
+	return user, pii, nil
+}
+
+func userStatus(user *User) string {
+	if user.Status == "" {
+		return UserStatusActive
+	}
+	return user.Status
+}
+
+// requireActive refuses users that are suspended or deactivated.
+func requireActive(user *User) error {
+	status := userStatus(user)
+	if status != UserStatusActive {
+		return errForbiddenRole("user %s is %s", user.UserID, status)
+	}
+	return nil
+}
+
+func sameOrg(actor *User, user *User) bool {
+	return actor.OrgID != "" && actor.OrgID == user.OrgID
+}
+
+// authorizeUserChange allows the user itself, or a member of the same org the
+// ACL lets manage users of its type, to change the user.
+func authorizeUserChange(ctx contractapi.TransactionContextInterface, actor *User, user *User) error {
+	if actor.UserID == user.UserID {
+		return nil
+	}
+	if !sameOrg(actor, user) {
+		return errForbiddenRole("only %s or an admin of its org can change this user", user.UserID)
+	}
+	return authorize(ctx, actor, ActionManageUser, user.UserType)
+}
+
+// setUserStatus moves user to status on behalf of actorID, who authenticates
+// with the password in the transient map.
+func setUserStatus(ctx contractapi.TransactionContextInterface, actorID string, userID string, reason string, status string) error {
+	args := []string{actorID, userID, reason}
+	actor, err := authenticate(ctx, args, actorID)
+	if err != nil {
+		return err
+	}
+
+	user := actor
+	if userID != actorID {
+		err = requireActive(actor)
+		if err != nil {
+			return err
+		}
+		user, err = LoadUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = authorizeUserChange(ctx, actor, user)
+	if err != nil {
+		return err
+	}
+
+	current := userStatus(user)
+	switch {
+	case current == UserStatusDeactivated:
+		return errInvalidTransition("user %s is deactivated", userID)
+	case current == status:
+		return errConflict("user %s is already %s", userID, status)
+	case status == UserStatusActive && actor.UserID == user.UserID:
+		return errForbiddenRole("only an admin of the org can reactivate %s", userID)
+	}
+
+	user.Status = status
+	user.StatusReason = reason
+	user.StatusChangedBy = actor.UserID
+	return SaveUser(ctx, user)
+}
+
+// UpdateUserProfile changes the personal data of userID and optionally rotates
+// its password. The actor's password, and any of name, email, address, salt
+// and new_password to change, are passed in the transient map. A new password
+// comes with a fresh password_salt.
+func (t *SupplyChain) UpdateUserProfile(ctx contractapi.TransactionContextInterface, actorID string, userID string) error {
+	args := []string{actorID, userID}
+	actor, err := authenticate(ctx, args, actorID)
+	if err != nil {
+		return err
+	}
+	err = requireActive(actor)
+	if err != nil {
+		return err
+	}
+
+	user := actor
+	if userID != actorID {
+		user, err = LoadUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = authorizeUserChange(ctx, actor, user)
+	if err != nil {
+		return err
+	}
+	err = requireActive(user)
+	if err != nil {
+		return err
+	}
+
+	changes, err := readOptionalSensitive(ctx, args, TransientName, TransientEmail, TransientAddress, TransientSalt, TransientNewPassword, TransientPasswordSalt)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return errValidation("nothing to update, pass the changed fields in the transient map")
+	}
+
+	if newPassword, ok := changes[TransientNewPassword]; ok {
+		err = setPassword(ctx, user, newPassword, changes[TransientPasswordSalt])
+		if err != nil {
+			return err
+		}
+		delete(changes, TransientNewPassword)
+	}
+	delete(changes, TransientPasswordSalt)
+
+	if len(changes) > 0 {
+		pii, err := LoadUserPII(ctx, user)
+		if err != nil {
+			return err
+		}
+		if name, ok := changes[TransientName]; ok {
+			pii.Name = name
+		}
+		if email, ok := changes[TransientEmail]; ok {
+			pii.Email = email
+		}
+		if address, ok := changes[TransientAddress]; ok {
+			pii.Address = address
+		}
+		if salt, ok := changes[TransientSalt]; ok {
+			pii.Salt = salt
+		}
+
+		err = saveUserPII(ctx, user, pii)
+		if err != nil {
+			return err
+		}
+	}
+
+	return SaveUser(ctx, user)
+}
+
+// SuspendUser temporarily blocks userID, for example when its credentials are
+// compromised. Suspended users can not take part in any transfer.
+func (t *SupplyChain) SuspendUser(ctx contractapi.TransactionContextInterface, actorID string, userID string, reason string) error {
+	return setUserStatus(ctx, actorID, userID, reason, UserStatusSuspended)
+}
+
+// ReactivateUser lifts a suspension. Only an admin of the user's org can do so.
+func (t *SupplyChain) ReactivateUser(ctx contractapi.TransactionContextInterface, actorID string, userID string, reason string) error {
+	return setUserStatus(ctx, actorID, userID, reason, UserStatusActive)
+}
+
+// DeactivateUser permanently disables userID. The record is kept so products
+// that reference it stay consistent.
+func (t *SupplyChain) DeactivateUser(ctx contractapi.TransactionContextInterface, actorID string, userID string, reason string) error {
+	return setUserStatus(ctx, actorID, userID, reason, UserStatusDeactivated)
+}